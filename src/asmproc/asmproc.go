@@ -22,40 +22,53 @@ import (
 	lk "mpc/core/module/lexkind"
 	lck "mpc/core/module/localkind"
 	msg "mpc/messages"
+	"mpc/parallel"
 
+	"mpc/core/cc/cdecl"
+	"mpc/core/cc/gc"
+	regcc "mpc/core/cc/reg"
 	cc "mpc/core/cc/stack"
+	T "mpc/core/types"
 
 	"fmt"
 	"strconv"
 	"strings"
 )
 
-func GenAsmProcs(M *mod.Module) *Error {
+func GenAsmProcs(M *mod.Module) []*Error {
 	M.ResetVisited()
 	return genMod(M)
 }
 
-func genMod(M *mod.Module) *Error {
+func genMod(M *mod.Module) []*Error {
 	if M.Visited {
 		return nil
 	}
 	M.Visited = true
-	for _, dep := range M.Dependencies {
-		err := genMod(dep.M)
-		if err != nil {
-			return err
+	for _, dep := range M.SortedDependencies() {
+		errs := genMod(dep.M)
+		if len(errs) > 0 {
+			return errs
 		}
 	}
-	for _, sy := range M.Globals {
-		switch sy.Kind {
-		case gk.Proc:
-			err := genProc(M, sy)
-			if err != nil {
-				return err
-			}
+	procs := []*mod.Global{}
+	for _, sy := range M.SortedGlobals() {
+		if sy.Kind == gk.Proc {
+			procs = append(procs, sy)
 		}
 	}
-	return nil
+	// procedures only read the module, each writes its own Asm
+	results := make([]*Error, len(procs))
+	parallel.Each(len(procs), func(i int) {
+		results[i] = genProc(M, procs[i])
+	})
+	errs := []*Error{}
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
 }
 
 func genProc(M *mod.Module, sy *mod.Global) *Error {
@@ -200,7 +213,7 @@ func convertID(ctx context, op *mod.Node) (asm.Operand, *Error) {
 	if ok {
 		return reg, nil
 	}
-	special, ok := stringToSpecial(text)
+	special, ok := stringToSpecial(ctx, text)
 	if ok {
 		return special, nil
 	}
@@ -224,7 +237,13 @@ const (
 	retPrefix = "_ret"
 )
 
-func stringToSpecial(s string) (asm.Operand, bool) {
+// for collectors to find roots
+const stackMaps = "_stackmaps"
+
+func stringToSpecial(ctx context, s string) (asm.Operand, bool) {
+	if s == stackMaps {
+		return au.LabelOp(gc.StackMaps), true
+	}
 	start, end := au.FindDigits(s)
 	var num int
 	if start != -1 && end != -1 {
@@ -234,11 +253,18 @@ func stringToSpecial(s string) (asm.Operand, bool) {
 		}
 		num = int(n)
 	}
+	t := ctx.Sy.Proc.Type.Proc
 	if strings.HasPrefix(s, argPrefix) {
+		if r, ok := regcc.AsmRegister(t.CC, num); ok && num < len(t.Args) {
+			return au.Reg(r, au.TypeToTsize(t.Args[num])), true
+		}
 		offset := cc.Arg(num)
 		return au.ConstInt(offset), true
 	}
 	if strings.HasPrefix(s, retPrefix) {
+		if r, ok := regcc.AsmRegister(t.CC, num); ok && num < len(t.Rets) {
+			return au.Reg(r, au.TypeToTsize(t.Rets[num])), true
+		}
 		offset := cc.Ret(num)
 		return au.ConstInt(offset), true
 	}
@@ -263,6 +289,17 @@ func convLocalOp(ctx context, s string) (asm.Operand, bool) {
 		return au.BadOp(), false
 	}
 	if local.Kind == lck.Argument {
+		if proc.Type.Proc.CC == T.Cdecl {
+			// the first ones are in registers
+			if cdecl.InRegister(local.Position) {
+				return au.BadOp(), false
+			}
+			return au.ConstInt(cdecl.Arg(local.Position)), true
+		}
+		// and here they are the registers themselves
+		if r, ok := regcc.AsmRegister(proc.Type.Proc.CC, local.Position); ok {
+			return au.Reg(r, au.TypeToTsize(local.T)), true
+		}
 		offset := cc.Arg(local.Position)
 		return au.ConstInt(offset), true
 	} else if local.Kind == lck.Variable {
@@ -0,0 +1,154 @@
+package gen
+
+import (
+	"mpc/core/asm"
+	. "mpc/core/asm/instrkind"
+	. "mpc/core/asm/util"
+
+	"mpc/core/cc/cdecl"
+	cc "mpc/core/cc/stack"
+	T "mpc/core/types"
+
+	"mpc/backend0/mir"
+	mirc "mpc/backend0/mir/class"
+)
+
+var RBX = regMap(3)
+var R10 = regMap(10)
+var R11 = regMap(11)
+
+func regMap(id int) RegMap {
+	return RegMap{
+		QWord: Reg(id, asm.QuadWord),
+		DWord: Reg(id, asm.DoubleWord),
+		Word:  Reg(id, asm.Word),
+		Byte:  Reg(id, asm.Byte),
+	}
+}
+
+// the body of a cdecl procedure is a normal stack procedure,
+// the label of the procedure goes to the entry that adapts one to the other
+func bodyLabel(label string) string {
+	return label + ".body"
+}
+
+/*
+C calls us with the arguments in registers, so we build the
+frame that the body expects right below ours, call it,
+and bring the returns back to the registers.
+
+Since the body may use any register, we also save the ones
+that C expects to be preserved.
+*/
+func genCdeclEntry(proc *mir.Procedure) []asm.Line {
+	slots := len(proc.Args)
+	if len(proc.Rets) > slots {
+		slots = len(proc.Rets)
+	}
+	output := []asm.Line{
+		LabelLine(proc.Label),
+		Unary(Push, RBP),
+		Bin(Mov, RBP, RSP),
+	}
+	for _, r := range cdecl.CalleeSaved {
+		output = append(output, Unary(Push, regMap(r).QWord))
+	}
+	if slots > 0 {
+		output = append(output, Bin(Sub, RSP, ConstInt(8*slots)))
+	}
+	for i, arg := range proc.Args {
+		dest := AddrStack(cc.Outgoing(i), TypeToTsize(arg))
+		if cdecl.InRegister(i) {
+			r := regMap(cdecl.Args[i])
+			output = append(output, Bin(Mov, dest, _genReg(r, arg)))
+			continue
+		}
+		source := AddrFrame(cdecl.Arg(i), TypeToTsize(arg))
+		output = append(output,
+			Bin(Mov, _genReg(R10, arg), source),
+			Bin(Mov, dest, _genReg(R10, arg)),
+		)
+	}
+	output = append(output, Unary(Call, LabelOp(bodyLabel(proc.Label))))
+	for i, ret := range proc.Rets {
+		source := AddrStack(cc.Outgoing(i), TypeToTsize(ret))
+		output = append(output, loadExtended(regMap(cdecl.Rets[i]), source, ret))
+	}
+	if slots > 0 {
+		output = append(output, Bin(Add, RSP, ConstInt(8*slots)))
+	}
+	for i := len(cdecl.CalleeSaved) - 1; i >= 0; i-- {
+		r := cdecl.CalleeSaved[i]
+		output = append(output, Unary(Pop, regMap(r).QWord))
+	}
+	return append(output, Unary(Pop, RBP), Plain(Ret))
+}
+
+/*
+Arguments are already in the callee interproc slots, as in any other
+call, we move them to where C expects and store the returns back
+in the slots, where the register allocator expects them.
+
+At this point no register holds a live value, except the one
+with the callee. rbx is preserved by the callee, so it keeps
+the old rsp while we align the stack.
+*/
+func genCdeclCall(P *mir.Program, proc *mir.Procedure, instr mir.Instr) []asm.Line {
+	t := instr.A.Type.Proc
+	slot := func(i int, t *T.Type) asm.Operand {
+		op := mir.Operand{Class: mirc.CalleeInterproc, ID: int64(i), Type: t}
+		return convertOperandProc(P, proc, op)
+	}
+
+	callee := convertOperandProc(P, proc, instr.A.Op())
+	output := []asm.Line{
+		Bin(Mov, R11.QWord, callee),
+		Bin(Mov, RBX.QWord, RSP),
+	}
+	numStack := len(t.Args) - len(cdecl.Args)
+	if numStack > 0 {
+		output = append(output, Bin(Sub, RSP, ConstInt(8*numStack)))
+	}
+	output = append(output, Bin(And, RSP, ConstInt(-cdecl.StackAlign)))
+	for i, arg := range t.Args {
+		if cdecl.InRegister(i) {
+			continue
+		}
+		dest := AddrStack(cdecl.CallArg(i), TypeToTsize(arg))
+		output = append(output,
+			Bin(Mov, _genReg(R10, arg), slot(i, arg)),
+			Bin(Mov, dest, _genReg(R10, arg)),
+		)
+	}
+	for i, arg := range t.Args {
+		if !cdecl.InRegister(i) {
+			break
+		}
+		r := regMap(cdecl.Args[i])
+		output = append(output, loadExtended(r, slot(i, arg), arg))
+	}
+	output = append(output,
+		Bin(Xor, RAX.DWord, RAX.DWord), // no vector arguments, for variadic procedures
+		Unary(Call, R11.QWord),
+		Bin(Mov, RSP, RBX.QWord),
+	)
+	for i, ret := range t.Rets {
+		r := regMap(cdecl.Rets[i])
+		output = append(output, Bin(Mov, slot(i, ret), _genReg(r, ret)))
+	}
+	return output
+}
+
+// C compilers expect small integers to be extended to 32 bits
+func loadExtended(dest RegMap, source asm.Operand, t *T.Type) asm.Line {
+	switch t.Size() {
+	case 1, 2:
+		if T.IsSigned(t) {
+			return Bin(Movsx, dest.DWord, source)
+		}
+		return Bin(Movzx, dest.DWord, source)
+	case 4:
+		return Bin(Mov, dest.DWord, source)
+	}
+	return Bin(Mov, dest.QWord, source)
+}
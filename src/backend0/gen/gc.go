@@ -0,0 +1,88 @@
+package gen
+
+import (
+	"mpc/core/asm"
+	. "mpc/core/asm/instrkind"
+	. "mpc/core/asm/util"
+
+	"mpc/core/cc/gc"
+	cc "mpc/core/cc/stack"
+	T "mpc/core/types"
+
+	"mpc/backend0/mir"
+	mirc "mpc/backend0/mir/class"
+
+	"math/big"
+	"strconv"
+)
+
+// see core/cc/gc for the layout
+func genStackMaps(P *mir.Program) (asm.Data, bool) {
+	hasGC := false
+	count := 0
+	entries := []asm.DataEntry{}
+	for _, sy := range P.Symbols {
+		if sy.Proc == nil || sy.Proc.CC != T.GC {
+			continue
+		}
+		hasGC = true
+		for _, m := range sy.Proc.StackMaps {
+			count++
+			entries = append(entries,
+				asm.DataEntry{Type: asm.QuadWord, Label: sy.Proc.Label + stackMapLabel(m)},
+				qword(len(m.Roots)),
+			)
+			for _, root := range m.Roots {
+				entries = append(entries, qword(slotOffset(sy.Proc, root)))
+			}
+		}
+	}
+	entries = append([]asm.DataEntry{qword(count)}, entries...)
+	return asm.Data{Label: gc.StackMaps, Blob: entries}, hasGC
+}
+
+func qword(n int) asm.DataEntry {
+	return asm.DataEntry{Type: asm.QuadWord, Num: big.NewInt(int64(n))}
+}
+
+// local label right after the call, the return address
+func stackMapLabel(m *mir.StackMap) string {
+	return ".gc" + strconv.Itoa(m.ID)
+}
+
+func slotOffset(proc *mir.Procedure, op mir.Operand) int {
+	switch op.Class {
+	case mirc.Local:
+		return cc.Var(int(op.ID))
+	case mirc.Spill:
+		return cc.Spill(proc.NumOfVars, int(op.ID))
+	case mirc.CalleeInterproc:
+		return cc.CallArg(proc.NumOfVars, proc.NumOfSpills, proc.NumOfMaxCalleeArguments, int(op.ID))
+	}
+	panic("not a frame slot: " + op.String())
+}
+
+// the collector may look at pointer variables before they're assigned
+func genZeroPointers(proc *mir.Procedure) []asm.Line {
+	output := []asm.Line{}
+	for i, t := range proc.Vars {
+		if T.IsPtr(t) {
+			dest := AddrFrame(cc.Var(i), asm.QuadWord)
+			output = append(output, Bin(Mov, dest, ConstInt(0)))
+		}
+	}
+	return output
+}
+
+// the label goes right after the call instruction,
+// which may not be the last one
+func addStackMapLabel(lines []asm.Line, m *mir.StackMap) []asm.Line {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if !lines[i].IsLabel && lines[i].Instr.Kind == Call {
+			output := append([]asm.Line{}, lines[:i+1]...)
+			output = append(output, LabelLine(stackMapLabel(m)))
+			return append(output, lines[i+1:]...)
+		}
+	}
+	panic("call without call instruction")
+}
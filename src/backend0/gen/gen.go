@@ -21,7 +21,11 @@ func Generate(P *mir.Program) *asm.Program {
 	output := &asm.Program{
 		Writable:   []asm.Data{},
 		Readonly:   []asm.Data{},
-		Executable: genEntry(P),
+		Executable: []asm.Line{},
+	}
+	if P.Entry != mir.NoEntry {
+		output.Executable = genEntry(P)
+		output.Entry = true
 	}
 
 	for _, sy := range P.Symbols {
@@ -29,25 +33,66 @@ func Generate(P *mir.Program) *asm.Program {
 			proc := genProc(P, sy.Proc)
 			output.Executable = append(output.Executable, proc...)
 		}
-		if sy.Mem != nil {
+		if sy.Mem != nil && !sy.Mem.Extern {
 			mem := genMem(sy.Mem)
 			output.Writable = append(output.Writable, mem)
 		}
 	}
+	if maps, ok := genStackMaps(P); ok {
+		output.Readonly = append(output.Readonly, maps)
+	}
 	return output
 }
 
-// for now this is ok
+/*
+The kernel leaves argc at [rsp], followed by the argv pointers,
+a null pointer, and then the envp pointers. If main wants them,
+they're passed on the stack like any other stack procedure.
+
+If main returns something, it's the exit code, otherwise it's 0.
+*/
 func genEntry(P *mir.Program) []asm.Line {
 	entry := P.Symbols[P.Entry]
 	if entry == nil || entry.Proc == nil {
 		panic("nil entrypoint")
 	}
-	return []asm.Line{
+	output := []asm.Line{}
+	switch {
+	case len(entry.Proc.Args) > 0:
+		output = genMainArgs()
+	case len(entry.Proc.Rets) > 0:
+		// room for the return value, keeping rsp aligned
+		output = []asm.Line{Bin(Sub, RSP, ConstInt(16))}
+	}
+	output = append(output,
 		Unary(Call, LabelOp(entry.Proc.Label)),
-		Bin(Xor, RDI.QWord, RDI.QWord),    // EXIT CODE 0
+		Bin(Xor, RDI.QWord, RDI.QWord), // EXIT CODE 0
+	)
+	if len(entry.Proc.Rets) > 0 {
+		// like arguments, the return value is at the top of the stack
+		ret := entry.Proc.Rets[0]
+		output = append(output, loadExtended(RDI, AddrStack(0, TypeToTsize(ret)), ret))
+	}
+	return append(output,
 		Bin(Mov, RAX.QWord, ConstInt(60)), // EXIT
 		Plain(Syscall),
+	)
+}
+
+// 4 slots so that rsp stays aligned to 16 bytes
+func genMainArgs() []asm.Line {
+	return []asm.Line{
+		Bin(Mov, RAX.QWord, AddrStack(0, asm.QuadWord)), // argc
+		Bin(Mov, RCX.QWord, RSP),
+		Bin(Add, RCX.QWord, ConstInt(8)), // argv
+		Bin(Mov, RDX.QWord, RAX.QWord),
+		Bin(Shl, RDX.QWord, ConstInt(3)),
+		Bin(Add, RDX.QWord, RCX.QWord),
+		Bin(Add, RDX.QWord, ConstInt(8)), // envp, after the null pointer
+		Bin(Sub, RSP, ConstInt(32)),
+		Bin(Mov, AddrStack(0, asm.QuadWord), RAX.QWord),
+		Bin(Mov, AddrStack(8, asm.QuadWord), RCX.QWord),
+		Bin(Mov, AddrStack(16, asm.QuadWord), RDX.QWord),
 	}
 }
 
@@ -78,16 +123,28 @@ func genMem(mem *mir.DataDecl) asm.Data {
 }
 
 func genProc(P *mir.Program, proc *mir.Procedure) []asm.Line {
+	if proc.Extern {
+		return nil
+	}
 	if proc.Asm != nil {
 		op := LabelLine(proc.Label)
 		return append([]asm.Line{op}, proc.Asm...)
 	}
+	output := []asm.Line{}
+	label := proc.Label
+	if proc.CC == T.Cdecl {
+		output = genCdeclEntry(proc)
+		label = bodyLabel(proc.Label)
+	}
 	stackReserve := 8 * (proc.NumOfVars + proc.NumOfSpills + proc.NumOfMaxCalleeArguments)
-	output := []asm.Line{
-		LabelLine(proc.Label),
+	output = append(output, []asm.Line{
+		LabelLine(label),
 		Unary(Push, RBP),
 		Bin(Mov, RBP, RSP),
 		Bin(Sub, RSP, ConstInt(stackReserve)),
+	}...)
+	if proc.CC == T.GC {
+		output = append(output, genZeroPointers(proc)...)
 	}
 	proc.ResetBlocks()
 	body := genBlocks(P, proc, proc.FirstBlock())
@@ -99,6 +156,9 @@ func genBlocks(P *mir.Program, proc *mir.Procedure, start *mir.BasicBlock) []asm
 	trueBranches := []*mir.BasicBlock{}
 	falseBlocks := genFalseBranches(P, proc, start, &trueBranches)
 	for _, tBlock := range trueBranches {
+		if tBlock.Visited { // short circuits share targets
+			continue
+		}
 		out := genBlocks(P, proc, tBlock)
 		falseBlocks = append(falseBlocks, out...)
 	}
@@ -133,6 +193,11 @@ func genFalseBranches(P *mir.Program, proc *mir.Procedure, block *mir.BasicBlock
 		jmp := genCondJmp(P, proc, t, block.Out.V[0])
 		fb = append(fb, jmp...)
 		f := proc.GetBlock(block.Out.False)
+		if f.Visited {
+			jmp := Unary(Jmp, LabelOp(f.Label))
+			fb = append(fb, jmp)
+			return fb
+		}
 		out := genFalseBranches(P, proc, f, trueBranches)
 		out = append(fb, out...)
 		return out
@@ -228,10 +293,19 @@ func genInstr(P *mir.Program, proc *mir.Procedure, instr mir.Instr) []asm.Line {
 }
 
 func genCall(P *mir.Program, proc *mir.Procedure, instr mir.Instr) []asm.Line {
-	newA := convertOperandProc(P, proc, instr.A.Op())
-	return []asm.Line{
-		Unary(Call, newA),
+	var output []asm.Line
+	if instr.A.Type.Proc.CC == T.Cdecl {
+		output = genCdeclCall(P, proc, instr)
+	} else {
+		newA := convertOperandProc(P, proc, instr.A.Op())
+		output = []asm.Line{
+			Unary(Call, newA),
+		}
+	}
+	if instr.Map != nil {
+		output = addStackMapLabel(output, instr.Map)
 	}
+	return output
 }
 
 func genLoadStore(P *mir.Program, proc *mir.Procedure, instr mir.Instr) []asm.Line {
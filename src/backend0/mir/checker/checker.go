@@ -7,6 +7,7 @@ import (
 	IT "mpc/backend0/mir/instrkind"
 
 	. "mpc/core"
+	regcc "mpc/core/cc/reg"
 	T "mpc/core/types"
 	eu "mpc/core/util"
 
@@ -17,7 +18,7 @@ import (
 
 func Check(P *mir.Program) *Error {
 	for _, sy := range P.Symbols {
-		if sy.Proc != nil && sy.Proc.Asm == nil {
+		if sy.Proc != nil && sy.Proc.Asm == nil && !sy.Proc.Extern {
 			s := newState(P)
 			s.proc = sy.Proc
 			s.proc.ResetBlocks()
@@ -94,6 +95,10 @@ func newState(M *mir.Program) *state {
 
 func (s *state) Init() {
 	for i, arg := range s.proc.Args {
+		if r, ok := regcc.Register(s.proc.CC, i); ok {
+			s.SetReg(newRegOperand(arg, int64(r)))
+			continue
+		}
 		argOp := newCallerOperand(arg, int64(i))
 		s.CallerInterproc.Store(int64(i), argOp)
 	}
@@ -150,6 +155,14 @@ func newCallerOperand(t *T.Type, i int64) mir.Operand {
 	}
 }
 
+func newRegOperand(t *T.Type, i int64) mir.Operand {
+	return mir.Operand{
+		Class: mirc.Register,
+		ID:    i,
+		Type:  t,
+	}
+}
+
 func newLocalOperand(t *T.Type, i int64) mir.Operand {
 	return mir.Operand{
 		Class: mirc.Local,
@@ -196,6 +209,13 @@ func checkJump(s *state) *Error {
 
 func checkRet(s *state) *Error {
 	for i, ret := range s.proc.Rets {
+		if r, ok := regcc.Register(s.proc.CC, i); ok {
+			op, ok := s.Registers.Load(int64(r))
+			if !ok || !ret.Equals(op.Type) {
+				return eu.NewInternalSemanticError("return of type " + ret.String() + " doesn't match value in register: " + s.Registers.String())
+			}
+			continue
+		}
 		op, ok := s.CallerInterproc.Load(int64(i))
 		if !ok {
 			return eu.NewInternalSemanticError("return stack is empty, expected returns: " + s.proc.StrRets())
@@ -624,9 +644,24 @@ func checkCall(s *state, instr mir.Instr) *Error {
 		return malformedTypeOrClass(instr)
 	}
 
+	err = checkRegOperand(s, instr, instr.A)
+	if err != nil {
+		return err
+	}
+
 	t := instr.A.Type
 
 	for i, formal_arg := range t.Proc.Args {
+		if r, ok := regcc.Register(t.Proc.CC, i); ok {
+			real_arg, ok := s.Registers.Load(int64(r))
+			if !ok {
+				return errorCallLoadingGarbage(instr)
+			}
+			if !formal_arg.Equals(real_arg.Type) {
+				return procBadArg(instr, formal_arg, real_arg)
+			}
+			continue
+		}
 		real_arg, ok := s.CalleeInterproc.Load(int64(i))
 		if !ok {
 			return errorCallLoadingGarbage(instr)
@@ -638,6 +673,10 @@ func checkCall(s *state, instr mir.Instr) *Error {
 	}
 
 	for i, formal_ret := range t.Proc.Rets {
+		if r, ok := regcc.Register(t.Proc.CC, i); ok {
+			s.SetReg(newRegOperand(formal_ret, int64(r)))
+			continue
+		}
 		op := mir.Operand{Class: mirc.CalleeInterproc, ID: int64(i), Type: formal_ret}
 		s.CalleeInterproc.Store(int64(i), op)
 	}
@@ -0,0 +1,37 @@
+package mir
+
+import (
+	FT "mpc/backend0/mir/flowkind"
+	"mpc/core/dot"
+)
+
+// the control flow graph of each procedure, as a DOT graph
+func (this *Program) Dot() string {
+	g := dot.NewGraph(this.Name)
+	for _, sy := range this.Symbols {
+		if sy.Proc == nil || len(sy.Proc.AllBlocks) == 0 {
+			continue
+		}
+		proc := sy.Proc
+		g.Subgraph(proc.Label)
+		for i, b := range proc.AllBlocks {
+			lines := []string{b.Label + ":"}
+			for _, instr := range b.Code {
+				lines = append(lines, instr.String())
+			}
+			lines = append(lines, b.Out.String())
+			g.Node(proc.Label+b.Label, lines, BlockID(i) == proc.Start)
+		}
+		for _, b := range proc.AllBlocks {
+			from := proc.Label + b.Label
+			switch b.Out.T {
+			case FT.Jmp:
+				g.Edge(from, proc.Label+proc.GetBlock(b.Out.True).Label, "")
+			case FT.If:
+				g.Edge(from, proc.Label+proc.GetBlock(b.Out.True).Label, "true")
+				g.Edge(from, proc.Label+proc.GetBlock(b.Out.False).Label, "false")
+			}
+		}
+	}
+	return g.String()
+}
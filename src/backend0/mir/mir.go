@@ -14,6 +14,9 @@ import (
 // index into Program.Symbols array
 type SymbolID int
 
+// libraries have no main
+const NoEntry SymbolID = -1
+
 type Program struct {
 	Name    string
 	Entry   SymbolID
@@ -88,9 +91,13 @@ type DataDecl struct {
 	Size     *big.Int
 	Nums     []asm.DataEntry
 	DataSize int
+	Extern   bool // defined in another object
 }
 
 func (this *DataDecl) String() string {
+	if this.Extern {
+		return "extern " + this.Label
+	}
 	if this.Data != "" {
 		return this.Label + ": " + this.Data
 	}
@@ -99,6 +106,7 @@ func (this *DataDecl) String() string {
 
 type Procedure struct {
 	Label string
+	CC    T.CCKind
 	Vars  []*T.Type
 	Args  []*T.Type
 	Rets  []*T.Type
@@ -106,7 +114,10 @@ type Procedure struct {
 	Start     BlockID
 	AllBlocks []*BasicBlock
 
-	Asm []asm.Line
+	Asm    []asm.Line
+	Extern bool // only the label is known
+
+	StackMaps []*StackMap
 
 	NumOfVars               int
 	NumOfSpills             int
@@ -115,6 +126,9 @@ type Procedure struct {
 
 func (this *Procedure) String() string {
 	output := this.Label + "{\n"
+	if this.Extern {
+		output = "extern " + output
+	}
 	output += this.StrArgs() + "\n"
 	output += this.StrRets() + "\n"
 	output += this.StrLocals() + "\n"
@@ -313,6 +327,22 @@ type Instr struct {
 	A    OptOperand
 	B    OptOperand
 	Dest OptOperand
+
+	Map *StackMap // only for calls inside gc procedures
+}
+
+// frame slots that hold pointers while a call is happening
+type StackMap struct {
+	ID    int
+	Roots []Operand
+}
+
+func (this *StackMap) String() string {
+	output := []string{}
+	for _, op := range this.Roots {
+		output = append(output, op.String())
+	}
+	return "roots(" + strings.Join(output, ", ") + ")"
 }
 
 func (this *Instr) String() string {
@@ -336,5 +366,8 @@ func (this *Instr) String() string {
 	if this.Dest.Valid {
 		output += " -> " + this.Dest.String()
 	}
+	if this.Map != nil {
+		output += " " + this.Map.String()
+	}
 	return output
 }
@@ -18,9 +18,12 @@ import (
 	mik "mpc/backend0/mir/instrkind"
 	IRU "mpc/backend0/mir/util"
 
+	regcc "mpc/core/cc/reg"
 	T "mpc/core/types"
+	"mpc/parallel"
 
 	"math/big"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -84,6 +87,18 @@ func (s *stack) Pop() int {
 	return item
 }
 
+// takes an item from anywhere in the stack
+func (s *stack) Take(item int) bool {
+	for i := 0; i <= s.top; i++ {
+		if s.items[i] == item {
+			copy(s.items[i:], s.items[i+1:s.top+1])
+			s.top--
+			return true
+		}
+	}
+	return false
+}
+
 func (s *stack) Size() int {
 	return s.top
 }
@@ -283,11 +298,45 @@ func (s *state) AllocReg(v value, t *T.Type) reg {
 	return r
 }
 
+// like AllocReg, but for a specific register, which must be free
+func (s *state) TakeReg(r reg, v value, t *T.Type) {
+	if !s.AvailableRegs.Take(int(r)) {
+		panic("taking used register: " + strconv.Itoa(int(r)))
+	}
+	s.UsedRegs[r] = v
+	s.LiveValues[v] = useInfo{Place: Register, Num: int64(r), T: t}
+}
+
+// maps are iterated in random order, the output must not depend on it
+func (s *state) SortedLiveValues() []value {
+	output := make([]value, 0, len(s.LiveValues))
+	for v := range s.LiveValues {
+		output = append(output, v)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		if output[i].Class != output[j].Class {
+			return output[i].Class < output[j].Class
+		}
+		return output[i].ID < output[j].ID
+	})
+	return output
+}
+
+func (s *state) SortedUsedRegs() []reg {
+	output := make([]reg, 0, len(s.UsedRegs))
+	for r := range s.UsedRegs {
+		output = append(output, r)
+	}
+	sort.Slice(output, func(i, j int) bool { return output[i] < output[j] })
+	return output
+}
+
 func (s *state) FurthestUse(index int) (useInfo, value) {
 	biggestIndex := index
 	var outputInfo useInfo
 	var outputValue value
-	for v, info := range s.LiveValues {
+	for _, v := range s.SortedLiveValues() {
+		info := s.LiveValues[v]
 		lastUse := s.valueUse[v]
 		if info.Place == Register && lastUse > biggestIndex {
 			biggestIndex = lastUse
@@ -337,13 +386,15 @@ func (s *state) AddInstr(instr mir.Instr) {
 
 func (s *state) String() string {
 	livevalues := "Live Values ["
-	for value, useinfo := range s.LiveValues {
+	for _, value := range s.SortedLiveValues() {
+		useinfo := s.LiveValues[value]
 		livevalues += "(" + value.String() + ", " + useinfo.String() + ") "
 	}
 	livevalues += "]"
 
 	registers := "Used Regs ["
-	for r, v := range s.UsedRegs {
+	for _, r := range s.SortedUsedRegs() {
+		v := s.UsedRegs[r]
 		rStr := strconv.FormatInt(int64(r), 10)
 		vStr := v.String()
 		registers += "(" + rStr + ", " + vStr + ")"
@@ -362,7 +413,9 @@ func Allocate(P *pir.Program, numRegs int) *mir.Program {
 	// if pir.SymbolID != mir.SymbolID then
 	// a few procedures will crash. Must keep the index
 	// consistent.
-	for i, sy := range P.Symbols {
+	// procedures are independent of each other
+	parallel.Each(len(P.Symbols), func(i int) {
+		sy := P.Symbols[i]
 		if sy.Proc != nil {
 			proc := allocProc(P, sy.Proc, numRegs)
 			output.Symbols[i] = &mir.Symbol{Proc: proc}
@@ -371,13 +424,13 @@ func Allocate(P *pir.Program, numRegs int) *mir.Program {
 			mem := hirToMirMem(sy.Mem)
 			output.Symbols[i] = &mir.Symbol{Mem: mem}
 		}
-	}
+	})
 	return output
 }
 
 func allocProc(Program *pir.Program, proc *pir.Procedure, numRegs int) *mir.Procedure {
 	outProc := hirToMirProc(proc)
-	if outProc.Asm != nil {
+	if outProc.Asm != nil || outProc.Extern {
 		return outProc
 	}
 	outProc.AllBlocks = make([]*mir.BasicBlock, len(proc.AllBlocks))
@@ -389,12 +442,15 @@ func allocProc(Program *pir.Program, proc *pir.Procedure, numRegs int) *mir.Proc
 		s.hirProc = proc
 		s.hirBlock = curr
 		findUses(s)
+		if i == int(proc.Start) {
+			receiveArgs(s)
+		}
 		allocBlock(s)
 		calcRegions(s)
 		// preserve the BlockIDs
 		outProc.AllBlocks[i] = s.outputBlock
 	}
-	outProc.NumOfVars = len(proc.Vars)
+	outProc.NumOfVars = len(proc.Vars) + regcc.InRegisters(proc.CC, len(proc.Args))
 	return outProc
 }
 
@@ -421,9 +477,20 @@ func transformReturn(s *state) {
 		Op    pir.Operand
 	}
 
+	rets := s.hirBlock.Out.V
+	numRegs := regcc.InRegisters(s.hirProc.CC, len(rets))
+	moves := []move{}
+	inRegs := map[value]bool{}
+	for i, ret := range rets[:numRegs] {
+		r := reg(regcc.Registers(s.hirProc.CC)[i])
+		moves = append(moves, move{Op: ret, Target: r})
+		inRegs[toValue(ret)] = true
+	}
+
 	notAlive := []RetVal{}
 	// load the already immediate ones first
-	for i, ret := range s.hirBlock.Out.V {
+	for i := numRegs; i < len(rets); i++ {
+		ret := rets[i]
 		rVal := toValue(ret)
 		info, ok := s.LiveValues[rVal]
 		if ok && info.Place == Register {
@@ -432,7 +499,9 @@ func transformReturn(s *state) {
 			callerInterproc := newOp(ret.Type, mc.CallerInterproc, int64(i), nil)
 			loadRet := IRU.Store(regOp, callerInterproc)
 			s.AddInstr(loadRet)
-			s.Free(rVal)
+			if !inRegs[rVal] {
+				s.Free(rVal)
+			}
 		} else {
 			rv := RetVal{Index: int64(i), Op: ret}
 			notAlive = append(notAlive, rv)
@@ -448,11 +517,13 @@ func transformReturn(s *state) {
 		loadRet := IRU.Store(immediateRet, callerInterproc)
 		s.AddInstr(loadRet)
 	}
+	// nothing is allocated after this
+	placeInRegs(s, moves)
 	s.outputBlock.Out.V = nil
 }
 
 func moveArgIfNeeded(s *state, pos int) {
-	if pos >= len(s.hirProc.Args) {
+	if pos >= len(s.hirProc.Args) || isRegArg(s.hirProc, int64(pos)) {
 		return
 	}
 	op := pir.Operand{
@@ -659,15 +730,20 @@ func corruptOldVersion(s *state, op pir.Operand) {
 // ret1 is assumed to be in interproc1
 // retN is assumed to be in interprocN
 func allocCall(s *state, instr pir.Instr, index int) {
+	if regcc.IsReg(instr.Operands[0].Type.Proc.CC) {
+		allocRegCall(s, instr, index)
+		return
+	}
 	// TODO: OPT: spillAllLiveInterproc should only spill the ones being corrupted
 	spillAllLiveRegisters(s, index) // these need to be in order
 	spillAllLiveInterproc(s, index)
-	loadArguments(s, instr, index)
+	loadArguments(s, instr, index, 0, nil)
 	// TODO: OPT: clearVolatiles should only clear the ones being corrupted
 	clearVolatiles(s)
 
 	outInstr := hirToMirInstr(instr)
 	outInstr.A = mir.OptOperand_(ensureImmediate(s, index, instr.Operands[0]))
+	outInstr.Map = stackMap(s, instr.Operands[1:], 0)
 	s.AddInstr(outInstr)
 
 	for i, dest := range instr.Destination {
@@ -680,8 +756,7 @@ func allocCall(s *state, instr pir.Instr, index int) {
 			load, op := loadCalleeInterproc(s, callee, v, dest.Type, index)
 			s.AddInstr(load)
 			r := reg(op.ID)
-			arg := callerInterproc(v.ID)
-			store := storeArg(r, arg, dest.Type)
+			store := storeArg(s, r, v.ID, dest.Type)
 			s.AddInstr(store)
 		case pc.Variable:
 			load, op := loadCalleeInterproc(s, callee, v, dest.Type, index)
@@ -698,9 +773,264 @@ func allocCall(s *state, instr pir.Instr, index int) {
 	s.UpdateMaxCalleeInterproc(len(instr.Operands)-1, len(instr.Destination))
 }
 
+// for register conventions, the first arguments go in registers:
+//
+//	store argN -> interprocN (for those that don't fit)
+//	copy arg1 -> r0
+//	...
+//	copy <proc> -> rN+1
+//	call rN+1
+//
+// and the first returns are in the same registers.
+func allocRegCall(s *state, instr pir.Instr, index int) {
+	proc := instr.Operands[0]
+	args := instr.Operands[1:]
+	regs := regcc.Registers(proc.Type.Proc.CC)
+	numRegs := regcc.InRegisters(proc.Type.Proc.CC, len(args))
+
+	spillAllLiveRegisters(s, index)
+	spillAllLiveInterproc(s, index)
+
+	moves := []move{}
+	for i, arg := range args[:numRegs] {
+		moves = append(moves, move{Op: arg, Target: reg(regs[i])})
+	}
+	callee := toMircOpt(s, proc)
+	if proc.Class != pc.Lit && proc.Class != pc.Global {
+		// the register right after the convention's ones
+		r := reg(regs[len(regs)-1] + 1)
+		moves = append(moves, move{Op: proc, Target: r})
+		callee = mir.OptOperand_(newRegOp(r, proc.Type))
+	}
+	inRegs := map[value]bool{}
+	for _, m := range moves {
+		inRegs[toValue(m.Op)] = true
+	}
+	loadArguments(s, instr, index, numRegs, inRegs)
+	placeInRegs(s, moves)
+	clearVolatiles(s)
+
+	outInstr := hirToMirInstr(instr)
+	outInstr.A = callee
+	outInstr.Map = stackMap(s, args, numRegs)
+	s.AddInstr(outInstr)
+
+	numRets := regcc.InRegisters(proc.Type.Proc.CC, len(instr.Destination))
+	for i, dest := range instr.Destination[:numRets] {
+		v := toValue(dest)
+		s.TakeReg(reg(regs[i]), v, proc.Type.Proc.Rets[i])
+		if dest.Class == pc.Variable || dest.Class == pc.Arg {
+			s.Mark(v)
+		}
+	}
+	for i := numRets; i < len(instr.Destination); i++ {
+		dest := instr.Destination[i]
+		v := toValue(dest)
+		callee := calleeInterproc(i)
+		switch dest.Class {
+		case pc.Temp:
+			s.LiveValues[v] = useInfo{Place: CalleeInterProc, Num: int64(i), T: dest.Type}
+		case pc.Arg:
+			load, op := loadCalleeInterproc(s, callee, v, dest.Type, index)
+			s.AddInstr(load)
+			s.AddInstr(storeArg(s, reg(op.ID), v.ID, dest.Type))
+		case pc.Variable:
+			load, op := loadCalleeInterproc(s, callee, v, dest.Type, index)
+			s.AddInstr(load)
+			s.AddInstr(storeLocal(reg(op.ID), v.ID, dest.Type))
+		}
+	}
+	for _, op := range instr.Operands {
+		freeIfNotNeededAndNotMutated(s, index, instr, toValue(op))
+	}
+
+	s.UpdateMaxCalleeInterproc(len(args), len(instr.Destination))
+}
+
+/*
+Inside gc procedures, every call records which slots of the frame
+hold pointers: pointer variables (zeroed at the start of the procedure),
+live spills and the arguments being passed, from first onwards.
+
+Values in registers were already saved by now. The procedure's
+own arguments live in the caller's frame, so they're found in
+the caller's map, if it has one.
+*/
+func stackMap(s *state, args []pir.Operand, first int) *mir.StackMap {
+	if s.hirProc.CC != T.GC {
+		return nil
+	}
+	roots := []mir.Operand{}
+	for i, t := range s.hirProc.Vars {
+		if T.IsPtr(t) {
+			roots = append(roots, newLocalOperand(int64(i), t))
+		}
+	}
+	spills := []mir.Operand{}
+	for _, info := range s.LiveValues {
+		if info.Place == Spill && T.IsPtr(info.T) {
+			spills = append(spills, newSpillOperand(spill(info.Num), info.T))
+		}
+	}
+	sort.Slice(spills, func(i, j int) bool {
+		return spills[i].ID < spills[j].ID
+	})
+	roots = append(roots, spills...)
+	for i := first; i < len(args); i++ {
+		if T.IsPtr(args[i].Type) {
+			roots = append(roots, newCalleeInterprocOperand(calleeInterproc(i), args[i].Type))
+		}
+	}
+	m := &mir.StackMap{ID: len(s.outputProc.StackMaps), Roots: roots}
+	s.outputProc.StackMaps = append(s.outputProc.StackMaps, m)
+	return m
+}
+
+// register arguments start in their registers,
+// as if they were just assigned
+func receiveArgs(s *state) {
+	proc := s.hirProc
+	regs := regcc.Registers(proc.CC)
+	for i := 0; i < regcc.InRegisters(proc.CC, len(proc.Args)); i++ {
+		r := reg(regs[i])
+		v := value{Class: pc.Arg, ID: int64(i)}
+		s.TakeReg(r, v, proc.Args[i])
+		s.Mark(v)
+		if _, used := s.valueUse[v]; !used {
+			s.AddInstr(storeArg(s, r, v.ID, proc.Args[i]))
+			s.Free(v)
+		}
+	}
+}
+
+type move struct {
+	Op     pir.Operand
+	Target reg
+}
+
+/*
+Puts each operand in its register, as if all at the same time.
+
+Values already in registers go first, a move waits while its target
+holds a value that another move still needs, and cycles are broken
+by sending one of the values to memory. Values in memory and literals
+are loaded last, when nothing else needs their targets.
+
+Whatever else is in the registers must be either dead or already
+saved in memory, since after this no register is tracked anymore.
+*/
+func placeInRegs(s *state, moves []move) {
+	source := make([]reg, len(moves))
+	inReg := make([]bool, len(moves))
+	isSource := map[reg]bool{}
+	for i, m := range moves {
+		if !isValue(m.Op) {
+			continue
+		}
+		info, ok := s.LiveValues[toValue(m.Op)]
+		if ok && info.Place == Register {
+			source[i], inReg[i] = reg(info.Num), true
+			isSource[source[i]] = true
+		}
+	}
+	for _, m := range moves {
+		v, ok := s.UsedRegs[m.Target]
+		if ok && !isSource[m.Target] {
+			s.Free(v)
+		}
+	}
+
+	pending := []int{}
+	for i, m := range moves {
+		if inReg[i] && source[i] != m.Target {
+			pending = append(pending, i)
+		}
+	}
+	blocked := func(r reg) bool {
+		for _, j := range pending {
+			if source[j] == r {
+				return true
+			}
+		}
+		return false
+	}
+	for len(pending) > 0 {
+		next := -1
+		for k, i := range pending {
+			if !blocked(moves[i].Target) {
+				next = k
+				break
+			}
+		}
+		if next == -1 { // only cycles left
+			r := source[pending[0]]
+			sendToMemory(s, r)
+			left := []int{}
+			for _, j := range pending {
+				if source[j] == r {
+					inReg[j] = false
+				} else {
+					left = append(left, j)
+				}
+			}
+			pending = left
+			continue
+		}
+		i := pending[next]
+		t := moves[i].Op.Type
+		s.AddInstr(IRU.Copy(newRegOp(source[i], t), newRegOp(moves[i].Target, t)))
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+
+	for i, m := range moves {
+		if inReg[i] {
+			continue
+		}
+		target := newRegOp(m.Target, m.Op.Type)
+		if isValue(m.Op) {
+			s.AddInstr(IRU.Load(toMirc(s, m.Op), target))
+		} else {
+			s.AddInstr(IRU.Copy(toMirc(s, m.Op), target))
+		}
+	}
+
+	// the registers now hold the moves, not what the state says
+	for _, r := range s.SortedUsedRegs() {
+		v := s.UsedRegs[r]
+		if s.LiveValues[v].Place == Register && reg(s.LiveValues[v].Num) == r {
+			s.Free(v)
+		}
+	}
+}
+
+// stores the value in the register to memory, where it's loaded from later
+func sendToMemory(s *state, r reg) {
+	v := s.UsedRegs[r]
+	info := s.LiveValues[v]
+	switch v.Class {
+	case pc.Temp:
+		s.AddInstr(spillTemp(s, r, info.T))
+	case pc.Variable:
+		if info.Mutated {
+			s.AddInstr(storeLocal(r, v.ID, info.T))
+		}
+		s.Free(v)
+	case pc.Arg:
+		if info.Mutated {
+			s.AddInstr(storeArg(s, r, v.ID, info.T))
+		}
+		s.Free(v)
+	}
+}
+
+func isValue(op pir.Operand) bool {
+	return op.Class == pc.Temp || op.Class == pc.Variable || op.Class == pc.Arg
+}
+
 func clearVolatiles(s *state) {
 	toFree := []value{}
-	for val, info := range s.LiveValues {
+	for _, val := range s.SortedLiveValues() {
+		info := s.LiveValues[val]
 		if info.Place != Local && info.Place != Spill {
 			toFree = append(toFree, val)
 		}
@@ -710,9 +1040,14 @@ func clearVolatiles(s *state) {
 	}
 }
 
-func loadArguments(s *state, instr pir.Instr, index int) {
+// arguments before first are passed elsewhere, values in keep
+// are needed there and must not be freed
+func loadArguments(s *state, instr pir.Instr, index int, first int, keep map[value]bool) {
 	// ensure immediate, then store
 	for i, op := range instr.Operands[1:] {
+		if i < first {
+			continue
+		}
 		v := toValue(op)
 		info, ok := s.LiveValues[v]
 		if ok && info.Place == CalleeInterProc && info.Num == int64(i) {
@@ -724,7 +1059,9 @@ func loadArguments(s *state, instr pir.Instr, index int) {
 		storeArg := IRU.Store(immediate, arg)
 		s.AddInstr(storeArg)
 
-		freeIfNotNeededAndNotMutated(s, index, instr, v)
+		if !keep[v] {
+			freeIfNotNeededAndNotMutated(s, index, instr, v)
+		}
 	}
 }
 
@@ -757,7 +1094,7 @@ func toMirc(s *state, o pir.Operand) mir.Operand {
 	case pc.Variable:
 		return newOp(o.Type, mc.Local, o.ID, o.Num)
 	case pc.Arg:
-		return newOp(o.Type, mc.CallerInterproc, o.ID, o.Num)
+		return argHome(s, o.ID, o.Type)
 	case pc.Global:
 		return newOp(o.Type, mc.Static, o.ID, o.Num)
 	case pc.Lit:
@@ -767,7 +1104,8 @@ func toMirc(s *state, o pir.Operand) mir.Operand {
 }
 
 func storeLiveLocals(s *state) {
-	for val, info := range s.LiveValues {
+	for _, val := range s.SortedLiveValues() {
+		info := s.LiveValues[val]
 		if info.Place == Register && info.Mutated {
 			if val.Class == pc.Variable {
 				r := reg(info.Num)
@@ -776,8 +1114,7 @@ func storeLiveLocals(s *state) {
 			}
 			if val.Class == pc.Arg {
 				r := reg(info.Num)
-				it := callerInterproc(val.ID)
-				instr := storeArg(r, it, info.T)
+				instr := storeArg(s, r, val.ID, info.T)
 				s.AddInstr(instr)
 			}
 		}
@@ -785,7 +1122,8 @@ func storeLiveLocals(s *state) {
 }
 
 func spillAllLiveInterproc(s *state, index int) {
-	for val, info := range s.LiveValues {
+	for _, val := range s.SortedLiveValues() {
+		info := s.LiveValues[val]
 		lastUse := s.valueUse[val]
 		if info.Place == CalleeInterProc && lastUse >= index {
 			callee := calleeInterproc(info.Num)
@@ -809,7 +1147,8 @@ func spillAllLiveInterproc(s *state, index int) {
 }
 
 func spillAllLiveRegisters(s *state, index int) {
-	for val, info := range s.LiveValues {
+	for _, val := range s.SortedLiveValues() {
+		info := s.LiveValues[val]
 		if info.Place == Register && (isNeeded(s, index, val) || info.Mutated) {
 			switch val.Class {
 			case pc.Variable:
@@ -817,8 +1156,7 @@ func spillAllLiveRegisters(s *state, index int) {
 				s.AddInstr(storeLocal(r, val.ID, info.T))
 			case pc.Arg:
 				r := reg(info.Num)
-				arg := callerInterproc(val.ID)
-				s.AddInstr(storeArg(r, arg, info.T))
+				s.AddInstr(storeArg(s, r, val.ID, info.T))
 			case pc.Temp:
 				s.AddInstr(spillTemp(s, reg(info.Num), info.T))
 			}
@@ -920,7 +1258,7 @@ func _loadLocal(s *state, v value, t *T.Type, index int) (mir.Instr, mir.Operand
 }
 
 func _loadArg(s *state, v value, t *T.Type, index int) (mir.Instr, mir.Operand) {
-	newOp := newCallerInterprocOperand(callerInterproc(v.ID), t)
+	newOp := argHome(s, v.ID, t)
 	rOp := _allocReg(s, v, t, index)
 	load := IRU.Load(newOp, rOp)
 	return load, rOp
@@ -954,8 +1292,7 @@ func _allocReg(s *state, v value, t *T.Type, index int) mir.Operand {
 		s.Free(val)
 	case pc.Arg:
 		if info.Mutated {
-			arg := callerInterproc(val.ID)
-			s.AddInstr(storeArg(reg(info.Num), arg, info.T))
+			s.AddInstr(storeArg(s, reg(info.Num), val.ID, info.T))
 		}
 		s.Free(val)
 	case pc.Lit, pc.Global:
@@ -982,12 +1319,25 @@ func storeLocal(r reg, position int64, t *T.Type) mir.Instr {
 	return IRU.Store(reg, loc)
 }
 
-func storeArg(r reg, num callerInterproc, t *T.Type) mir.Instr {
+func storeArg(s *state, r reg, id int64, t *T.Type) mir.Instr {
 	reg := newRegOp(r, t)
-	loc := newCallerInterprocOperand(num, t)
+	loc := argHome(s, id, t)
 	return IRU.Store(reg, loc)
 }
 
+// register arguments are kept in local slots after the variables,
+// the others in the caller's frame
+func argHome(s *state, id int64, t *T.Type) mir.Operand {
+	if isRegArg(s.hirProc, id) {
+		return newLocalOperand(int64(len(s.hirProc.Vars))+id, t)
+	}
+	return newCallerInterprocOperand(callerInterproc(id), t)
+}
+
+func isRegArg(proc *pir.Procedure, id int64) bool {
+	return id < int64(regcc.InRegisters(proc.CC, len(proc.Args)))
+}
+
 func newRegOp(r reg, t *T.Type) mir.Operand {
 	return mir.Operand{
 		Class: mc.Register,
@@ -1066,11 +1416,13 @@ func toValue(op pir.Operand) value {
 func hirToMirProc(proc *pir.Procedure) *mir.Procedure {
 	return &mir.Procedure{
 		Label:                   proc.Label,
+		CC:                      proc.CC,
 		Vars:                    proc.Vars,
 		Args:                    proc.Args,
 		Rets:                    proc.Rets,
 		Start:                   mir.BlockID(proc.Start),
 		Asm:                     proc.Asm,
+		Extern:                  proc.Extern,
 		NumOfVars:               0,
 		NumOfSpills:             0,
 		NumOfMaxCalleeArguments: 0,
@@ -1171,6 +1523,7 @@ func hirToMirMem(mem *pir.DataDecl) *mir.DataDecl {
 		DataSize: mem.DataSize,
 		Size:     mem.Size,
 		Nums:     mem.Nums,
+		Extern:   mem.Extern,
 	}
 }
 
@@ -0,0 +1,142 @@
+/*
+The build cache keeps, for each module, its interface and its
+object, as produced by separate compilation. Entries are keyed
+by the hash of the module: its source and the hashes of its
+dependencies, so any change below a module invalidates it.
+
+The interface stands for the typechecked exports, and the object
+for the generated code, so a hit skips the backend too. The price
+is that objects are linked by ld, see the readme.
+*/
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// where entries are kept, empty disables the cache
+var Dir string
+
+var Hits, Misses int
+
+const (
+	interfaceExt = ".mpi"
+	objectExt    = ".o"
+)
+
+// $XDG_CACHE_HOME/mpc, or ~/.cache/mpc. cached objects are
+// linked by ld, without it there's no cache
+func DefaultDir() string {
+	if _, err := exec.LookPath("ld"); err != nil {
+		return ""
+	}
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		base = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(base, "mpc")
+}
+
+func Enabled() bool {
+	return Dir != ""
+}
+
+// the output of a different compiler is not reused
+var compiler = compilerID()
+
+func compilerID() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return ""
+	}
+	return exe + ":" + strconv.FormatInt(info.Size(), 10) + ":" + info.ModTime().String()
+}
+
+// deps are the hashes of the dependencies, in a fixed order
+func Key(modID, source string, deps []string) string {
+	h := sha256.New()
+	for _, s := range append([]string{compiler, modID, source}, deps...) {
+		h.Write([]byte(strconv.Itoa(len(s)) + ":" + s))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// returns the paths of the interface and object of the entry
+func Lookup(key string) (string, string, bool) {
+	if !Enabled() {
+		return "", "", false
+	}
+	iface := filepath.Join(Dir, key+interfaceExt)
+	object := filepath.Join(Dir, key+objectExt)
+	_, err := os.Stat(iface)
+	if err != nil {
+		Misses++
+		return "", "", false
+	}
+	_, err = os.Stat(object)
+	if err != nil {
+		Misses++
+		return "", "", false
+	}
+	Hits++
+	return iface, object, true
+}
+
+// the interface is written last, entries without it
+// are never looked at. returns the path of the object
+func Store(key string, iface string, object []byte) (string, error) {
+	err := os.MkdirAll(Dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(Dir, ObjectName(key))
+	err = writeFile(path, object)
+	if err != nil {
+		return "", err
+	}
+	return path, writeFile(filepath.Join(Dir, key+interfaceExt), []byte(iface))
+}
+
+// relative to the interface
+func ObjectName(key string) string {
+	return key + objectExt
+}
+
+// other compilers may be reading the cache at the same time
+func writeFile(path string, contents []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "tmp_*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func Report() string {
+	if !Enabled() {
+		return "cache: off\n"
+	}
+	return "cache: " + strconv.Itoa(Hits) + " hits, " + strconv.Itoa(Misses) + " misses\n"
+}
@@ -62,39 +62,47 @@ func getMinMax(t *T.Type) (*big.Int, *big.Int) {
 	}
 }
 
-func EvalConstExprs(m *mod.Module) *Error {
+func EvalConstExprs(m *mod.Module) []*Error {
 	m.ResetVisited()
-	err := evalModule(m)
-	if err != nil {
-		return err
+	errs := evalModule(m)
+	if len(errs) > 0 {
+		return errs
 	}
 	m.ResetVisited()
 	return nil
 }
 
-func evalModule(m *mod.Module) *Error {
+// like in the typechecker, symbols that depend on
+// a failed symbol are skipped instead of reported
+func evalModule(m *mod.Module) []*Error {
 	if m.Visited {
 		return nil
 	}
 	m.Visited = true
-	var err *Error
 	for _, dep := range m.Dependencies {
-		err = evalModule(dep.M)
-		if err != nil {
-			return err
+		errs := evalModule(dep.M)
+		if len(errs) > 0 {
+			return errs
 		}
 	}
 
+	errs := []*Error{}
+	failed := map[mod.SyField]mod.Unit{}
 	m.ResetVisitedSymbols()
 	for _, sy := range m.Globals {
 		if !sy.External {
-			err = evalSymbol(m, mod.FromSymbol(sy))
+			sf := mod.FromSymbol(sy)
+			if sf.Reaches(failed) {
+				continue
+			}
+			err := evalSymbol(m, sf)
 			if err != nil {
-				return err
+				errs = append(errs, err)
+				sf.Reach(failed)
 			}
 		}
 	}
-	return nil
+	return errs
 }
 
 func evalSymbol(m *mod.Module, sf mod.SyField) *Error {
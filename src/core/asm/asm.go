@@ -7,12 +7,14 @@ import (
 )
 
 type DataEntry struct {
-	Type TypeSize
-	Num  *big.Int
+	Type  TypeSize
+	Num   *big.Int
+	Label string // if not empty, the entry is the address of the label
 }
 
 type Program struct {
 	FileName string
+	Entry    bool // the code starts at the entry point
 
 	Writable   []Data
 	Readonly   []Data
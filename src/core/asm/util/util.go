@@ -102,6 +102,18 @@ func AddrFrame(a int, size asm.TypeSize) asm.Operand {
 	}
 }
 
+func AddrStack(a int, size asm.TypeSize) asm.Operand {
+	return asm.Operand{
+		Kind: asm.Addressing,
+		A:    RSP.A,
+		B: asm.Value{
+			Kind:  asm.Const,
+			Const: big.NewInt(int64(a)),
+		},
+		TypeSize: size,
+	}
+}
+
 func AddrSimple(op asm.Operand, size asm.TypeSize) asm.Operand {
 	return asm.Operand{
 		Kind: asm.Addressing,
@@ -206,6 +218,9 @@ func stringToReg(s string) (asm.Register, bool) {
 		}, true
 	}
 	start, end := FindDigits(s)
+	if start == -1 {
+		return asm.Register{}, false
+	}
 	i, err := strconv.ParseInt(s[start:end+1], 10, 64)
 	if err != nil {
 		return asm.Register{}, false
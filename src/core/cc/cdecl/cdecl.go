@@ -0,0 +1,49 @@
+/*
+System V AMD64, the convention used by C on linux.
+
+The first 6 arguments go in registers, the remaining ones in the
+stack, the 7th closest to the return address. Up to 2 values are
+returned in rax and rdx. At the call instruction rsp must be
+aligned to 16 bytes.
+
+|   Stack frame     |    Address
+|-------------------|----------------------------
+| Arg#N             | <- RBP + 16 + (N-6)*8
+| ...               |
+| Arg#6             | <- RBP + 16
+| Return Address    |
+| Caller RBP        | <- RBP
+| ...               |
+
+The callee must preserve rbx, rbp and r12~r15, every other
+register may be clobbered by the call.
+*/
+package cdecl
+
+const slot = 8
+
+const StackAlign = 16
+
+// register IDs, as in asm.Register
+
+var Args = []int{7, 6, 2, 1, 8, 9} // rdi, rsi, rdx, rcx, r8, r9
+
+var Rets = []int{0, 2} // rax, rdx
+
+// rbp is left out, since the prologue already saves it
+var CalleeSaved = []int{3, 12, 13, 14, 15} // rbx, r12~r15
+
+func InRegister(i int) bool {
+	return i < len(Args)
+}
+
+// offset from rsp, at the call instruction, of argument i
+func CallArg(i int) int {
+	return (i - len(Args)) * slot
+}
+
+// offset from rbp, inside the callee, of argument i
+func Arg(i int) int {
+	//      v must jump the slots: rbp, return address
+	return 2*slot + (i-len(Args))*slot
+}
@@ -0,0 +1,30 @@
+/*
+The gc calling convention is the stack convention, but every call
+inside a gc procedure gets a stack map: the slots of the frame that
+hold pointers (or structs) while the call is happening.
+
+The maps go in a readonly table of qwords:
+
+	number of maps
+	return address of the call #0
+	number of roots #0
+	offset from rbp of each root #0
+	...
+	return address of the call #N
+	number of roots #N
+	offset from rbp of each root #N
+
+A collector walks the rbp chain, and for each frame the return address
+(at [rbp + 8]) finds the map of the frame above (at [rbp]).
+Frames without a map don't belong to gc procedures and have no roots.
+
+Arguments live in the caller's frame, so they're described
+by the caller's map, together with its other slots.
+
+There's a single table for the whole program, so modules with
+gc procedures are never taken from the build cache.
+*/
+package gc
+
+// label of the table, asm procedures can find it with _stackmaps
+const StackMaps = "_stackmaps"
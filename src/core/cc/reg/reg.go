@@ -0,0 +1,70 @@
+/*
+Register calling conventions: the first arguments and returns go in
+registers, in order, the remaining ones stay in the stack frame, in the
+same slots they would have in the stack convention.
+
+| Convention | Registers                    |
+|------------|------------------------------|
+| reg        | r15, r14, r13, r12, r11, r10 |
+| reg_a      | r15, r14, r13                |
+| reg_b      | r12, r11, r10                |
+| reg_c      | r9, r8, rdi                  |
+
+reg_a, reg_b and reg_c are disjoint subsets of the registers,
+for procedures with few arguments.
+
+Every register is still clobbered by a call. Inside the callee, register
+arguments get a local slot right after the variables, where they are
+kept if they need to leave the register.
+*/
+package reg
+
+import (
+	T "mpc/core/types"
+)
+
+type class struct {
+	Regs []int // as numbered by the register allocator
+	Asm  []int // the same registers, as in asm.Register
+}
+
+var classes = map[T.CCKind]class{
+	T.Reg:   {Regs: []int{0, 1, 2, 3, 4, 5}, Asm: []int{15, 14, 13, 12, 11, 10}},
+	T.Reg_A: {Regs: []int{0, 1, 2}, Asm: []int{15, 14, 13}},
+	T.Reg_B: {Regs: []int{3, 4, 5}, Asm: []int{12, 11, 10}},
+	T.Reg_C: {Regs: []int{6, 7, 8}, Asm: []int{9, 8, 7}},
+}
+
+func IsReg(cc T.CCKind) bool {
+	_, ok := classes[cc]
+	return ok
+}
+
+// registers of the allocator used by the convention, in order,
+// stack conventions have none
+func Registers(cc T.CCKind) []int {
+	return classes[cc].Regs
+}
+
+// allocator register of argument or return i, if it is in a register
+func Register(cc T.CCKind, i int) (int, bool) {
+	regs := classes[cc].Regs
+	if i < len(regs) {
+		return regs[i], true
+	}
+	return 0, false
+}
+
+// asm register of argument or return i, if it is in a register
+func AsmRegister(cc T.CCKind, i int) (int, bool) {
+	regs := classes[cc].Asm
+	if i < len(regs) {
+		return regs[i], true
+	}
+	return 0, false
+}
+
+// number of arguments (or returns) of the list that go in registers
+func InRegisters(cc T.CCKind, amount int) int {
+	return min(amount, len(classes[cc].Regs))
+}
@@ -31,6 +31,12 @@ func CallRet(numVars, numSpills, numMaxCalleeArgs, i int) int {
 	return CallArg(numVars, numSpills, numMaxCalleeArgs, i)
 }
 
+// offset from rsp, at the call instruction, of argument i,
+// the same place as CallArg when the frame is fully reserved
+func Outgoing(i int) int {
+	return i * slot
+}
+
 func Spill(numVars, i int) int {
 	//        v jumps a slot because rbp points to the last rbp
 	return -(slot + numVars*slot + i*slot)
@@ -1,21 +1,27 @@
 package core
 
 import (
-	"fmt"
-	"io/ioutil"
+	"encoding/json"
 	et "mpc/core/errorkind"
 	sv "mpc/core/severity"
+	"sort"
 	"strconv"
 )
 
+// zero based, but shown counting from 1, like in editors
 type Position struct {
 	Line   int
 	Column int
 }
 
 func (this Position) String() string {
-	return strconv.FormatInt(int64(this.Line), 10) + ":" +
-		strconv.FormatInt(int64(this.Column), 10)
+	shown := this.Shown()
+	return strconv.FormatInt(int64(shown.Line), 10) + ":" +
+		strconv.FormatInt(int64(shown.Column), 10)
+}
+
+func (this Position) Shown() Position {
+	return Position{Line: this.Line + 1, Column: this.Column + 1}
 }
 
 func (this Position) LessThan(other Position) bool {
@@ -67,49 +73,6 @@ func (this *Location) String() string {
 	return this.File
 }
 
-func (this *Location) Source() string {
-	if this == nil || this.Range == nil {
-		return ""
-	}
-	contents, err := ioutil.ReadFile(this.File)
-	if err != nil {
-		fmt.Printf("%#v\n", this)
-		panic(err) // internal error
-	}
-	currline := 0
-	currcol := 0
-	output := "    \u001b[36m"
-	// this is not unicode aware
-	for _, r := range string(contents) {
-		if currline >= this.Range.Begin.Line &&
-			currline <= this.Range.End.Line {
-			if currline == this.Range.Begin.Line &&
-				currcol == this.Range.Begin.Column {
-				output += "\u001b[31m"
-			}
-			if currline == this.Range.End.Line &&
-				currcol == this.Range.End.Column {
-				output += "\u001b[36m"
-			}
-			if r == '\n' {
-				output += string(r) + "    "
-			} else if r == '\t' {
-				output += "    "
-			} else {
-				output += string(r)
-			}
-		}
-		if r == '\n' {
-			currline++
-			currcol = 0
-		} else {
-			currcol++
-		}
-	}
-	output += "\u001b[0m"
-	return output
-}
-
 type Error struct {
 	Code     et.ErrorKind
 	Severity sv.Severity
@@ -128,6 +91,39 @@ func (this *Error) String() string {
 	return message
 }
 
+// positions count from 1, just like in String()
+type jsonError struct {
+	Code     string
+	Severity string
+	Message  string
+	File     string
+	Begin    *Position `json:",omitempty"`
+	End      *Position `json:",omitempty"`
+}
+
+// a single line JSON object, meant for tools
+func (this *Error) JSON() string {
+	out := jsonError{
+		Code:     this.ErrCode(),
+		Severity: this.Severity.String(),
+		Message:  this.Message,
+	}
+	if this.Location != nil {
+		out.File = this.Location.File
+		if this.Location.Range != nil {
+			begin := this.Location.Range.Begin.Shown()
+			end := this.Location.Range.End.Shown()
+			out.Begin = &begin
+			out.End = &end
+		}
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		panic(err) // internal error
+	}
+	return string(b)
+}
+
 func (this *Error) ErrCode() string {
 	return this.Code.String()
 }
@@ -139,3 +135,21 @@ func ProcessFileError(e error) *Error {
 		Message:  e.Error(),
 	}
 }
+
+// sorts errors by file and position, errors without
+// a location come first, otherwise order is kept
+func SortErrors(errs []*Error) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, b := errs[i].Location, errs[j].Location
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Range == nil || b.Range == nil {
+			return a.Range == nil && b.Range != nil
+		}
+		return a.Range.Begin.LessThan(b.Range.Begin)
+	})
+}
@@ -0,0 +1,89 @@
+package dot
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+Builds a graph in the graphviz language. Nodes are boxes
+with left aligned lines of code, each subgraph is a cluster,
+so that it's drawn inside its own box.
+*/
+type Graph struct {
+	b        strings.Builder
+	clusters int
+	inside   bool
+}
+
+func NewGraph(name string) *Graph {
+	g := &Graph{}
+	g.b.WriteString("digraph " + Quote(name) + " {\n")
+	g.b.WriteString("\tnode [shape=box, fontname=monospace];\n")
+	return g
+}
+
+// closes the previous subgraph, if any
+func (this *Graph) Subgraph(label string) {
+	this.closeSubgraph()
+	this.b.WriteString("\tsubgraph cluster_" + strconv.Itoa(this.clusters) + " {\n")
+	this.b.WriteString("\t\tlabel=" + Quote(label) + ";\n")
+	this.clusters++
+	this.inside = true
+}
+
+// what comes after is outside of any subgraph
+func (this *Graph) EndSubgraph() {
+	this.closeSubgraph()
+}
+
+func (this *Graph) Node(id string, lines []string, bold bool) {
+	label := ""
+	for _, line := range lines {
+		label += escape(line) + `\l`
+	}
+	attrs := `label="` + label + `"`
+	if bold {
+		attrs += ", penwidth=2"
+	}
+	this.b.WriteString(this.indent() + Quote(id) + " [" + attrs + "];\n")
+}
+
+func (this *Graph) Edge(from, to, label string) {
+	edge := Quote(from) + " -> " + Quote(to)
+	if label != "" {
+		edge += " [label=" + Quote(label) + "]"
+	}
+	this.b.WriteString(this.indent() + edge + ";\n")
+}
+
+func (this *Graph) String() string {
+	this.closeSubgraph()
+	return this.b.String() + "}\n"
+}
+
+func (this *Graph) closeSubgraph() {
+	if this.inside {
+		this.b.WriteString("\t}\n")
+		this.inside = false
+	}
+}
+
+func (this *Graph) indent() string {
+	if this.inside {
+		return "\t\t"
+	}
+	return "\t"
+}
+
+func Quote(s string) string {
+	return `"` + escape(s) + `"`
+}
+
+// tabs don't render well, and newlines would center the text
+func escape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\t", "    ")
+	return strings.ReplaceAll(s, "\n", `\l`)
+}
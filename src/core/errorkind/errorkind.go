@@ -79,6 +79,8 @@ const (
 	InvalidOperand
 	ExpectedProc
 	ExportExternal
+	OutsideLoop
+	TooManyReturns
 )
 
 func (et ErrorKind) String() string {
@@ -161,4 +163,6 @@ var ErrorCodeMap = map[ErrorKind]string{
 	InvalidOperand:                 "E072",
 	ExpectedProc:                   "E073",
 	ExportExternal:                 "E074",
+	OutsideLoop:                    "E075",
+	TooManyReturns:                 "E076",
 }
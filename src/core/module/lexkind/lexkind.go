@@ -79,6 +79,8 @@ const (
 	ELSEIF
 	WHILE
 	DO
+	BREAK
+	CONTINUE
 	RETURN
 	PROC
 	DATA
@@ -96,6 +98,7 @@ const (
 	ALL
 	STRUCT
 	ASM
+	EXTERN
 
 	I8
 	I16
@@ -207,45 +210,48 @@ var Tktosrc = map[LexKind]string{
 	QUESTION:              "?",
 	SWAP:                  "<>",
 
-	VAR:    "vars",
-	TRUE:   "true",
-	FALSE:  "false",
-	AND:    "and",
-	OR:     "or",
-	NOT:    "not",
-	IF:     "if",
-	ELSE:   "else",
-	WHILE:  "while",
-	DO:     "do",
-	RETURN: "return",
-	ELSEIF: "elseif",
-	PROC:   "proc",
-	DATA:   "data",
-	BEGIN:  "begin",
-	END:    "end",
-	SET:    "set",
-	I8:     "i8",
-	I16:    "i16",
-	I32:    "i32",
-	I64:    "i64",
-	U8:     "u8",
-	U16:    "u16",
-	U32:    "u32",
-	U64:    "u64",
-	PTR:    "ptr",
-	BOOL:   "bool",
-	VOID:   "void",
-	EXIT:   "exit",
-	IMPORT: "import",
-	FROM:   "from",
-	EXPORT: "export",
-	SIZEOF: "sizeof",
-	CONST:  "const",
-	ATTR:   "attr",
-	AS:     "as",
-	ALL:    "all",
-	ASM:    "asm",
-	STRUCT: "struct",
+	VAR:      "vars",
+	TRUE:     "true",
+	FALSE:    "false",
+	AND:      "and",
+	OR:       "or",
+	NOT:      "not",
+	IF:       "if",
+	ELSE:     "else",
+	WHILE:    "while",
+	DO:       "do",
+	BREAK:    "break",
+	CONTINUE: "continue",
+	RETURN:   "return",
+	ELSEIF:   "elseif",
+	PROC:     "proc",
+	DATA:     "data",
+	BEGIN:    "begin",
+	END:      "end",
+	SET:      "set",
+	I8:       "i8",
+	I16:      "i16",
+	I32:      "i32",
+	I64:      "i64",
+	U8:       "u8",
+	U16:      "u16",
+	U32:      "u32",
+	U64:      "u64",
+	PTR:      "ptr",
+	BOOL:     "bool",
+	VOID:     "void",
+	EXIT:     "exit",
+	IMPORT:   "import",
+	FROM:     "from",
+	EXPORT:   "export",
+	SIZEOF:   "sizeof",
+	CONST:    "const",
+	ATTR:     "attr",
+	AS:       "as",
+	ALL:      "all",
+	ASM:      "asm",
+	STRUCT:   "struct",
+	EXTERN:   "extern",
 
 	IDLIST:    "id list",
 	ALIASLIST: "alias list",
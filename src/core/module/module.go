@@ -9,6 +9,7 @@ import (
 	T "mpc/core/types"
 
 	"fmt"
+	"sort"
 	"strings"
 
 	"math/big"
@@ -25,6 +26,12 @@ type Node struct {
 	Value *big.Int // for int literals
 
 	Range *Range
+
+	// comments kept for the formatter, an empty string
+	// stands for an empty line
+	Leading  []string // lines right before the node
+	Trailing string   // comment after the node, in the same line
+	Closing  []string // lines before the 'end' of a container
 }
 
 func (n *Node) String() string {
@@ -89,6 +96,13 @@ type Module struct {
 	Dependencies map[string]*Dependency
 	Exported     map[string]*Global
 
+	// loaded from an interface file, only the declarations are
+	// known, the code is in Object (if any)
+	Interface bool
+	Object    string
+
+	Hash string // of the source and of every dependency
+
 	Visited bool
 }
 
@@ -118,6 +132,34 @@ func (M *Module) ResetVisited() {
 	}
 }
 
+// sorted by name, passes that go through them
+// must not depend on the order of a map
+func (M *Module) SortedGlobals() []*Global {
+	names := make([]string, 0, len(M.Globals))
+	for name := range M.Globals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	output := make([]*Global, len(names))
+	for i, name := range names {
+		output[i] = M.Globals[name]
+	}
+	return output
+}
+
+func (M *Module) SortedDependencies() []*Dependency {
+	names := make([]string, 0, len(M.Dependencies))
+	for name := range M.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	output := make([]*Dependency, len(names))
+	for i, name := range names {
+		output[i] = M.Dependencies[name]
+	}
+	return output
+}
+
 func (M *Module) ResetVisitedSymbols() {
 	for _, sy := range M.Globals {
 		sy.ResetVisited()
@@ -130,7 +172,9 @@ func (M *Module) GetSymbol(name string) *Global {
 		return nil
 	}
 	if sy.External {
-		dep, ok := M.Dependencies[sy.ModuleName]
+		// from std/io import ... adds the dependency as io
+		name := sy.ModuleName[strings.LastIndex(sy.ModuleName, "/")+1:]
+		dep, ok := M.Dependencies[name]
 		if !ok {
 			fmt.Println(sy.ModuleName)
 			fmt.Println(M.Globals)
@@ -163,6 +207,7 @@ type Global struct {
 	Name       string
 	N          *Node
 	External   bool
+	Interface  bool // declared in an interface file
 	Refs       Refs
 	Attr       []string
 	Visited    bool
@@ -219,9 +264,16 @@ func (this *Global) GetType() *T.Type {
 /*
 All ABIs must respect this, no calling convention may
 alter the mangling of names.
+
+Modules in subfolders (std/io) use dots in place of slashes.
+Extern procedures keep their name, as they're defined elsewhere,
+except the ones in interface files, those are Millipascal procedures.
 */
 func (this *Global) Label() string {
-	return this.ModuleName + "_" + this.Name
+	if this.Kind == GK.Proc && this.Proc.Extern && !this.Interface {
+		return this.Name
+	}
+	return strings.ReplaceAll(this.ModuleName, "/", ".") + "_" + this.Name
 }
 
 type Local struct {
@@ -245,8 +297,11 @@ type Proc struct {
 	Rets   []*T.Type
 	Type   *T.Type
 	Asm    []asm.Line
+	Extern bool // defined elsewhere, there's no body
 
 	N *Node
+
+	Loops int // loop nesting, used while typechecking
 }
 
 func (this *Proc) StrArgs() string {
@@ -432,3 +487,31 @@ type Field struct {
 	Offset  *Node
 	Visited bool
 }
+
+// adds this symbol (or field) and everything it references,
+// directly or not, to the set
+func (this *SyField) Reach(set map[SyField]Unit) {
+	if _, ok := set[*this]; ok {
+		return
+	}
+	set[*this] = Unit{}
+	refs := this.GetRefs()
+	for _, ref := range refs.Symbols {
+		ref.Reach(set)
+	}
+}
+
+// true if this symbol (or field) references, directly or not,
+// something in the set
+func (this *SyField) Reaches(set map[SyField]Unit) bool {
+	if _, ok := set[*this]; ok {
+		return true
+	}
+	refs := this.GetRefs()
+	for _, ref := range refs.Symbols {
+		if ref.Reaches(set) {
+			return true
+		}
+	}
+	return false
+}
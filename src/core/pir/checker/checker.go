@@ -16,7 +16,7 @@ import (
 
 func Check(P *hir.Program) *Error {
 	for _, sy := range P.Symbols {
-		if sy.Proc != nil && sy.Proc.Asm == nil {
+		if sy.Proc != nil && sy.Proc.Asm == nil && !sy.Proc.Extern {
 			s := newState(P)
 			s.proc = sy.Proc
 			sy.Proc.ResetBlocks()
@@ -17,6 +17,9 @@ import (
 // index into Program.Symbols array
 type SymbolID int
 
+// libraries have no main
+const NoEntry SymbolID = -1
+
 type Program struct {
 	Name    string
 	Entry   SymbolID
@@ -71,9 +74,14 @@ type DataDecl struct {
 
 	Data string
 	Nums []asm.DataEntry
+
+	Extern bool // defined in another object
 }
 
 func (this *DataDecl) String() string {
+	if this.Extern {
+		return "extern " + this.Label
+	}
 	if this.Data != "" {
 		return this.Label + ": " + this.Data
 	}
@@ -91,6 +99,7 @@ type Procedure struct {
 	Rets  []*T.Type
 
 	Asm       []asm.Line
+	Extern    bool // only the label is known
 	Start     BlockID
 	AllBlocks []*BasicBlock
 }
@@ -121,6 +130,9 @@ func (p *Procedure) StrLocals() string {
 
 func (this *Procedure) String() string {
 	output := this.Label + "{\n"
+	if this.Extern {
+		output = "extern " + output
+	}
 	output += this.StrArgs() + "\n"
 	output += this.StrRets() + "\n"
 	output += this.StrLocals() + "\n"
@@ -0,0 +1,234 @@
+package core
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// diagnostics and test results use ANSI escape codes
+// only if this is true, main sets it from -color and NO_COLOR
+var Color = true
+
+const (
+	Red     = "\u001b[31m"
+	Blue    = "\u001b[34m"
+	Magenta = "\u001b[35m"
+	Cyan    = "\u001b[36m"
+	reset   = "\u001b[0m"
+)
+
+func Paint(color string, text string) string {
+	if !Color || text == "" {
+		return text
+	}
+	return color + text + reset
+}
+
+// files read for diagnostics, each is read only once,
+// errors may be printed from more than one goroutine
+var sources = map[string]*sourceFile{}
+var sourcesMu sync.Mutex
+
+type sourceFile struct {
+	Text  string
+	Lines []int // byte offset where each line begins
+}
+
+func readSource(path string) (*sourceFile, error) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	if f, ok := sources[path]; ok {
+		return f, nil
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &sourceFile{Text: string(contents), Lines: []int{0}}
+	for i, b := range contents {
+		if b == '\n' {
+			f.Lines = append(f.Lines, i+1)
+		}
+	}
+	sources[path] = f
+	return f, nil
+}
+
+// without the line break
+func (this *sourceFile) Line(i int) (string, bool) {
+	if i < 0 || i >= len(this.Lines) {
+		return "", false
+	}
+	end := len(this.Text)
+	if i+1 < len(this.Lines) {
+		end = this.Lines[i+1]
+	}
+	return strings.TrimRight(this.Text[this.Lines[i]:end], "\r\n"), true
+}
+
+// ranges longer than this only show their first and last lines
+const maxSnippetLines = 6
+
+/*
+Shows the lines of the range with their numbers, counted from 1
+like in editors, and underlines the range: ^ marks where it
+begins, ~ the rest of it. Columns
+count runes, like in the lexer, tabs are shown as 4 spaces and
+wide characters take 2 columns in the underline.
+
+	4 |     x = föo + 1;
+	  |         ^~~
+*/
+func (this *Location) Source() string {
+	if this == nil || this.Range == nil {
+		return ""
+	}
+	f, err := readSource(this.File)
+	if err != nil {
+		return "" // the message is still useful
+	}
+	begin, end := this.Range.Begin, this.Range.End
+	if end.LessThan(begin) {
+		end = begin
+	}
+	numWidth := len(strconv.Itoa(end.Line + 1))
+	gutter := func(num string) string {
+		return Paint(Cyan, strings.Repeat(" ", numWidth-len(num))+num+" |")
+	}
+	output := []string{}
+	for _, i := range snippetLines(begin.Line, end.Line) {
+		if i < 0 {
+			output = append(output, gutter("")+" ...")
+			continue
+		}
+		line, ok := f.Line(i)
+		if !ok {
+			break
+		}
+		from, to := firstNonBlank(line), utf8.RuneCountInString(line)
+		if i == begin.Line {
+			from = begin.Column
+		}
+		if i == end.Line {
+			to = end.Column
+		}
+		text, marks := underline(line, from, to, i == begin.Line)
+		output = append(output,
+			gutter(strconv.Itoa(i+1))+" "+text,
+			gutter("")+" "+Paint(Red, marks),
+		)
+	}
+	return strings.Join(output, "\n")
+}
+
+// -1 stands for the lines that are left out
+func snippetLines(begin, end int) []int {
+	output := []int{}
+	if end-begin < maxSnippetLines {
+		for i := begin; i <= end; i++ {
+			output = append(output, i)
+		}
+		return output
+	}
+	for i := begin; i < begin+maxSnippetLines/2; i++ {
+		output = append(output, i)
+	}
+	output = append(output, -1)
+	for i := end - maxSnippetLines/2 + 1; i <= end; i++ {
+		output = append(output, i)
+	}
+	return output
+}
+
+func firstNonBlank(line string) int {
+	col := 0
+	for _, r := range line {
+		if r != ' ' && r != '\t' {
+			return col
+		}
+		col++
+	}
+	return col
+}
+
+// the line as shown, and the marks below the runes in [from, to),
+// if caret is set, the first mark is a ^, even for empty ranges
+func underline(line string, from, to int, caret bool) (string, string) {
+	text := strings.Builder{}
+	marks := strings.Builder{}
+	col := 0
+	for _, r := range line {
+		w := runeWidth(r)
+		if r == '\t' {
+			text.WriteString(strings.Repeat(" ", w))
+		} else {
+			text.WriteRune(r)
+		}
+		switch {
+		case col < from:
+			marks.WriteString(strings.Repeat(" ", w))
+		case col < to:
+			if col == from && caret && w > 0 {
+				marks.WriteString("^" + strings.Repeat("~", w-1))
+			} else {
+				marks.WriteString(strings.Repeat("~", w))
+			}
+		}
+		col++
+	}
+	if caret && from >= to {
+		// past the end of the line, or nothing to underline
+		if from > col {
+			marks.WriteString(strings.Repeat(" ", from-col))
+		}
+		marks.WriteString("^")
+	}
+	return text.String(), strings.TrimRight(marks.String(), " ")
+}
+
+const tabWidth = 4
+
+// columns a rune takes in a terminal
+func runeWidth(r rune) int {
+	switch {
+	case r == '\t':
+		return tabWidth
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case isWide(r):
+		return 2
+	}
+	return 1
+}
+
+// east asian wide and fullwidth characters, and most emoji
+var wideRanges = [][2]rune{
+	{0x1100, 0x115F},
+	{0x2E80, 0x303E},
+	{0x3041, 0x33FF},
+	{0x3400, 0x4DBF},
+	{0x4E00, 0x9FFF},
+	{0xA000, 0xA4CF},
+	{0xAC00, 0xD7A3},
+	{0xF900, 0xFAFF},
+	{0xFE30, 0xFE4F},
+	{0xFF00, 0xFF60},
+	{0xFFE0, 0xFFE6},
+	{0x1F300, 0x1F64F},
+	{0x1F900, 0x1F9FF},
+	{0x20000, 0x2FFFD},
+	{0x30000, 0x3FFFD},
+}
+
+func isWide(r rune) bool {
+	for _, rg := range wideRanges {
+		if r >= rg[0] && r <= rg[1] {
+			return true
+		}
+	}
+	return false
+}
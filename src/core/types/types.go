@@ -180,8 +180,6 @@ func ConvertCC(s string) CCKind {
 const (
 	InvalidCCKind CCKind = iota
 	Stack
-
-	// unimplemented
 	Reg
 	Cdecl
 	GC
@@ -243,6 +241,9 @@ var T_Ptr = &Type{Basic: Ptr}
 var T_Void = &Type{Basic: Void}
 var T_MainProc = &Type{Proc: &ProcType{CC: Stack, Args: []*Type{}, Rets: []*Type{}}}
 
+// argc, argv and envp, main may take the first few of them
+var T_MainArgs = []*Type{T_I64, T_Ptr, T_Ptr}
+
 type BasicType int
 
 const (
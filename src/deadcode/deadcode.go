@@ -0,0 +1,190 @@
+/*
+Dead code elimination at the level of globals: only procedures and
+data reachable from the entry point end up in the program. References
+are found in the instructions of each procedure, in the labels used
+by asm procedures and in the labels inside data blobs.
+
+Programs without an entry point (objects) are left untouched, anything
+in them may be used by some other object. Programs linked with objects
+also keep the roots they're given, what the objects may call.
+*/
+package deadcode
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"mpc/core/asm"
+	"mpc/core/pir"
+	pirc "mpc/core/pir/class"
+)
+
+// labels of the symbols removed from the last program,
+// Eliminate starts it over and Unlinked adds to it
+var Removed []string
+
+func Eliminate(P *pir.Program, roots []string) {
+	Removed = nil
+	if P.Entry == pir.NoEntry {
+		return
+	}
+	labels := map[string]pir.SymbolID{}
+	for i, sy := range P.Symbols {
+		labels[label(sy)] = pir.SymbolID(i)
+	}
+	reached := map[pir.SymbolID]bool{}
+	var reach func(id pir.SymbolID)
+	reach = func(id pir.SymbolID) {
+		if reached[id] {
+			return
+		}
+		reached[id] = true
+		for _, label := range references(P.Symbols[id]) {
+			if other, ok := labels[label]; ok {
+				reach(other)
+			}
+		}
+		for _, op := range globals(P.Symbols[id]) {
+			reach(pir.SymbolID(op.ID))
+		}
+	}
+	reach(P.Entry)
+	for _, root := range roots {
+		if id, ok := labels[root]; ok {
+			reach(id)
+		}
+	}
+
+	newID := make([]pir.SymbolID, len(P.Symbols))
+	symbols := []*pir.Symbol{}
+	for i, sy := range P.Symbols {
+		if !reached[pir.SymbolID(i)] {
+			// declarations never generated anything
+			if !extern(sy) {
+				Removed = append(Removed, label(sy))
+			}
+			continue
+		}
+		newID[i] = pir.SymbolID(len(symbols))
+		symbols = append(symbols, sy)
+	}
+	for _, sy := range symbols {
+		for _, op := range globals(sy) {
+			op.ID = int64(newID[op.ID])
+		}
+	}
+	P.Entry = newID[P.Entry]
+	P.Symbols = symbols
+}
+
+func label(sy *pir.Symbol) string {
+	if sy.Proc != nil {
+		return sy.Proc.Label
+	}
+	return sy.Mem.Label
+}
+
+func extern(sy *pir.Symbol) bool {
+	if sy.Proc != nil {
+		return sy.Proc.Extern
+	}
+	return sy.Mem.Extern
+}
+
+// operands that refer to other symbols, by pointer, so that they can be renumbered
+func globals(sy *pir.Symbol) []*pir.Operand {
+	if sy.Proc == nil {
+		return nil
+	}
+	output := []*pir.Operand{}
+	add := func(ops []pir.Operand) {
+		for i := range ops {
+			if ops[i].Class == pirc.Global {
+				output = append(output, &ops[i])
+			}
+		}
+	}
+	for _, b := range sy.Proc.AllBlocks {
+		for _, instr := range b.Code {
+			add(instr.Operands)
+			add(instr.Destination)
+		}
+		add(b.Out.V)
+	}
+	return output
+}
+
+// labels used by asm procedures and data blobs
+func references(sy *pir.Symbol) []string {
+	output := []string{}
+	if sy.Mem != nil {
+		for _, entry := range sy.Mem.Nums {
+			if entry.Label != "" {
+				output = append(output, entry.Label)
+			}
+		}
+		return output
+	}
+	value := func(v asm.Value) {
+		if v.Kind == asm.Label {
+			output = append(output, v.Label)
+		}
+	}
+	for _, line := range sy.Proc.Asm {
+		if line.IsLabel {
+			continue
+		}
+		for _, op := range line.Instr.Operands {
+			value(op.A)
+			value(op.B)
+		}
+	}
+	return output
+}
+
+/*
+Modules from the build cache are linked as objects, with a
+section for each symbol, and the linker removes the ones the
+program doesn't use. This records them, from the output of
+ld --print-gc-sections:
+
+	ld: removing unused section '.text.ioutil_put_char' in file 'x.o'
+
+Only sections from our own objects are recorded, the ones
+from other objects are not Millipascal symbols.
+*/
+func Unlinked(output string, objects []string) {
+	const prefix = "removing unused section '"
+	const file = "' in file '"
+	ours := map[string]bool{}
+	for _, obj := range objects {
+		ours[obj] = true
+	}
+	for _, line := range strings.Split(output, "\n") {
+		i := strings.Index(line, prefix)
+		j := strings.Index(line, file)
+		if i < 0 || j < i {
+			continue
+		}
+		name := line[i+len(prefix) : j]
+		obj := strings.TrimSuffix(line[j+len(file):], "'")
+		if !ours[obj] {
+			continue
+		}
+		for _, kind := range []string{".text.", ".rodata.", ".data."} {
+			if strings.HasPrefix(name, kind) {
+				Removed = append(Removed, strings.TrimPrefix(name, kind))
+			}
+		}
+	}
+}
+
+func Report() string {
+	sort.Strings(Removed)
+	report := "deadcode: " + strconv.Itoa(len(Removed)) + " removed"
+	if len(Removed) > 0 {
+		report += " " + strings.Join(Removed, ", ")
+	}
+	return report + "\n"
+}
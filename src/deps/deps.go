@@ -0,0 +1,194 @@
+package deps
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"mpc/core/dot"
+	mod "mpc/core/module"
+	GK "mpc/core/module/globalkind"
+)
+
+/*
+The module graph and the symbol graph of a resolved program.
+
+Modules point to their dependencies, along with the names they
+import. Symbols point to the symbols they need at compile time
+(Global.Refs), struct fields are symbols of their own, named
+Struct.field, since offsets may depend on other symbols.
+
+References are qualified with the module that defines the
+symbol, as module::name, since it may have been imported.
+*/
+type Graph struct {
+	Modules []*Module
+}
+
+type Module struct {
+	Name         string
+	Path         string
+	Dependencies []*Dependency
+	Symbols      []*Symbol
+}
+
+type Dependency struct {
+	Module  string
+	Line    int // counts from 1, like diagnostics
+	Imports []string
+}
+
+type Symbol struct {
+	Name string
+	Kind string
+	Refs []string
+}
+
+func Build(M *mod.Module) *Graph {
+	g := &Graph{}
+	for _, m := range modules(M) {
+		g.Modules = append(g.Modules, module(m))
+	}
+	return g
+}
+
+// the root first, then each dependency the first time it's seen,
+// names are sorted so that the output doesn't change between runs
+func modules(M *mod.Module) []*mod.Module {
+	seen := map[*mod.Module]bool{M: true}
+	order := []*mod.Module{M}
+	for i := 0; i < len(order); i++ {
+		for _, name := range depNames(order[i]) {
+			dep := order[i].Dependencies[name].M
+			if !seen[dep] {
+				seen[dep] = true
+				order = append(order, dep)
+			}
+		}
+	}
+	return order
+}
+
+func depNames(M *mod.Module) []string {
+	names := []string{}
+	for name := range M.Dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func module(M *mod.Module) *Module {
+	out := &Module{
+		Name:         M.Name,
+		Path:         M.FullPath,
+		Dependencies: []*Dependency{},
+		Symbols:      []*Symbol{},
+	}
+	imports := map[string][]string{}
+	names := []string{}
+	for name, sy := range M.Globals {
+		if sy.External {
+			// from std/io import ... adds the dependency as io
+			dep := sy.ModuleName[strings.LastIndex(sy.ModuleName, "/")+1:]
+			imports[dep] = append(imports[dep], sy.Name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range depNames(M) {
+		dep := M.Dependencies[name]
+		d := &Dependency{Module: dep.M.Name, Imports: append([]string{}, imports[name]...)}
+		sort.Strings(d.Imports)
+		if dep.Source != nil && dep.Source.Range != nil {
+			d.Line = dep.Source.Range.Begin.Shown().Line
+		}
+		out.Dependencies = append(out.Dependencies, d)
+	}
+	for _, name := range names {
+		sy := M.Globals[name]
+		out.Symbols = append(out.Symbols, symbol(name, sy.Kind.String(), sy.Refs))
+		if sy.Kind == GK.Struct && sy.Struct != nil {
+			for _, field := range sy.Struct.Fields {
+				out.Symbols = append(out.Symbols, symbol(name+"."+field.Name, "field", field.Refs))
+			}
+		}
+	}
+	return out
+}
+
+func symbol(name, kind string, refs mod.Refs) *Symbol {
+	sy := &Symbol{Name: name, Kind: kind, Refs: []string{}}
+	for _, sf := range refs.Symbols {
+		sy.Refs = append(sy.Refs, qualified(sf.Sy.ModuleName, sf.Name()))
+	}
+	return sy
+}
+
+// symbols of different modules may have the same name
+func qualified(module, name string) string {
+	return module + "::" + name
+}
+
+func (this *Graph) JSON() string {
+	b, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		panic(err) // internal error
+	}
+	return string(b) + "\n"
+}
+
+// one cluster for the modules, then one for the symbols of each module,
+// fields are only drawn when something refers to them, or they refer to something
+func (this *Graph) Dot() string {
+	g := dot.NewGraph(this.Modules[0].Name)
+	g.Subgraph("modules")
+	for i, m := range this.Modules {
+		g.Node(m.Name, []string{m.Name}, i == 0)
+	}
+	for _, m := range this.Modules {
+		for _, d := range m.Dependencies {
+			g.Edge(m.Name, d.Module, strings.Join(d.Imports, ", "))
+		}
+	}
+	used := this.usedFields()
+	for _, m := range this.Modules {
+		g.Subgraph(m.Name)
+		for _, sy := range m.Symbols {
+			id := qualified(m.Name, sy.Name)
+			if sy.Kind == "field" && !used[id] {
+				continue
+			}
+			g.Node(id, []string{sy.Kind + " " + sy.Name}, false)
+		}
+	}
+	// outside the clusters, otherwise a symbol from another
+	// module would be drawn in the cluster that refers to it
+	g.EndSubgraph()
+	for _, m := range this.Modules {
+		for _, sy := range m.Symbols {
+			for _, ref := range sy.Refs {
+				g.Edge(qualified(m.Name, sy.Name), ref, "")
+			}
+		}
+	}
+	return g.String()
+}
+
+// fields may be used from any module
+func (this *Graph) usedFields() map[string]bool {
+	used := map[string]bool{}
+	for _, m := range this.Modules {
+		for _, sy := range m.Symbols {
+			if sy.Kind == "field" && len(sy.Refs) > 0 {
+				used[qualified(m.Name, sy.Name)] = true
+			}
+			for _, ref := range sy.Refs {
+				used[ref] = true
+			}
+		}
+	}
+	return used
+}
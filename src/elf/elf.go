@@ -0,0 +1,266 @@
+/*
+This package writes ELF64 files directly from an asm.Program,
+using the x64 package to encode the instructions.
+
+The executable layout mimics the one from fasm's
+"format ELF64 executable 3": one segment for readonly data,
+one for writable data and one for code, in this order,
+with the entry point at the start of the code segment.
+*/
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"mpc/core/asm"
+	"mpc/x64"
+)
+
+const (
+	baseAddress = 0x400000
+	pageSize    = 0x1000
+
+	ehdrSize = 64
+	phdrSize = 56
+)
+
+const (
+	pfX = 1
+	pfW = 2
+	pfR = 4
+)
+
+type segment struct {
+	Flags  uint32
+	Offset uint64
+	Addr   uint64
+	Data   []byte
+}
+
+// generates a static executable, ready to be written to disk
+func Executable(p *asm.Program) ([]byte, error) {
+	readonly, roLabels, roRefs, err := DataBytes(p.Readonly)
+	if err != nil {
+		return nil, err
+	}
+	writable, rwLabels, rwRefs, err := DataBytes(p.Writable)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []*segment{}
+	if len(readonly) > 0 {
+		segments = append(segments, &segment{Flags: pfR, Data: readonly})
+	}
+	if len(writable) > 0 {
+		segments = append(segments, &segment{Flags: pfR | pfW, Data: writable})
+	}
+	code := &segment{Flags: pfR | pfX}
+	segments = append(segments, code)
+
+	// each segment lives in its own page, but in the file
+	// they're packed together, the virtual address just has to be
+	// congruent to the offset modulo the page size
+	offset := uint64(ehdrSize + phdrSize*len(segments))
+	for i, seg := range segments {
+		offset = align(offset, 16)
+		seg.Offset = offset
+		seg.Addr = baseAddress + offset + uint64(i+1)*pageSize
+		offset += uint64(len(seg.Data))
+	}
+	// the code segment is always last, so nothing after it moves
+	// when we find out its size
+
+	symbols := map[string]uint64{}
+	for _, seg := range segments {
+		switch seg.Flags {
+		case pfR:
+			addLabels(symbols, roLabels, seg.Addr)
+		case pfR | pfW:
+			addLabels(symbols, rwLabels, seg.Addr)
+		}
+	}
+	var codeLabels map[string]uint64
+	code.Data, codeLabels, err = x64.Encode(p.Executable, code.Addr, symbols)
+	if err != nil {
+		return nil, err
+	}
+	addLabels(symbols, codeLabels, 0)
+	err = resolve(readonly, roRefs, symbols)
+	if err != nil {
+		return nil, err
+	}
+	err = resolve(writable, rwRefs, symbols)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bytes.Buffer{}
+	writeHeader(b, code.Addr, len(segments))
+	for _, seg := range segments {
+		writeProgramHeader(b, seg)
+	}
+	for _, seg := range segments {
+		pad(b, seg.Offset)
+		b.Write(seg.Data)
+	}
+	return b.Bytes(), nil
+}
+
+func addLabels(symbols map[string]uint64, labels map[string]uint64, base uint64) {
+	for label, offset := range labels {
+		symbols[label] = base + offset
+	}
+}
+
+// data that points to labels can only be filled after the code is encoded
+func resolve(data []byte, refs map[uint64]string, symbols map[string]uint64) error {
+	for offset, label := range refs {
+		addr, ok := symbols[label]
+		if !ok {
+			return fmt.Errorf("label %v not defined", label)
+		}
+		binary.LittleEndian.PutUint64(data[offset:], addr)
+	}
+	return nil
+}
+
+func align(n, a uint64) uint64 {
+	return (n + a - 1) &^ (a - 1)
+}
+
+func pad(b *bytes.Buffer, offset uint64) {
+	for uint64(b.Len()) < offset {
+		b.WriteByte(0)
+	}
+}
+
+func writeHeader(b *bytes.Buffer, entry uint64, phnum int) {
+	ident := [16]byte{0x7F, 'E', 'L', 'F',
+		2, // 64 bits
+		1, // little endian
+		1, // version
+		3, // linux
+	}
+	b.Write(ident[:])
+	le := binary.LittleEndian
+	binary.Write(b, le, uint16(2))    // executable
+	binary.Write(b, le, uint16(0x3E)) // x86-64
+	binary.Write(b, le, uint32(1))    // version
+	binary.Write(b, le, entry)
+	binary.Write(b, le, uint64(ehdrSize)) // program headers right after
+	binary.Write(b, le, uint64(0))        // no section headers
+	binary.Write(b, le, uint32(0))        // flags
+	binary.Write(b, le, uint16(ehdrSize))
+	binary.Write(b, le, uint16(phdrSize))
+	binary.Write(b, le, uint16(phnum))
+	binary.Write(b, le, uint16(64)) // section header size
+	binary.Write(b, le, uint16(0))
+	binary.Write(b, le, uint16(0))
+}
+
+func writeProgramHeader(b *bytes.Buffer, seg *segment) {
+	le := binary.LittleEndian
+	size := uint64(len(seg.Data))
+	binary.Write(b, le, uint32(1)) // PT_LOAD
+	binary.Write(b, le, seg.Flags)
+	binary.Write(b, le, seg.Offset)
+	binary.Write(b, le, seg.Addr)
+	binary.Write(b, le, seg.Addr)
+	binary.Write(b, le, size)
+	binary.Write(b, le, size)
+	binary.Write(b, le, uint64(pageSize))
+}
+
+/*
+Lays out the data declarations one after the other, just like fasm does,
+returns the contents, the offset of each label and the offset of
+each entry that refers to a label, which is left zeroed.
+*/
+func DataBytes(data []asm.Data) ([]byte, map[string]uint64, map[uint64]string, error) {
+	out := []byte{}
+	labels := map[string]uint64{}
+	refs := map[uint64]string{}
+	for _, d := range data {
+		labels[d.Label] = uint64(len(out))
+		if d.Str != "" {
+			out = append(out, Unescape(d.Str)...)
+		} else if d.Blob == nil {
+			out = append(out, make([]byte, d.Size)...)
+		} else {
+			for _, entry := range d.Blob {
+				if entry.Label != "" {
+					if entry.Type != asm.QuadWord {
+						return nil, nil, nil, fmt.Errorf("%v: addresses take a qword", d.Label)
+					}
+					refs[uint64(len(out))] = entry.Label
+					out = append(out, make([]byte, 8)...)
+					continue
+				}
+				b, err := entryBytes(entry)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("%v: %v", d.Label, err)
+				}
+				out = append(out, b...)
+			}
+		}
+	}
+	return out, labels, refs, nil
+}
+
+var two = big.NewInt(2)
+
+// little endian, two's complement
+func entryBytes(entry asm.DataEntry) ([]byte, error) {
+	var size int
+	switch entry.Type {
+	case asm.Byte:
+		size = 1
+	case asm.Word:
+		size = 2
+	case asm.DoubleWord:
+		size = 4
+	case asm.QuadWord:
+		size = 8
+	default:
+		return nil, fmt.Errorf("invalid data size")
+	}
+	n := new(big.Int).Set(entry.Num)
+	if n.Sign() < 0 {
+		n.Add(n, new(big.Int).Exp(two, big.NewInt(int64(size*8)), nil))
+	}
+	if n.Sign() < 0 || n.BitLen() > size*8 {
+		return nil, fmt.Errorf("%v does not fit in %v bytes", entry.Num, size)
+	}
+	out := make([]byte, size)
+	for i, b := range n.Bytes() { // big endian
+		out[len(n.Bytes())-1-i] = b
+	}
+	return out, nil
+}
+
+// strings keep their quotes and escape sequences until here
+func Unescape(original string) []byte {
+	s := original[1 : len(original)-1]
+	out := []byte{}
+	for i := 0; i < len(s); i++ {
+		r := s[i]
+		if r == '\\' && i+1 < len(s) {
+			i++
+			r = s[i]
+			switch r {
+			case 'n':
+				r = '\n'
+			case 't':
+				r = '\t'
+			case 'r':
+				r = '\r'
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
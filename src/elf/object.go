@@ -0,0 +1,397 @@
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+
+	"mpc/core/asm"
+	"mpc/x64"
+)
+
+// sections after the ones with code and data
+const (
+	shNoteStack = iota
+	shSymtab
+	shStrtab
+	shShstrtab
+	numFixed
+)
+
+const (
+	shtProgbits = 1
+	shtSymtab   = 2
+	shtStrtab   = 3
+	shtRela     = 4
+
+	shfWrite = 1
+	shfAlloc = 2
+	shfExec  = 4
+	shfInfo  = 0x40
+
+	stbLocal  = 0
+	stbGlobal = 1
+	stbWeak   = 2
+
+	sttNotype  = 0
+	sttObject  = 1
+	sttFunc    = 2
+	sttSection = 3
+
+	rX86_64_64    = 1
+	rX86_64_PC32  = 2
+	rX86_64_PLT32 = 4
+	rX86_64_32S   = 11
+
+	shdrSize = 64
+	symSize  = 24
+	relaSize = 24
+)
+
+// the entry point, for when we're linked into an executable
+const startLabel = "_start"
+
+type symbol struct {
+	Name    string
+	Section uint16 // 0 if undefined
+	Value   uint64
+	Type    byte
+	Weak    bool
+}
+
+// Piece is nil if the symbol is by name
+type rela struct {
+	Offset uint64
+	Symbol string
+	Piece  *piece
+	Type   uint32
+	Addend int64
+}
+
+// the code of a procedure, or a piece of data
+type piece struct {
+	Label string
+	Name  string // of the section
+	Flags uint64
+	Align uint64
+	Data  []byte
+	Relas []rela
+
+	Index uint16 // of the section
+	Sym   uint32 // index of the section symbol
+}
+
+// where a label is defined in the object
+type place struct {
+	Piece  *piece
+	Offset uint64
+}
+
+/*
+Generates a relocatable object: procedures and data keep their
+labels as global symbols, anything referenced but not defined
+is left for the linker, just like extern procedures.
+
+Each procedure and each piece of data has its own section, named
+after its label (.text.main_main), so that the linker can leave
+out whatever the program doesn't use (ld --gc-sections). References
+between them are always relocations, since sections may move.
+
+Local labels (.L0) are not symbols, references to them, or to any
+other label defined here, are relative to the section they are in.
+*/
+func Object(p *asm.Program) ([]byte, error) {
+	pieces := []*piece{}
+	defined := map[string]place{}
+	codeRelocs := map[*piece][]x64.Reloc{}
+	for _, chunk := range splitCode(p.Executable) {
+		code, codeLabels, relocs, err := x64.EncodeObject(chunk.Lines)
+		if err != nil {
+			return nil, err
+		}
+		pc := &piece{Label: chunk.Label, Name: ".text." + chunk.Label, Flags: shfAlloc | shfExec, Align: 16, Data: code}
+		pieces = append(pieces, pc)
+		defined[chunk.Label] = place{pc, 0}
+		for label, addr := range codeLabels {
+			defined[label] = place{pc, addr}
+		}
+		codeRelocs[pc] = relocs
+	}
+	dataRefs := map[*piece]map[uint64]string{}
+	addData := func(data []asm.Data, prefix string, flags uint64) error {
+		for _, d := range data {
+			b, _, refs, err := DataBytes([]asm.Data{d})
+			if err != nil {
+				return err
+			}
+			pc := &piece{Label: d.Label, Name: prefix + d.Label, Flags: flags, Align: 8, Data: b}
+			pieces = append(pieces, pc)
+			defined[d.Label] = place{pc, 0}
+			dataRefs[pc] = refs
+		}
+		return nil
+	}
+	err := addData(p.Readonly, ".rodata.", shfAlloc)
+	if err != nil {
+		return nil, err
+	}
+	err = addData(p.Writable, ".data.", shfAlloc|shfWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	// labels defined here are relative to their section, the rest keep their names
+	toRela := func(offset uint64, label string, t uint32, addend int64) rela {
+		if pl, ok := defined[label]; ok {
+			return rela{Offset: offset, Piece: pl.Piece, Type: t, Addend: addend + int64(pl.Offset)}
+		}
+		return rela{Offset: offset, Symbol: label, Type: t, Addend: addend}
+	}
+	for _, pc := range pieces {
+		for _, r := range codeRelocs[pc] {
+			pc.Relas = append(pc.Relas, toRela(r.Offset, r.Symbol, relocType(r.Kind), r.Addend))
+		}
+		for offset, label := range dataRefs[pc] {
+			pc.Relas = append(pc.Relas, toRela(offset, label, rX86_64_64, 0))
+		}
+		sort.Slice(pc.Relas, func(i, j int) bool { return pc.Relas[i].Offset < pc.Relas[j].Offset })
+	}
+
+	// the null section, then one for each piece
+	for i, pc := range pieces {
+		pc.Index = uint16(i + 1)
+	}
+	globals := map[string]symbol{}
+	for _, pc := range pieces {
+		t := byte(sttObject)
+		if pc.Flags&shfExec != 0 {
+			t = sttFunc
+		}
+		globals[pc.Label] = symbol{Name: pc.Label, Section: pc.Index, Value: 0, Type: t}
+	}
+	// a module with main may also be a dependency of another program,
+	// the linker takes the first entry point, and ours goes first
+	if sy, ok := globals[startLabel]; ok {
+		sy.Weak = true
+		globals[startLabel] = sy
+	}
+	for _, pc := range pieces {
+		for _, r := range pc.Relas {
+			if _, ok := globals[r.Symbol]; r.Piece == nil && !ok {
+				globals[r.Symbol] = symbol{Name: r.Symbol}
+			}
+		}
+	}
+
+	// locals first: the null symbol and one for each section
+	symbols := []symbol{{}}
+	for _, pc := range pieces {
+		pc.Sym = uint32(len(symbols))
+		symbols = append(symbols, symbol{Section: pc.Index, Type: sttSection})
+	}
+	firstGlobal := len(symbols)
+	sorted := []symbol{}
+	for _, sy := range globals {
+		sorted = append(sorted, sy)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	symbols = append(symbols, sorted...)
+	index := map[string]uint32{}
+	for i, sy := range sorted {
+		index[sy.Name] = uint32(firstGlobal + i)
+	}
+	symIndex := func(r rela) uint32 {
+		if r.Piece != nil {
+			return r.Piece.Sym
+		}
+		return index[r.Symbol]
+	}
+
+	strtab := newStrtab()
+	symtab := &bytes.Buffer{}
+	le := binary.LittleEndian
+	for i, sy := range symbols {
+		binary.Write(symtab, le, strtab.Add(sy.Name))
+		bind := byte(stbGlobal)
+		if i < firstGlobal {
+			bind = stbLocal
+		} else if sy.Weak {
+			bind = stbWeak
+		}
+		symtab.WriteByte(bind<<4 | sy.Type)
+		symtab.WriteByte(0) // default visibility
+		binary.Write(symtab, le, sy.Section)
+		binary.Write(symtab, le, sy.Value)
+		binary.Write(symtab, le, uint64(0)) // size
+	}
+	writeRelas := func(relas []rela) []byte {
+		b := &bytes.Buffer{}
+		for _, r := range relas {
+			binary.Write(b, le, r.Offset)
+			binary.Write(b, le, uint64(symIndex(r))<<32|uint64(r.Type))
+			binary.Write(b, le, r.Addend)
+		}
+		return b.Bytes()
+	}
+
+	// the pieces, the fixed sections, then the relocations of each piece
+	sections := []section{{}}
+	for _, pc := range pieces {
+		sections = append(sections, section{Name: pc.Name, Type: shtProgbits, Flags: pc.Flags, Align: pc.Align, Data: pc.Data})
+	}
+	fixed := len(sections)
+	symtabIndex := uint32(fixed + shSymtab)
+	strtabIndex := uint32(fixed + shStrtab)
+	sections = append(sections, make([]section, numFixed)...)
+	for _, pc := range pieces {
+		if len(pc.Relas) > 0 {
+			sections = append(sections, relaSection(".rela"+pc.Name, symtabIndex, uint32(pc.Index), writeRelas(pc.Relas)))
+		}
+	}
+	// empty, tells the linker that we don't need an executable stack
+	sections[fixed+shNoteStack] = section{Name: ".note.GNU-stack", Type: shtProgbits, Align: 1}
+	sections[fixed+shSymtab] = section{
+		Name: ".symtab", Type: shtSymtab, Align: 8, Data: symtab.Bytes(),
+		Link: strtabIndex, Info: uint32(firstGlobal), EntSize: symSize,
+	}
+	sections[fixed+shStrtab] = section{Name: ".strtab", Type: shtStrtab, Align: 1, Data: strtab.Bytes()}
+	shstrtab := newStrtab()
+	for i := range sections {
+		sections[i].NameOffset = shstrtab.Add(sections[i].Name)
+	}
+	shstrtabIndex := fixed + shShstrtab
+	sections[shstrtabIndex] = section{Name: ".shstrtab", Type: shtStrtab, Align: 1}
+	sections[shstrtabIndex].NameOffset = shstrtab.Add(".shstrtab")
+	sections[shstrtabIndex].Data = shstrtab.Bytes()
+
+	offset := uint64(ehdrSize)
+	for i := 1; i < len(sections); i++ {
+		offset = align(offset, sections[i].Align)
+		sections[i].Offset = offset
+		offset += uint64(len(sections[i].Data))
+	}
+	shoff := align(offset, 8)
+
+	b := &bytes.Buffer{}
+	writeObjectHeader(b, shoff, len(sections), shstrtabIndex)
+	for _, sec := range sections[1:] {
+		pad(b, sec.Offset)
+		b.Write(sec.Data)
+	}
+	pad(b, shoff)
+	for _, sec := range sections {
+		writeSectionHeader(b, sec)
+	}
+	return b.Bytes(), nil
+}
+
+type chunk struct {
+	Label string
+	Lines []asm.Line
+}
+
+// code is split at each label that is not local, the code
+// before the first one is the entry point, if there's any
+func splitCode(lines []asm.Line) []chunk {
+	chunks := []chunk{}
+	for _, line := range lines {
+		if line.IsLabel && !strings.HasPrefix(line.Label, ".") {
+			chunks = append(chunks, chunk{Label: line.Label})
+		} else if len(chunks) == 0 {
+			chunks = append(chunks, chunk{Label: startLabel})
+		}
+		last := &chunks[len(chunks)-1]
+		last.Lines = append(last.Lines, line)
+	}
+	return chunks
+}
+
+func relocType(k x64.RelocKind) uint32 {
+	switch k {
+	case x64.PC32:
+		return rX86_64_PC32
+	case x64.PLT32:
+		return rX86_64_PLT32
+	}
+	return rX86_64_32S
+}
+
+type section struct {
+	Name       string
+	NameOffset uint32
+	Type       uint32
+	Flags      uint64
+	Offset     uint64
+	Align      uint64
+	Link       uint32
+	Info       uint32
+	EntSize    uint64
+	Data       []byte
+}
+
+func relaSection(name string, symtab, target uint32, data []byte) section {
+	return section{
+		Name: name, Type: shtRela, Flags: shfInfo, Align: 8, Data: data,
+		Link: symtab, Info: target, EntSize: relaSize,
+	}
+}
+
+type strtab struct {
+	b       *bytes.Buffer
+	offsets map[string]uint32
+}
+
+func newStrtab() *strtab {
+	b := &bytes.Buffer{}
+	b.WriteByte(0)
+	return &strtab{b: b, offsets: map[string]uint32{"": 0}}
+}
+
+func (s *strtab) Add(name string) uint32 {
+	if offset, ok := s.offsets[name]; ok {
+		return offset
+	}
+	offset := uint32(s.b.Len())
+	s.b.WriteString(name)
+	s.b.WriteByte(0)
+	s.offsets[name] = offset
+	return offset
+}
+
+func (s *strtab) Bytes() []byte {
+	return s.b.Bytes()
+}
+
+func writeObjectHeader(b *bytes.Buffer, shoff uint64, shnum, shstrndx int) {
+	ident := [16]byte{0x7F, 'E', 'L', 'F', 2, 1, 1, 0}
+	b.Write(ident[:])
+	le := binary.LittleEndian
+	binary.Write(b, le, uint16(1))    // relocatable
+	binary.Write(b, le, uint16(0x3E)) // x86-64
+	binary.Write(b, le, uint32(1))    // version
+	binary.Write(b, le, uint64(0))    // no entry
+	binary.Write(b, le, uint64(0))    // no program headers
+	binary.Write(b, le, shoff)
+	binary.Write(b, le, uint32(0)) // flags
+	binary.Write(b, le, uint16(ehdrSize))
+	binary.Write(b, le, uint16(0))
+	binary.Write(b, le, uint16(0))
+	binary.Write(b, le, uint16(shdrSize))
+	binary.Write(b, le, uint16(shnum))
+	binary.Write(b, le, uint16(shstrndx))
+}
+
+func writeSectionHeader(b *bytes.Buffer, sec section) {
+	le := binary.LittleEndian
+	binary.Write(b, le, sec.NameOffset)
+	binary.Write(b, le, sec.Type)
+	binary.Write(b, le, sec.Flags)
+	binary.Write(b, le, uint64(0)) // address
+	binary.Write(b, le, sec.Offset)
+	binary.Write(b, le, uint64(len(sec.Data)))
+	binary.Write(b, le, sec.Link)
+	binary.Write(b, le, sec.Info)
+	binary.Write(b, le, sec.Align)
+	binary.Write(b, le, sec.EntSize)
+}
@@ -48,11 +48,15 @@ func convertNums(entries []asm.DataEntry) string {
 	for i, entry := range entries {
 		s := genDataSize(entry.Type)
 		b.Place(s)
-		if entry.Num.Cmp(zero) == -1 {
-			b.Place("-")
+		if entry.Label != "" {
+			b.Place(entry.Label)
+		} else {
+			if entry.Num.Cmp(zero) == -1 {
+				b.Place("-")
+			}
+			b.Place("0x")
+			b.Place(scratch.Abs(entry.Num).Text(16))
 		}
-		b.Place("0x")
-		b.Place(scratch.Abs(entry.Num).Text(16))
 		if i < len(entries)-1 {
 			b.Place("\n")
 		}
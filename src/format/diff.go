@@ -0,0 +1,140 @@
+package format
+
+import (
+	"strconv"
+	"strings"
+)
+
+const diffContext = 3
+
+type edit struct {
+	Op   byte // ' ', '-' or '+'
+	Text string
+}
+
+// unified diff from the original to the formatted source,
+// in the same format as diff -u
+func Diff(file, original, formatted string) string {
+	edits := diffLines(splitLines(original), splitLines(formatted))
+
+	// line in each file right before each edit
+	aLine := make([]int, len(edits)+1)
+	bLine := make([]int, len(edits)+1)
+	for i, e := range edits {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if e.Op != '+' {
+			aLine[i+1]++
+		}
+		if e.Op != '-' {
+			bLine[i+1]++
+		}
+	}
+
+	out := &strings.Builder{}
+	out.WriteString("--- " + file + "\n")
+	out.WriteString("+++ " + file + " (formatted)\n")
+	i := 0
+	for i < len(edits) {
+		for i < len(edits) && edits[i].Op == ' ' {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+		// changes close enough share a hunk
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].Op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		begin := max(0, i-diffContext)
+		end = min(len(edits), end+diffContext)
+		out.WriteString("@@ -" + hunkRange(aLine[begin], aLine[end]) +
+			" +" + hunkRange(bLine[begin], bLine[end]) + " @@\n")
+		for _, e := range edits[begin:end] {
+			out.WriteByte(e.Op)
+			out.WriteString(e.Text + "\n")
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// lines are 1 based, an empty range points to the line before it
+func hunkRange(begin, end int) string {
+	size := end - begin
+	if size == 0 {
+		return strconv.Itoa(begin) + ",0"
+	}
+	return strconv.Itoa(begin+1) + "," + strconv.Itoa(size)
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// longest common subsequence, the common prefix and suffix
+// are stripped first since formatting usually changes little
+func diffLines(a, b []string) []edit {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre &&
+		a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	am, bm := a[pre:len(a)-suf], b[pre:len(b)-suf]
+
+	lcs := make([][]int32, len(am)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(bm)+1)
+	}
+	for i := len(am) - 1; i >= 0; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	out := []edit{}
+	for _, line := range a[:pre] {
+		out = append(out, edit{' ', line})
+	}
+	i, j := 0, 0
+	for i < len(am) && j < len(bm) {
+		switch {
+		case am[i] == bm[j]:
+			out = append(out, edit{' ', am[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, edit{'-', am[i]})
+			i++
+		default:
+			out = append(out, edit{'+', bm[j]})
+			j++
+		}
+	}
+	for ; i < len(am); i++ {
+		out = append(out, edit{'-', am[i]})
+	}
+	for ; j < len(bm); j++ {
+		out = append(out, edit{'+', bm[j]})
+	}
+	for _, line := range a[len(a)-suf:] {
+		out = append(out, edit{' ', line})
+	}
+	return out
+}
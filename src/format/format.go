@@ -4,300 +4,522 @@ package format
 import (
 	mod "mpc/core/module"
 	T "mpc/core/module/lexkind"
+	"strings"
 )
 
+const indentation = "    "
+
 func Format(n *mod.Node) string {
-	panic("outdated")
 	ctx := _context()
 	module(ctx, n)
+	ctx.Line()
 	return ctx.String()
 }
 
 func _context() *context {
 	return &context{
-		depth:   0,
-		columns: 0,
-		head:    nil,
-		curr:    nil,
+		start: true,
+		empty: true,
 	}
 }
 
-type llist struct {
-	s    []byte
-	next *llist
+type context struct {
+	depth int // counts scope depth
+	lines int // counts line breaks
+
+	start  bool // nothing was placed in the current line
+	empty  bool // the previous line is empty
+	broken bool // the current line ends in a comment
+
+	b strings.Builder
 }
 
-type context struct {
-	depth   int // counts scope depth
-	columns int // chars per line
+// indentation is only placed with the first thing in the line,
+// so that empty lines stay empty
+func (this *context) Place(s string) {
+	if this.broken {
+		this.Newline()
+	}
+	if this.start {
+		this.b.WriteString(strings.Repeat(indentation, this.depth))
+		this.start = false
+	}
+	this.b.WriteString(s)
+}
 
-	head *llist
-	curr *llist
+func (this *context) Newline() {
+	this.b.WriteString("\n")
+	this.empty = this.start
+	this.start = true
+	this.broken = false
+	this.lines++
 }
 
-func (this *context) indent() {
-	d := this.depth
-	for d > 0 {
-		this.Place([]byte("\t"))
-		d--
+// makes sure the next thing starts a line
+func (this *context) Line() {
+	if !this.start {
+		this.Newline()
 	}
 }
 
-// this allows us to break the line in commas
-func (this *context) Comma() {
-	this.Place([]byte(", "))
-	if this.columns >= 75 {
+// makes sure there's an empty line before the next thing
+func (this *context) Empty() {
+	this.Line()
+	if !this.empty {
 		this.Newline()
 	}
 }
 
-func (this *context) Newline() {
-	this.columns = 0
-	this.Place([]byte("\n"))
-	this.indent()
+// comments go until the end of the line,
+// anything placed after them goes to the next one
+func (this *context) Comment(s string) {
+	this.Place(s)
+	this.broken = true
 }
 
-func (this *context) Place(s []byte) {
-	new := &llist{
-		s:    s,
-		next: nil,
+func (this *context) String() string {
+	return this.b.String()
+}
+
+type printer func(*context, *mod.Node)
+
+func leading(ctx *context, lines []string) {
+	for _, line := range lines {
+		if line == "" {
+			ctx.Empty()
+		} else {
+			ctx.Line()
+			ctx.Comment(line)
+		}
 	}
-	this.columns += len(s)
-	if this.curr != nil {
-		this.curr.next = new
+	ctx.Line()
+}
+
+func trailing(ctx *context, n *mod.Node) {
+	if n.Trailing != "" {
+		ctx.Comment(" " + n.Trailing)
 	}
-	this.curr = new
-	if this.head == nil {
-		this.head = new
+}
+
+// empty lines at the start and end of a container are dropped
+func trimFront(lines []string) []string {
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
 	}
+	return lines
 }
 
-func (this *context) String() string {
-	size := this.getSize()
-	buff := make([]byte, size)
-	index := 0
-	curr := this.head
-	for curr != nil {
-		copy(buff[index:], curr.s)
-		index += len(curr.s)
-		curr = curr.next
+func trimBack(lines []string) []string {
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
 	}
-	return string(buff)
+	return lines
 }
 
-func (this *context) getSize() int {
-	output := 0
-	curr := this.head
-	for curr != nil {
-		output += len(curr.s)
-		curr = curr.next
+// prints the items of a container one per line,
+// the caller places the 'begin' and 'end'
+func items(ctx *context, n *mod.Node, p printer) {
+	for i, leaf := range n.Leaves {
+		ctx.Line()
+		lines := leaf.Leading
+		if i == 0 {
+			lines = trimFront(lines)
+		}
+		leading(ctx, lines)
+		p(ctx, leaf)
+		trailing(ctx, leaf)
+	}
+	closing := trimBack(n.Closing)
+	if len(n.Leaves) == 0 {
+		closing = trimFront(closing)
+	}
+	if len(closing) > 0 {
+		leading(ctx, closing)
 	}
-	return output
 }
 
-type printer func(*context, *mod.Node)
+/*
+Prints a comma separated list, keeping the line breaks
+from the source: an item that started in a new line
+stays in a new line. The line is where the list was opened.
+
+Returns true if the list was broken before the first item,
+in which case whatever closes the list goes in its own line.
+*/
+func list(ctx *context, leaves []*mod.Node, p printer, line int, sep string) bool {
+	broken := false
+	ctx.depth++
+	for i, leaf := range leaves {
+		if i > 0 {
+			ctx.Place(",")
+			trailing(ctx, leaves[i-1])
+		}
+		if leaf.Range.Begin.Line > line || len(leaf.Leading) > 0 {
+			if i == 0 {
+				broken = true
+			}
+			ctx.Line()
+			leading(ctx, leaf.Leading)
+		} else if i > 0 {
+			ctx.Place(" ")
+		} else {
+			ctx.Place(sep)
+		}
+		p(ctx, leaf)
+		line = leaf.Range.End.Line
+	}
+	if len(leaves) > 0 {
+		trailing(ctx, leaves[len(leaves)-1])
+	}
+	ctx.depth--
+	return broken
+}
 
+// for lists that are never broken
 func commalist(ctx *context, leaves []*mod.Node, p printer) {
 	for i, leaf := range leaves {
 		p(ctx, leaf)
 		if i < len(leaves)-1 {
-			ctx.Comma()
+			ctx.Place(", ")
 		}
 	}
 }
 
 func module(ctx *context, n *mod.Node) {
-	_coupling(ctx, n.Leaves[0])
-	ctx.Newline()
-	_symbols(ctx, n.Leaves[1])
-}
-
-func _coupling(ctx *context, n *mod.Node) {
-	for i, leaf := range n.Leaves {
-		switch leaf.Lex {
-		case T.IMPORT:
-			ctx.Place([]byte("import "))
-			commalist(ctx, leaf.Leaves, _id)
-		case T.FROM:
-			_from(ctx, leaf)
-		case T.EXPORT:
-			ctx.Place([]byte("export "))
-			commalist(ctx, leaf.Leaves, _id)
+	symbols := []*mod.Node{}
+	symbols = append(symbols, n.Leaves[0].Leaves...)
+	symbols = append(symbols, n.Leaves[1].Leaves...)
+	var prev *mod.Node
+	for _, leaf := range symbols {
+		ctx.Line()
+		if prev != nil && separate(prev, leaf) {
+			ctx.Empty()
 		}
-		if i < len(n.Leaves)-1 {
-			ctx.Newline()
-		}
-		ctx.Newline()
+		leading(ctx, leaf.Leading)
+		_symbol(ctx, leaf)
+		trailing(ctx, leaf)
+		prev = leaf
+	}
+	closing := trimBack(n.Closing)
+	if len(closing) > 0 {
+		leading(ctx, closing)
 	}
 }
 
-func _from(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("from "))
-	id := n.Leaves[0]
-	ctx.Place([]byte(id.Text))
-	ctx.Newline()
-	ctx.Place([]byte("import "))
-	idlist := n.Leaves[1]
-	commalist(ctx, idlist.Leaves, _id)
+// multiline symbols get an empty line around them,
+// and so does the boundary between couplings and symbols
+func separate(a, b *mod.Node) bool {
+	return isCoupling(a) != isCoupling(b) || multiline(a) || multiline(b)
 }
 
-func _impexp(ctx *context, leaves []*mod.Node, kw []byte) {
+func isCoupling(n *mod.Node) bool {
+	switch n.Lex {
+	case T.IMPORT, T.FROM, T.EXPORT:
+		return true
+	}
+	return false
 }
 
-func _id(ctx *context, n *mod.Node) {
-	ctx.Place([]byte(n.Text))
+// either it spans multiple lines in the source,
+// or it is always printed in multiple lines
+func multiline(n *mod.Node) bool {
+	if n.Range.Begin.Line != n.Range.End.Line {
+		return true
+	}
+	switch n.Lex {
+	case T.PROC, T.STRUCT, T.ATTR:
+		return true
+	case T.CONST, T.DATA:
+		return n.Leaves[0].Lex == T.BEGIN
+	}
+	return false
 }
 
-func _onlyConst(ctx *context, n *mod.Node) {
-	for _, leaf := range n.Leaves {
-		if leaf.Lex == T.CONST {
-			_const(ctx, leaf)
-			ctx.Newline()
-		}
+func _symbol(ctx *context, n *mod.Node) {
+	switch n.Lex {
+	case T.IMPORT:
+		ctx.Place("import")
+		_items(ctx, n.Leaves[0], n.Range.Begin.Line)
+	case T.FROM:
+		_from(ctx, n)
+	case T.EXPORT:
+		ctx.Place("export")
+		_items(ctx, n.Leaves[0], n.Range.Begin.Line)
+	case T.ATTR:
+		_attr(ctx, n)
+	case T.PROC:
+		_proc(ctx, n)
+	case T.DATA:
+		_data(ctx, n)
+	case T.CONST:
+		_const(ctx, n)
+	case T.STRUCT:
+		_struct(ctx, n)
+	default:
+		panic("unknown symbol")
 	}
-	ctx.Newline()
 }
 
-func _onlyMem(ctx *context, n *mod.Node) {
-	for _, leaf := range n.Leaves {
-		if leaf.Lex == T.DATA {
-			_mem(ctx, leaf)
-			ctx.Newline()
-		}
-	}
-	ctx.Newline()
+func _from(ctx *context, n *mod.Node) {
+	id := n.Leaves[0]
+	ctx.Place("from " + id.Text + " import")
+	_items(ctx, n.Leaves[1], id.Range.End.Line)
 }
 
-func _onlyProcs(ctx *context, n *mod.Node) {
-	for i, leaf := range n.Leaves {
-		if leaf.Lex == T.PROC {
-			_proc(ctx, leaf)
+func _items(ctx *context, n *mod.Node, line int) {
+	if n.Lex == T.ALL {
+		ctx.Place(" all")
+		return
+	}
+	list(ctx, n.Leaves, _alias, line, " ")
+}
 
-			if i < len(n.Leaves)-1 {
-				ctx.Newline()
-			}
-			ctx.Newline()
-		}
+func _alias(ctx *context, n *mod.Node) {
+	if n.Lex == T.AS {
+		ctx.Place(n.Leaves[0].Text + " as " + n.Leaves[1].Text)
+		return
 	}
+	_id(ctx, n)
 }
 
-func _symbols(ctx *context, n *mod.Node) {
-	_onlyConst(ctx, n)
-	_onlyMem(ctx, n)
-	_onlyProcs(ctx, n)
+func _id(ctx *context, n *mod.Node) {
+	ctx.Place(n.Text)
 }
 
-func _mem(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("data "))
-	id := n.Leaves[0]
-	ctx.Place([]byte(id.Text))
-	def := n.Leaves[1]
-	ctx.Place([]byte(" "))
-	ctx.Place([]byte(def.Text))
+func _attr(ctx *context, n *mod.Node) {
+	ctx.Place("attr ")
+	commalist(ctx, n.Leaves[0].Leaves, _id)
+	ctx.Line()
+	_symbol(ctx, n.Leaves[1])
+}
+
+func _data(ctx *context, n *mod.Node) {
+	ctx.Place("data ")
+	leaf := n.Leaves[0]
+	if leaf.Lex == T.BEGIN {
+		_group(ctx, leaf, _singleData)
+		return
+	}
+	_singleData(ctx, leaf)
 }
 
 func _const(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("const "))
-	id := n.Leaves[0]
-	ctx.Place([]byte(id.Text))
-	def := n.Leaves[1]
-	ctx.Place([]byte(" "))
-	ctx.Place([]byte(def.Text))
+	ctx.Place("const ")
+	leaf := n.Leaves[0]
+	if leaf.Lex == T.BEGIN {
+		_group(ctx, leaf, _singleConst)
+		return
+	}
+	_singleConst(ctx, leaf)
 }
 
-func _proc(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("proc "))
-	id := n.Leaves[0]
-	ctx.Place([]byte(id.Text))
-	_args(ctx, n.Leaves[1])
-	ctx.Place([]byte(" "))
-	_rets(ctx, n.Leaves[2])
-	ctx.Newline()
-	_vars(ctx, n.Leaves[3])
-	_block(ctx, n.Leaves[4])
-	ctx.Place([]byte(" proc"))
+func _group(ctx *context, n *mod.Node, p printer) {
+	ctx.Place("begin")
+	trailing(ctx, n)
+	ctx.depth++
+	items(ctx, n, func(ctx *context, n *mod.Node) {
+		p(ctx, n)
+		ctx.Place(";")
+	})
+	ctx.depth--
+	ctx.Line()
+	ctx.Place("end")
+}
+
+func _singleData(ctx *context, n *mod.Node) {
+	_id(ctx, n.Leaves[0])
+	_annot(ctx, n.Leaves[1])
+	def := n.Leaves[2]
+	ctx.Place(" ")
+	switch {
+	case def == nil:
+		ctx.Place("[]")
+	case def.Lex == T.STRING_LIT:
+		ctx.Place(def.Text)
+	case def.Lex == T.BLOB:
+		line := n.Leaves[0].Range.End.Line
+		if n.Leaves[1] != nil {
+			line = n.Leaves[1].Range.End.Line
+		}
+		ctx.Place("{")
+		if list(ctx, def.Leaves, _expr, line, "") {
+			ctx.Line()
+		}
+		ctx.Place("}")
+	default:
+		ctx.Place("[")
+		_expr(ctx, def)
+		ctx.Place("]")
+	}
+}
+
+func _singleConst(ctx *context, n *mod.Node) {
+	_id(ctx, n.Leaves[0])
+	_annot(ctx, n.Leaves[1])
+	ctx.Place(" = ")
+	_expr(ctx, n.Leaves[2])
 }
 
-func _vars(ctx *context, n *mod.Node) {
+func _annot(ctx *context, n *mod.Node) {
 	if n != nil {
-		ctx.Place([]byte("var "))
-		commalist(ctx, n.Leaves, _decl)
-		ctx.Newline()
+		ctx.Place(":")
+		_type(ctx, n.Leaves[0])
 	}
 }
 
-func _rets(ctx *context, n *mod.Node) {
-	if n != nil {
-		commalist(ctx, n.Leaves, _type)
+func _struct(ctx *context, n *mod.Node) {
+	ctx.Place("struct ")
+	_id(ctx, n.Leaves[0])
+	if n.Leaves[1] != nil {
+		ctx.Place(" [")
+		_expr(ctx, n.Leaves[1])
+		ctx.Place("]")
 	}
+	ctx.Place(" begin")
+	trailing(ctx, n.Leaves[2])
+	ctx.depth++
+	items(ctx, n.Leaves[2], _field)
+	ctx.depth--
+	ctx.Line()
+	ctx.Place("end")
 }
 
-func _args(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("["))
-	if n != nil {
-		commalist(ctx, n.Leaves, _decl)
+func _field(ctx *context, n *mod.Node) {
+	commalist(ctx, n.Leaves[0].Leaves, _id)
+	_annot(ctx, n.Leaves[1])
+	if n.Leaves[2] != nil {
+		ctx.Place(" {")
+		_expr(ctx, n.Leaves[2])
+		ctx.Place("}")
 	}
-	ctx.Place([]byte("]"))
+	ctx.Place(";")
 }
 
-func _decl(ctx *context, n *mod.Node) {
-	if n.Lex == T.COLON {
-		id := n.Leaves[0]
-		t := n.Leaves[1]
-		ctx.Place([]byte(id.Text))
-		ctx.Place([]byte(":"))
-		_type(ctx, t)
+func _proc(ctx *context, n *mod.Node) {
+	id := n.Leaves[0]
+	if n.Leaves[4].Lex == T.EXTERN {
+		ctx.Place("extern ")
+	}
+	ctx.Place("proc " + id.Text)
+	if cc := n.Leaves[5]; cc != nil {
+		ctx.Place("<" + cc.Text + ">")
+	}
+	args, rets := n.Leaves[1], n.Leaves[2]
+	if args != nil || rets != nil {
+		ctx.Place("[")
+		if args != nil && list(ctx, args.Leaves, _decl, id.Range.End.Line, "") {
+			ctx.Line()
+		}
+		ctx.Place("]")
+	}
+	if rets != nil {
+		ctx.Place(" ")
+		commalist(ctx, rets.Leaves, _type)
+	}
+	if vars := n.Leaves[3]; vars != nil {
+		ctx.Line()
+		ctx.Place("var")
+		list(ctx, vars.Leaves, _decl, vars.Leaves[0].Range.Begin.Line, " ")
+	}
+	body := n.Leaves[4]
+	if body.Lex == T.EXTERN {
 		return
 	}
-	ctx.Place([]byte(n.Text))
+	ctx.Line()
+	if body.Lex == T.ASM {
+		_asm(ctx, body)
+		return
+	}
+	_block(ctx, body)
+}
+
+func _decl(ctx *context, n *mod.Node) {
+	commalist(ctx, n.Leaves[0].Leaves, _id)
+	ctx.Place(":")
+	_type(ctx, n.Leaves[1])
 }
 
 func _type(ctx *context, n *mod.Node) {
-	if n.Lex == T.PROC {
+	switch n.Lex {
+	case T.PROC:
 		_procType(ctx, n)
-		return
+	case T.DOUBLECOLON:
+		ctx.Place(n.Leaves[0].Text + "::" + n.Leaves[1].Text)
+	default:
+		_id(ctx, n)
 	}
-	ctx.Place([]byte(n.Text))
 }
 
 func _procType(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("proc "))
-	args := n.Leaves[0]
-	_procTypeTypeList(ctx, args)
-
-	rets := n.Leaves[1]
-	if rets != nil {
-		if len(rets.Leaves) == 1 {
-			_type(ctx, rets.Leaves[0])
-		} else {
-			_procTypeTypeList(ctx, rets)
-		}
+	ctx.Place("proc")
+	if cc := n.Leaves[2]; cc != nil {
+		ctx.Place("<" + cc.Text + ">")
 	}
+	_procTypeTypeList(ctx, n.Leaves[0])
+	_procTypeTypeList(ctx, n.Leaves[1])
 }
 
 func _procTypeTypeList(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("["))
+	ctx.Place("[")
 	if n != nil {
 		commalist(ctx, n.Leaves, _type)
 	}
-	ctx.Place([]byte("]"))
+	ctx.Place("]")
 }
 
-func _block(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("begin"))
+func _asm(ctx *context, n *mod.Node) {
+	ctx.Place("asm begin")
+	trailing(ctx, n.Leaves[0])
 	ctx.depth++
-	ctx.Newline()
+	items(ctx, n.Leaves[0], _asmLine)
+	ctx.depth--
+	ctx.Line()
+	ctx.Place("end")
+}
 
-	for i, leaf := range n.Leaves {
-		_code(ctx, leaf)
-		if i < len(n.Leaves)-1 {
-			ctx.Newline()
-		}
+func _asmLine(ctx *context, n *mod.Node) {
+	if n.Lex == T.DOT {
+		// labels stay at the start of the line
+		depth := ctx.depth
+		ctx.depth = 0
+		ctx.Place("." + n.Leaves[0].Text + ":")
+		ctx.depth = depth
+		return
+	}
+	_id(ctx, n.Leaves[0])
+	ops := n.Leaves[1].Leaves
+	if len(ops) > 0 {
+		ctx.Place(" ")
+		commalist(ctx, ops, _asmOp)
 	}
+	ctx.Place(";")
+}
 
+func _asmOp(ctx *context, n *mod.Node) {
+	switch n.Lex {
+	case T.LEFTBRACKET:
+		ctx.Place("[")
+		commalist(ctx, n.Leaves[0].Leaves, _asmOp)
+		ctx.Place("]@" + n.Leaves[1].Text)
+	case T.LEFTBRACE:
+		ctx.Place("{")
+		_expr(ctx, n.Leaves[0])
+		ctx.Place("}")
+	case T.DOUBLECOLON:
+		_type(ctx, n)
+	default:
+		_id(ctx, n)
+	}
+}
+
+func _block(ctx *context, n *mod.Node) {
+	ctx.Place("begin")
+	trailing(ctx, n)
+	ctx.depth++
+	items(ctx, n, _code)
 	ctx.depth--
-	ctx.Newline()
-	ctx.Place([]byte("end"))
+	ctx.Line()
+	ctx.Place("end")
 }
 
 func _code(ctx *context, n *mod.Node) {
@@ -306,112 +528,123 @@ func _code(ctx *context, n *mod.Node) {
 		_if(ctx, n)
 	case T.WHILE:
 		_while(ctx, n)
+	case T.DO:
+		_doWhile(ctx, n)
 	case T.RETURN:
 		_return(ctx, n)
 	case T.SET:
 		_set(ctx, n)
 	case T.EXIT:
 		_exit(ctx, n)
+	case T.BREAK, T.CONTINUE:
+		ctx.Place(n.Text + ";")
 	default:
 		_expr(ctx, n)
+		ctx.Place(";")
 	}
 }
 
-func _return(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("return"))
-	if n.Leaves != nil && len(n.Leaves) > 0 {
-		ctx.Place([]byte(" "))
-		commalist(ctx, n.Leaves, _expr)
+// if the condition spans multiple lines,
+// 'begin' goes in its own line
+func _condBlock(ctx *context, cond, block *mod.Node) {
+	lines := ctx.lines
+	_expr(ctx, cond)
+	if ctx.lines > lines {
+		ctx.Line()
+	} else {
+		ctx.Place(" ")
 	}
-	ctx.Place([]byte(";"))
+	_block(ctx, block)
 }
 
-func _exit(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("exit"))
-	if n.Leaves != nil && len(n.Leaves) > 0 {
-		ctx.Place([]byte(" "))
-		_expr(ctx, n.Leaves[0])
+func _if(ctx *context, n *mod.Node) {
+	ctx.Place("if ")
+	_condBlock(ctx, n.Leaves[0], n.Leaves[1])
+	if chain := n.Leaves[2]; chain != nil {
+		for _, leaf := range chain.Leaves {
+			ctx.Place(" elseif ")
+			_condBlock(ctx, leaf.Leaves[0], leaf.Leaves[1])
+		}
+	}
+	if _else := n.Leaves[3]; _else != nil {
+		ctx.Place(" else ")
+		_block(ctx, _else.Leaves[0])
 	}
-	ctx.Place([]byte(";"))
 }
 
 func _while(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("while "))
-	_expr(ctx, n.Leaves[0])
-	ctx.Place([]byte(" "))
-	_block(ctx, n.Leaves[1])
-	ctx.Place([]byte(" while"))
+	ctx.Place("while ")
+	_condBlock(ctx, n.Leaves[0], n.Leaves[1])
 }
 
-func _if(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("if "))
-	_expr(ctx, n.Leaves[0])
-	ctx.Place([]byte(" "))
-	_block(ctx, n.Leaves[1])
-	_elseifchain(ctx, n.Leaves[2])
-	_else(ctx, n.Leaves[3])
-	ctx.Place([]byte(" if"))
+func _doWhile(ctx *context, n *mod.Node) {
+	ctx.Place("do ")
+	_block(ctx, n.Leaves[0])
+	ctx.Place(" while ")
+	_expr(ctx, n.Leaves[1])
+	ctx.Place(";")
 }
 
-func _elseifchain(ctx *context, n *mod.Node) {
-	if n == nil {
-		return
-	}
-	for _, leaf := range n.Leaves {
-		_elseif(ctx, leaf)
+func _return(ctx *context, n *mod.Node) {
+	ctx.Place("return")
+	if len(n.Leaves) > 0 {
+		ctx.Place(" ")
+		commalist(ctx, n.Leaves, _expr)
 	}
+	ctx.Place(";")
 }
 
-func _elseif(ctx *context, n *mod.Node) {
-	ctx.Place([]byte(" elseif "))
-	_expr(ctx, n.Leaves[0])
-	ctx.Place([]byte(" "))
-	_block(ctx, n.Leaves[1])
-}
-
-func _else(ctx *context, n *mod.Node) {
-	if n == nil {
-		return
+func _exit(ctx *context, n *mod.Node) {
+	ctx.Place("exit")
+	if n.Leaves[0] != nil {
+		ctx.Place("?")
 	}
-	ctx.Place([]byte(" else "))
-	_block(ctx, n.Leaves[0])
+	ctx.Place(" ")
+	_expr(ctx, n.Leaves[1])
+	ctx.Place(";")
 }
 
 func _set(ctx *context, n *mod.Node) {
-	ctx.Place([]byte("set "))
-	assignees := n.Leaves[0]
-	commalist(ctx, assignees.Leaves, _expr)
+	ctx.Place("set")
+	list(ctx, n.Leaves[0].Leaves, _expr, n.Range.Begin.Line, " ")
 	op := n.Leaves[1]
-	ctx.Place([]byte(" " + op.Text + " "))
+	if n.Leaves[2] == nil { // ++ and --
+		ctx.Place(op.Text + ";")
+		return
+	}
+	ctx.Place(" " + op.Text + " ")
 	_expr(ctx, n.Leaves[2])
+	ctx.Place(";")
 }
 
 func _expr(ctx *context, n *mod.Node) {
-	smallNumber := -1 * (1 << 10)
-	_exprPrec(ctx, n, smallNumber)
+	_exprPrec(ctx, n, 0)
 }
 
+// parenthesis are only placed where precedence requires them
 func _exprPrec(ctx *context, n *mod.Node, prevPrecedence int) {
 	switch n.Lex {
 	case T.IDENTIFIER:
 		_id(ctx, n)
 	case T.SIZEOF:
-		ctx.Place([]byte("sizeof "))
+		ctx.Place("sizeof[")
 		_type(ctx, n.Leaves[0])
+		if dot := n.Leaves[1]; dot != nil {
+			ctx.Place("." + dot.Leaves[0].Text)
+		}
+		ctx.Place("]")
 	case T.DOUBLECOLON:
-		_id(ctx, n.Leaves[0])
-		ctx.Place([]byte("::"))
-		_id(ctx, n.Leaves[1])
+		_type(ctx, n)
 	case T.I64_LIT, T.I32_LIT, T.I16_LIT, T.I8_LIT,
 		T.U64_LIT, T.U32_LIT, T.U16_LIT, T.U8_LIT,
 		T.FALSE, T.TRUE, T.PTR_LIT, T.STRING_LIT,
 		T.CHAR_LIT:
-		ctx.Place([]byte(n.Text))
+		ctx.Place(n.Text)
 	case T.NEG, T.BITWISENOT, T.NOT:
 		if precedence(n.Lex) < prevPrecedence {
-			ctx.Place([]byte("("))
+			ctx.Place("(")
 			unary(ctx, n)
-			ctx.Place([]byte(")"))
+			ctx.Place(")")
 		} else {
 			unary(ctx, n)
 		}
@@ -422,48 +655,77 @@ func _exprPrec(ctx *context, n *mod.Node, prevPrecedence int) {
 		T.MORE, T.MOREEQ, T.LESS, T.LESSEQ,
 		T.AND, T.OR:
 		if precedence(n.Lex) < prevPrecedence {
-			ctx.Place([]byte("("))
+			ctx.Place("(")
 			binary(ctx, n)
-			ctx.Place([]byte(")"))
+			ctx.Place(")")
 		} else {
 			binary(ctx, n)
 		}
 	// these have the highest precedence
 	case T.COLON:
 		_exprPrec(ctx, n.Leaves[1], precedence(T.COLON))
-		ctx.Place([]byte(":"))
+		ctx.Place(":")
 		_type(ctx, n.Leaves[0])
 	case T.AT:
 		_exprPrec(ctx, n.Leaves[1], precedence(T.AT))
-		ctx.Place([]byte("@"))
+		ctx.Place("@")
 		_type(ctx, n.Leaves[0])
 	case T.DOT:
 		_exprPrec(ctx, n.Leaves[1], precedence(T.DOT))
-		ctx.Place([]byte("."))
+		ctx.Place(".")
 		_id(ctx, n.Leaves[0])
 	case T.ARROW:
 		_exprPrec(ctx, n.Leaves[1], precedence(T.ARROW))
-		ctx.Place([]byte("->"))
+		ctx.Place("->")
 		_id(ctx, n.Leaves[0])
 	case T.CALL:
-		_exprPrec(ctx, n.Leaves[1], precedence(T.CALL))
-		ctx.Place([]byte("["))
-		exprs := n.Leaves[0]
-		commalist(ctx, exprs.Leaves, _expr)
-		ctx.Place([]byte("]"))
+		callee := n.Leaves[1]
+		_exprPrec(ctx, callee, precedence(T.CALL))
+		ctx.Place("[")
+		if list(ctx, n.Leaves[0].Leaves, _expr, callee.Range.End.Line, "") {
+			ctx.Line()
+		}
+		ctx.Place("]")
 	default:
 		panic("oh no!")
 	}
 }
 
+// operators are left associative, so the right side
+// needs parenthesis even if it has the same precedence.
+// line breaks after the operator are kept
 func binary(ctx *context, n *mod.Node) {
-	_exprPrec(ctx, n.Leaves[0], precedence(n.Lex))
-	ctx.Place([]byte(" " + T.Tktosrc[n.Lex] + " "))
-	_exprPrec(ctx, n.Leaves[1], precedence(n.Lex))
+	left, right := n.Leaves[0], n.Leaves[1]
+	operand(ctx, n, left, precedence(n.Lex))
+	if right.Range.Begin.Line > left.Range.End.Line {
+		ctx.Place(" " + n.Text)
+		ctx.depth++
+		ctx.Line()
+		operand(ctx, n, right, precedence(n.Lex)+1)
+		ctx.depth--
+		return
+	}
+	ctx.Place(" " + n.Text + " ")
+	operand(ctx, n, right, precedence(n.Lex)+1)
+}
+
+// 'and' inside 'or' is easy to misread, so it keeps the parenthesis
+func operand(ctx *context, parent, n *mod.Node, prec int) {
+	if parent.Lex == T.OR && n.Lex == T.AND {
+		ctx.Place("(")
+		binary(ctx, n)
+		ctx.Place(")")
+		return
+	}
+	_exprPrec(ctx, n, prec)
 }
 
 func unary(ctx *context, n *mod.Node) {
-	ctx.Place([]byte(T.Tktosrc[n.Lex] + " "))
+	if n.Lex == T.NOT {
+		ctx.Place(n.Text + " ")
+	} else {
+		ctx.Place(n.Text)
+	}
 	_exprPrec(ctx, n.Leaves[0], precedence(n.Lex))
 }
 
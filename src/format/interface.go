@@ -0,0 +1,177 @@
+package format
+
+import (
+	mod "mpc/core/module"
+	GK "mpc/core/module/globalkind"
+	T "mpc/core/module/lexkind"
+	types "mpc/core/types"
+
+	"math/big"
+	"sort"
+)
+
+/*
+Prints the interface of a typechecked module: the couplings
+as they are in the source, every struct with its layout, and
+the exported symbols, without anything that generates code.
+
+Procedures become extern declarations, data keeps only its size
+and constants are evaluated. Interfaces are Millipascal, so that
+they can be read by the rest of the compiler like any module.
+*/
+func Interface(M *mod.Module) string {
+	ctx := _context()
+	var prev *mod.Node
+	for _, leaf := range M.Root.Leaves[0].Leaves {
+		ctx.Line()
+		if prev != nil && separate(prev, leaf) {
+			ctx.Empty()
+		}
+		_symbol(ctx, leaf)
+		prev = leaf
+	}
+
+	for _, sy := range interfaceGlobals(M) {
+		ctx.Empty()
+		switch sy.Kind {
+		case GK.Proc:
+			_externProc(ctx, sy)
+		case GK.Data:
+			_externData(ctx, sy)
+		case GK.Const:
+			_evaluatedConst(ctx, sy)
+		case GK.Struct:
+			_layout(ctx, sy)
+		}
+	}
+	ctx.Line()
+	return ctx.String()
+}
+
+// in source order, so that interfaces don't change for no reason
+func interfaceGlobals(M *mod.Module) []*mod.Global {
+	output := []*mod.Global{}
+	for _, sy := range M.Globals {
+		if sy.External {
+			continue
+		}
+		if sy.Kind == GK.Struct || isExported(M, sy) {
+			output = append(output, sy)
+		}
+	}
+	sort.Slice(output, func(i, j int) bool {
+		a, b := output[i].N.Leaves[0].Range, output[j].N.Leaves[0].Range
+		return a.Begin.LessThan(b.Begin)
+	})
+	return output
+}
+
+func isExported(M *mod.Module, sy *mod.Global) bool {
+	for _, exp := range M.Exported {
+		if exp == sy {
+			return true
+		}
+	}
+	return false
+}
+
+// Foreign marks procedures that were already extern in the source,
+// those keep their names, the rest are defined by the module's object
+const Foreign = "foreign"
+
+func _externProc(ctx *context, sy *mod.Global) {
+	if sy.Proc.Extern {
+		ctx.Place("attr " + Foreign)
+		ctx.Line()
+	}
+	n := *sy.N
+	n.Leaves = []*mod.Node{
+		n.Leaves[0], n.Leaves[1], n.Leaves[2], nil,
+		{Lex: T.EXTERN, Text: "extern"},
+		n.Leaves[5],
+	}
+	_proc(ctx, &n)
+}
+
+// structs are counted in elements, anything else in bytes
+func _externData(ctx *context, sy *mod.Global) {
+	ctx.Place("data " + sy.Name)
+	size := sy.Data.Size
+	annot := sy.N.Leaves[1]
+	if annot != nil && types.IsStruct(sy.Data.Type) {
+		count, rem := new(big.Int).QuoRem(size, sy.Data.Type.Struct.Size, new(big.Int))
+		if rem.Sign() == 0 {
+			_annot(ctx, annot)
+			size = count
+		}
+	} else {
+		_annot(ctx, annot)
+	}
+	ctx.Place(" [" + number(size) + "]")
+}
+
+func _evaluatedConst(ctx *context, sy *mod.Global) {
+	ctx.Place("const " + sy.Name + " = " + literal(sy.Const.Value, sy.Const.Type))
+}
+
+// size and offsets are explicit, the layout doesn't
+// depend on anything that could change
+func _layout(ctx *context, sy *mod.Global) {
+	st := sy.Struct.Type.Struct
+	ctx.Place("struct " + sy.Name + " [" + number(st.Size) + "] begin")
+	ctx.depth++
+	fields := map[string]*mod.Node{}
+	for _, field := range sy.N.Leaves[2].Leaves {
+		for _, id := range field.Leaves[0].Leaves {
+			fields[id.Text] = field.Leaves[1]
+		}
+	}
+	for _, field := range st.Fields {
+		ctx.Line()
+		ctx.Place(field.Name)
+		_annot(ctx, fields[field.Name])
+		ctx.Place(" {" + number(field.Offset) + "};")
+	}
+	ctx.depth--
+	ctx.Line()
+	ctx.Place("end")
+}
+
+// offsets may be negative, there are no negative literals
+func number(v *big.Int) string {
+	text := new(big.Int).Abs(v).Text(10)
+	if v.Sign() < 0 {
+		return "~" + text
+	}
+	return text
+}
+
+// the suffix keeps the type of the constant
+func literal(v *big.Int, t *types.Type) string {
+	if types.IsBool(t) {
+		if v.Sign() == 0 {
+			return "false"
+		}
+		return "true"
+	}
+	text := number(v)
+	switch t.Basic {
+	case types.I8:
+		return text + "ss"
+	case types.I16:
+		return text + "s"
+	case types.I64:
+		return text + "l"
+	case types.U8:
+		return text + "uss"
+	case types.U16:
+		return text + "us"
+	case types.U32:
+		return text + "u"
+	case types.U64:
+		return text + "ul"
+	case types.Ptr:
+		return text + "p"
+	}
+	return text
+}
@@ -0,0 +1,273 @@
+package gas
+
+import (
+	"math/big"
+	"mpc/core/asm"
+	ik "mpc/core/asm/instrkind"
+	. "mpc/core/strbuilder"
+	"strconv"
+	"strings"
+)
+
+// GNU as has no notion of fasm's local labels (.L0 belongs to the
+// previous label), so we qualify them ourselves: main_main.L0.
+// The other labels are global, like in native objects, so that
+// objects linked with the program may use them
+func Generate(program *asm.Program) string {
+	b := &Builder{}
+	b.Place(".intel_syntax noprefix\n")
+	b.Place("\n.section .rodata\n")
+	for _, data := range program.Readonly {
+		genData(b, data)
+	}
+	b.Place("\n.data\n")
+	for _, data := range program.Writable {
+		genData(b, data)
+	}
+	b.Place("\n.text\n")
+	b.Place(".globl _start\n")
+	b.Place("_start:\n")
+	scope := ""
+	for _, line := range program.Executable {
+		if line.IsLabel && !isLocal(line.Label) {
+			scope = line.Label
+		}
+		genLine(b, scope, line)
+		b.Place("\n")
+	}
+	return b.String()
+}
+
+func isLocal(label string) bool {
+	return strings.HasPrefix(label, ".")
+}
+
+func qualify(scope, label string) string {
+	if isLocal(label) {
+		return scope + label
+	}
+	return label
+}
+
+func genData(b *Builder, data asm.Data) {
+	b.Place(".globl " + data.Label + "\n")
+	b.Place(data.Label)
+	b.Place(":")
+	if data.Str != "" {
+		b.Place(convertString(data.Str))
+	} else if data.Blob == nil {
+		b.Place(" .zero ")
+		b.Place(strconv.Itoa(data.Size))
+	} else {
+		b.Place(convertNums(data.Blob))
+	}
+	b.Place("\n")
+}
+
+func convertNums(entries []asm.DataEntry) string {
+	b := &Builder{}
+	for i, entry := range entries {
+		b.Place(genDataSize(entry.Type))
+		if entry.Label != "" {
+			b.Place(entry.Label)
+		} else {
+			b.Place(convNum(entry.Num))
+		}
+		if i < len(entries)-1 {
+			b.Place("\n")
+		}
+	}
+	return b.String()
+}
+
+func genDataSize(size asm.TypeSize) string {
+	switch size {
+	case asm.Byte:
+		return " .byte "
+	case asm.Word:
+		return " .word "
+	case asm.DoubleWord:
+		return " .long "
+	case asm.QuadWord:
+		return " .quad "
+	default:
+		panic("unknown size")
+	}
+}
+
+func genLine(b *Builder, scope string, line asm.Line) {
+	if line.IsLabel {
+		if !isLocal(line.Label) {
+			b.Place(".globl " + line.Label + "\n")
+		}
+		b.Place(qualify(scope, line.Label))
+		b.Place(":")
+		return
+	}
+	instr := line.Instr
+	b.Place("\t")
+	b.Place(ik.KindToString(instr.Kind))
+	b.Place("\t")
+	for i, op := range instr.Operands {
+		if i != 0 {
+			b.Place(", ")
+		}
+		switch op.Kind {
+		case asm.Simple:
+			b.Place(simpleOp(scope, instr.Kind, op.A))
+		case asm.Addressing:
+			genAddr(b, scope, op)
+		}
+	}
+}
+
+// in intel syntax a bare label is a memory access,
+// unless it is the target of a jump or call
+func simpleOp(scope string, kind ik.InstrKind, v asm.Value) string {
+	if v.Kind == asm.Label {
+		label := qualify(scope, v.Label)
+		if isBranch(kind) {
+			return label
+		}
+		return "offset " + label
+	}
+	return valueToString(scope, v)
+}
+
+func isBranch(kind ik.InstrKind) bool {
+	switch kind {
+	case ik.Call, ik.Jmp, ik.Je, ik.Jne, ik.Jl, ik.Jle,
+		ik.Jg, ik.Jge, ik.Jb, ik.Jbe, ik.Ja, ik.Jae:
+		return true
+	}
+	return false
+}
+
+func genAddr(b *Builder, scope string, op asm.Operand) {
+	b.Place(op.TypeSize.String())
+	b.Place(" ptr [")
+	if op.A.Kind == asm.Label {
+		// fasm uses rip relative addressing by default
+		b.Place("rip + ")
+	}
+	b.Place(valueToString(scope, op.A))
+	if op.B.Kind != asm.InvalidValueKind {
+		if op.B.Const != nil {
+			if op.B.Const.Cmp(zero) == -1 {
+				b.Place(" - ")
+				b.Place(convNum(scratch.Abs(op.B.Const)))
+				b.Place("]")
+				return
+			}
+		}
+		b.Place(" + ")
+		b.Place(valueToString(scope, op.B))
+	}
+	b.Place("]")
+}
+
+func valueToString(scope string, v asm.Value) string {
+	switch v.Kind {
+	case asm.Const:
+		return convNum(v.Const)
+	case asm.Label:
+		return qualify(scope, v.Label)
+	case asm.Reg:
+		return genReg(v.Reg)
+	default:
+		return "???"
+	}
+}
+
+type register struct {
+	QWord string
+	DWord string
+	Word  string
+	Byte  string
+}
+
+var registers = []*register{
+	{QWord: "rax", DWord: "eax", Word: "ax", Byte: "al"},
+	{QWord: "rcx", DWord: "ecx", Word: "cx", Byte: "cl"},
+	{QWord: "rdx", DWord: "edx", Word: "dx", Byte: "dl"},
+	{QWord: "rbx", DWord: "ebx", Word: "bx", Byte: "bl"},
+
+	{QWord: "rsp", DWord: "esp", Word: "sp", Byte: "spl"},
+	{QWord: "rbp", DWord: "ebp", Word: "bp", Byte: "bpl"},
+	{QWord: "rsi", DWord: "esi", Word: "si", Byte: "sil"},
+	{QWord: "rdi", DWord: "edi", Word: "di", Byte: "dil"},
+
+	{QWord: "r8", DWord: "r8d", Word: "r8w", Byte: "r8b"},
+	{QWord: "r9", DWord: "r9d", Word: "r9w", Byte: "r9b"},
+	{QWord: "r10", DWord: "r10d", Word: "r10w", Byte: "r10b"},
+	{QWord: "r11", DWord: "r11d", Word: "r11w", Byte: "r11b"},
+
+	{QWord: "r12", DWord: "r12d", Word: "r12w", Byte: "r12b"},
+	{QWord: "r13", DWord: "r13d", Word: "r13w", Byte: "r13b"},
+	{QWord: "r14", DWord: "r14d", Word: "r14w", Byte: "r14b"},
+	{QWord: "r15", DWord: "r15d", Word: "r15w", Byte: "r15b"},
+}
+
+func genReg(v asm.Register) string {
+	if v.ID == 16 {
+		return "rip"
+	}
+	r := registers[v.ID]
+	switch v.TypeSize {
+	case asm.QuadWord:
+		return r.QWord
+	case asm.DoubleWord:
+		return r.DWord
+	case asm.Word:
+		return r.Word
+	case asm.Byte:
+		return r.Byte
+	}
+	panic("invalid type size")
+}
+
+var zero = big.NewInt(0)
+var scratch = big.NewInt(0)
+
+func convNum(num *big.Int) string {
+	if num == nil {
+		return "nil" // easier to debug this way
+	}
+	sign := ""
+	if num.Cmp(zero) == -1 {
+		sign = "-"
+	}
+	return sign + "0x" + strings.ToUpper(scratch.Abs(num).Text(16))
+}
+
+// millipascal escapes are a subset of the ones in GNU as,
+// except for \' which as does not need
+func convertString(original string) string {
+	s := original[1 : len(original)-1] // removes quotes
+	output := " .ascii \""
+	for i := 0; i < len(s); i++ {
+		r := s[i]
+		if r == '\\' {
+			i++
+			r = s[i]
+			switch r {
+			case 'n':
+				output += "\\n"
+			case 't':
+				output += "\\t"
+			case 'r':
+				output += "\\r"
+			case '\\':
+				output += "\\\\"
+			default:
+				output += string(r)
+			}
+		} else if r == '"' {
+			output += "\\\""
+		} else {
+			output += string(r)
+		}
+	}
+	output += "\""
+	return output
+}
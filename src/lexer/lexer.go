@@ -52,12 +52,22 @@ type Lexer struct {
 	Input      string
 
 	Peeked *ir.Node
+
+	// trivia, the parser attaches it to the tree
+	Comments []*Comment
+	Blank    map[int]bool // lines with nothing but whitespace
+}
+
+type Comment struct {
+	Text  string
+	Range *Range
 }
 
 func NewLexer(filename string, s string) *Lexer {
 	st := &Lexer{
 		File:  filename,
 		Input: s,
+		Blank: map[int]bool{},
 	}
 	return st
 }
@@ -229,10 +239,28 @@ func ignoreWhitespace(st *Lexer) {
 loop:
 	for {
 		switch r {
-		case ' ', '\t', '\n':
+		case ' ', '\t':
+			nextRune(st)
+		case '\n':
+			if emptyLine(st) {
+				st.Blank[st.EndLine] = true
+			}
 			nextRune(st)
 		case '#':
+			begin := Position{Line: st.EndLine, Column: st.EndCol}
+			start := st.End
 			comment(st)
+			text := strings.TrimRight(st.Input[start:st.End], " \t\r\n")
+			st.Comments = append(st.Comments, &Comment{
+				Text: text,
+				Range: &Range{
+					Begin: begin,
+					End: Position{
+						Line:   begin.Line,
+						Column: begin.Column + utf8.RuneCountInString(text),
+					},
+				},
+			})
 		default:
 			break loop
 		}
@@ -241,6 +269,15 @@ loop:
 	ignore(st)
 }
 
+// checks if the line we're about to end had only whitespace
+func emptyLine(st *Lexer) bool {
+	i := st.End - 1
+	for i >= 0 && (st.Input[i] == ' ' || st.Input[i] == '\t') {
+		i--
+	}
+	return i < 0 || st.Input[i] == '\n'
+}
+
 // refactor this
 func any(st *Lexer) (*ir.Node, *Error) {
 	var r rune
@@ -529,6 +566,10 @@ func identifier(st *Lexer) *ir.Node {
 		tp = T.WHILE
 	case "do":
 		tp = T.DO
+	case "break":
+		tp = T.BREAK
+	case "continue":
+		tp = T.CONTINUE
 	case "return":
 		tp = T.RETURN
 	case "elseif":
@@ -581,6 +622,8 @@ func identifier(st *Lexer) *ir.Node {
 		tp = T.ATTR
 	case "asm":
 		tp = T.ASM
+	case "extern":
+		tp = T.EXTERN
 	}
 	return genNode(st, tp)
 }
@@ -13,6 +13,7 @@ import (
 	GK "mpc/core/module/globalkind"
 	LK "mpc/core/module/lexkind"
 	msg "mpc/messages"
+	"mpc/parallel"
 
 	lck "mpc/core/module/localkind"
 
@@ -30,9 +31,48 @@ type context struct {
 
 	CurrBlock *pir.BasicBlock
 
+	// innermost loop is last
+	Loops []*loop
+
 	TempCounter int64
 }
 
+// where break and continue jump to,
+// blocks are only created if something jumps there,
+// otherwise they would be unreachable
+type loop struct {
+	Cond    pir.BlockID
+	End     pir.BlockID
+	HasCond bool
+	HasEnd  bool
+}
+
+func (c *context) PushLoop(l *loop) {
+	c.Loops = append(c.Loops, l)
+}
+
+func (c *context) PopLoop() *loop {
+	l := c.Loops[len(c.Loops)-1]
+	c.Loops = c.Loops[:len(c.Loops)-1]
+	return l
+}
+
+func (c *context) LoopCond(l *loop) pir.BlockID {
+	if !l.HasCond {
+		l.Cond, _ = c.NewBlock()
+		l.HasCond = true
+	}
+	return l.Cond
+}
+
+func (c *context) LoopEnd(l *loop) pir.BlockID {
+	if !l.HasEnd {
+		l.End, _ = c.NewBlock()
+		l.HasEnd = true
+	}
+	return l.End
+}
+
 func newContext(M *mod.Module) *context {
 	return &context{
 		Program:     pir.NewProgram(),
@@ -62,6 +102,18 @@ func (c *context) AllocTemp(t *T.Type) pir.Operand {
 	return op
 }
 
+// temps don't survive across basic blocks,
+// so anything that needs to is kept in a hidden variable
+func (c *context) AllocHiddenVar(t *T.Type) pir.Operand {
+	op := pir.Operand{
+		Class: pirc.Variable,
+		Type:  t,
+		ID:    int64(len(c.PirProc.Vars)),
+	}
+	c.PirProc.Vars = append(c.PirProc.Vars, t)
+	return op
+}
+
 func (c *context) GetSymbolID(sy *mod.Global) pir.SymbolID {
 	return c.symbolMap[sy.Label()]
 }
@@ -90,14 +142,13 @@ func Generate(M *mod.Module) (*pir.Program, *Error) {
 	}
 
 	M.ResetVisited()
+	c.Program.Name = M.Name
+	c.Program.Entry = pir.NoEntry
 	sy, ok := M.Globals["main"]
-	if !ok {
-		panic("UERES MAIN")
+	if ok && !M.Interface {
+		c.Program.Entry = c.GetSymbolID(sy)
 	}
 
-	c.Program.Entry = c.GetSymbolID(sy)
-	c.Program.Name = sy.ModuleName
-
 	return c.Program, nil
 }
 
@@ -106,17 +157,16 @@ func declAll(c *context, M *mod.Module) {
 		return
 	}
 	M.Visited = true
-	for _, dep := range M.Dependencies {
+	for _, dep := range M.SortedDependencies() {
 		declAll(c, dep.M)
 	}
-	for _, sy := range M.Globals {
+	for _, sy := range M.SortedGlobals() {
 		if !sy.External {
 			if sy.Kind == GK.Proc {
-				p := newPirProc(sy)
-				i := c.Program.AddProc(p)
-				c.symbolMap[p.Label] = pir.SymbolID(i)
+				declProc(c, sy, M.Interface)
 			} else if sy.Kind == GK.Data {
 				m := newPirMem(c, sy)
+				m.Extern = M.Interface
 				i := c.Program.AddMem(m)
 				c.symbolMap[m.Label] = pir.SymbolID(i)
 			}
@@ -124,33 +174,74 @@ func declAll(c *context, M *mod.Module) {
 	}
 }
 
-func genAll(c *context, M *mod.Module) *Error {
-	if M.Visited {
-		return nil
+// extern procedures may be defined in the program itself,
+// all declarations share the symbol with the definition.
+// procedures from interfaces are defined in their objects
+func declProc(c *context, sy *mod.Global, interface_ bool) {
+	p := newPirProc(sy)
+	p.Extern = p.Extern || interface_
+	i, ok := c.symbolMap[p.Label]
+	if ok {
+		if !p.Extern {
+			c.Program.Symbols[i].Proc = p
+		}
+		return
 	}
-	M.Visited = true
-	for _, dep := range M.Dependencies {
-		err := genAll(c, dep.M)
+	i = pir.SymbolID(c.Program.AddProc(p))
+	c.symbolMap[p.Label] = i
+}
+
+/*
+Procedures are generated in parallel, each with its own context.
+They only read the module and the symbol map, and each one
+writes to its own pir.Procedure.
+*/
+func genAll(c *context, M *mod.Module) *Error {
+	procs := []modProc{}
+	collectProcs(M, &procs)
+	errs := make([]*Error, len(procs))
+	parallel.Each(len(procs), func(i int) {
+		pc := &context{Program: c.Program, symbolMap: c.symbolMap}
+		errs[i] = genProc(pc, procs[i].M, procs[i].Sy)
+	})
+	for _, err := range errs {
 		if err != nil {
 			return err
 		}
 	}
-	for _, sy := range M.Globals {
-		if !sy.External {
-			if sy.Kind == GK.Proc {
-				err := genProc(c, M, sy)
-				if err != nil {
-					return err
-				}
-			}
+	return nil
+}
+
+type modProc struct {
+	M  *mod.Module
+	Sy *mod.Global
+}
+
+// dependencies come first
+func collectProcs(M *mod.Module, procs *[]modProc) {
+	if M.Visited {
+		return
+	}
+	M.Visited = true
+	for _, dep := range M.SortedDependencies() {
+		collectProcs(dep.M, procs)
+	}
+	if M.Interface {
+		return
+	}
+	for _, sy := range M.SortedGlobals() {
+		if !sy.External && sy.Kind == GK.Proc {
+			*procs = append(*procs, modProc{M, sy})
 		}
 	}
-	return nil
 }
 
 func genProc(c *context, M *mod.Module, sy *mod.Global) *Error {
 	proc := sy.Proc
 	c.ModProc = proc
+	if proc.Extern {
+		return nil
+	}
 	c.PirProc = c.GetSymbol(sy).Proc
 
 	startID, start := c.NewBlock()
@@ -187,6 +278,10 @@ func setReturn(b *pir.BasicBlock) {
 
 func genBlock(M *mod.Module, c *context, body *mod.Node) {
 	for _, code := range body.Leaves {
+		if c.CurrBlock == nil {
+			// nothing flows here, the rest is unreachable
+			return
+		}
 		switch code.Lex {
 		case LK.IF:
 			genIf(M, c, code)
@@ -202,6 +297,14 @@ func genBlock(M *mod.Module, c *context, body *mod.Node) {
 		case LK.EXIT:
 			genExit(M, c, code)
 			return
+		case LK.BREAK:
+			l := c.Loops[len(c.Loops)-1]
+			c.CurrBlock.Jmp(c.LoopEnd(l))
+			return
+		case LK.CONTINUE:
+			l := c.Loops[len(c.Loops)-1]
+			c.CurrBlock.Jmp(c.LoopCond(l))
+			return
 		default:
 			genExpr(M, c, code)
 		}
@@ -214,13 +317,12 @@ func genIf(M *mod.Module, c *context, if_ *mod.Node) {
 	elseifchain := if_.Leaves[2]
 	else_ := if_.Leaves[3]
 
-	op := genExpr(M, c, exp)
 	trueblID, truebl := c.NewBlock()
 	falseblID, falsebl := c.NewBlock()
 	var outblID pir.BlockID
 	var outbl *pir.BasicBlock // we just generate an out block if it's reachable
 
-	c.CurrBlock.Branch(op, trueblID, falseblID)
+	genCond(M, c, exp, trueblID, falseblID)
 
 	c.CurrBlock = truebl
 	genBlock(M, c, block)
@@ -250,10 +352,9 @@ func genElseIfChain(M *mod.Module, c *context, elseifchain *mod.Node, outblID pi
 		exp := elseif.Leaves[0]
 		block := elseif.Leaves[1]
 
-		op := genExpr(M, c, exp)
 		trueblID, truebl := c.NewBlock()
 		falseblID, falsebl := c.NewBlock()
-		c.CurrBlock.Branch(op, trueblID, falseblID)
+		genCond(M, c, exp, trueblID, falseblID)
 
 		c.CurrBlock = truebl
 		genBlock(M, c, block)
@@ -272,12 +373,16 @@ func genWhile(M *mod.Module, c *context, while *mod.Node) {
 	c.CurrBlock.Jmp(loop_startID)
 	c.CurrBlock = loop_start
 
-	op := genExpr(M, c, while.Leaves[0])
-	c.CurrBlock.Branch(op, loop_bodyID, loop_endID)
+	genCond(M, c, while.Leaves[0], loop_bodyID, loop_endID)
 
 	c.CurrBlock = loop_body
+	c.PushLoop(&loop{
+		Cond: loop_startID, HasCond: true,
+		End: loop_endID, HasEnd: true,
+	})
 	genBlock(M, c, while.Leaves[1])
-	if !c.CurrBlock.HasFlow() {
+	c.PopLoop()
+	if c.CurrBlock != nil && !c.CurrBlock.HasFlow() {
 		c.CurrBlock.Jmp(loop_startID)
 	}
 
@@ -286,16 +391,84 @@ func genWhile(M *mod.Module, c *context, while *mod.Node) {
 
 func genDoWhile(M *mod.Module, c *context, while *mod.Node) {
 	loop_bodyID, loop_body := c.NewBlock()
-	loop_endID, loop_end := c.NewBlock()
 
 	c.CurrBlock.Jmp(loop_bodyID)
 	c.CurrBlock = loop_body
+	l := &loop{}
+	c.PushLoop(l)
 	genBlock(M, c, while.Leaves[0])
+	c.PopLoop()
+	if c.CurrBlock != nil && !c.CurrBlock.HasFlow() {
+		c.CurrBlock.Jmp(c.LoopCond(l))
+	}
 
-	op := genExpr(M, c, while.Leaves[1])
-	c.CurrBlock.Branch(op, loop_bodyID, loop_endID)
+	// the body may never reach the condition
+	if l.HasCond {
+		c.CurrBlock = c.PirProc.GetBlock(l.Cond)
+		genCond(M, c, while.Leaves[1], loop_bodyID, c.LoopEnd(l))
+	}
+	c.CurrBlock = nil
+	if l.HasEnd {
+		c.CurrBlock = c.PirProc.GetBlock(l.End)
+	}
+}
 
-	c.CurrBlock = loop_end
+// branches to trueblID or falseblID depending on the condition,
+// "and" and "or" only evaluate the right side if needed
+func genCond(M *mod.Module, c *context, exp *mod.Node, trueblID, falseblID pir.BlockID) {
+	switch exp.Lex {
+	case LK.AND:
+		midID, mid := c.NewBlock()
+		genCond(M, c, exp.Leaves[0], midID, falseblID)
+		c.CurrBlock = mid
+		genCond(M, c, exp.Leaves[1], trueblID, falseblID)
+	case LK.OR:
+		midID, mid := c.NewBlock()
+		genCond(M, c, exp.Leaves[0], trueblID, midID)
+		c.CurrBlock = mid
+		genCond(M, c, exp.Leaves[1], trueblID, falseblID)
+	case LK.NOT:
+		genCond(M, c, exp.Leaves[0], falseblID, trueblID)
+	default:
+		op := genExpr(M, c, exp)
+		c.CurrBlock.Branch(op, trueblID, falseblID)
+	}
+}
+
+func anySplits(exps []*mod.Node) bool {
+	for _, exp := range exps {
+		if splits(exp) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether evaluating the expression creates new basic blocks
+func splits(exp *mod.Node) bool {
+	if exp == nil {
+		return false
+	}
+	if exp.Lex == LK.AND || exp.Lex == LK.OR {
+		return true
+	}
+	for _, leaf := range exp.Leaves {
+		if splits(leaf) {
+			return true
+		}
+	}
+	return false
+}
+
+// if the rest of the expression splits the block,
+// temps computed until now must be kept in variables
+func persist(c *context, op pir.Operand) pir.Operand {
+	if op.Class != pirc.Temp {
+		return op
+	}
+	v := c.AllocHiddenVar(op.Type)
+	c.CurrBlock.AddInstr(RIU.Copy(op, v))
+	return v
 }
 
 func genReturn(M *mod.Module, c *context, return_ *mod.Node) {
@@ -303,8 +476,11 @@ func genReturn(M *mod.Module, c *context, return_ *mod.Node) {
 		return
 	}
 	operands := []pir.Operand{}
-	for _, ret := range return_.Leaves {
+	for i, ret := range return_.Leaves {
 		op := genExpr(M, c, ret)
+		if anySplits(return_.Leaves[i+1:]) {
+			op = persist(c, op)
+		}
 		operands = append(operands, op)
 	}
 	c.CurrBlock.Return(operands)
@@ -355,6 +531,11 @@ func genMultiProcAssign(M *mod.Module, c *context, assignees, call *mod.Node) {
 }
 
 func genLoadAssignRets(M *mod.Module, c *context, assignees *mod.Node, ops []pir.Operand) {
+	if anySplits(assignees.Leaves) {
+		for i := range ops {
+			ops[i] = persist(c, ops[i])
+		}
+	}
 	for i, ass := range assignees.Leaves {
 		op := ops[i]
 		dest, direct := genLValue(M, c, ass)
@@ -381,8 +562,11 @@ func genCallInstr(c *context, proc pir.Operand, args, rets []pir.Operand) {
 
 func genArgs(M *mod.Module, c *context, args *mod.Node) []pir.Operand {
 	output := []pir.Operand{}
-	for _, arg := range args.Leaves {
+	for i, arg := range args.Leaves {
 		res := genExpr(M, c, arg)
+		if anySplits(args.Leaves[i+1:]) {
+			res = persist(c, res)
+		}
 		output = append(output, res)
 	}
 	return output
@@ -416,6 +600,7 @@ func genIncDec(M *mod.Module, c *context, ass, op *mod.Node) {
 }
 
 var one = big.NewInt(1)
+var zero = big.NewInt(0)
 
 func incDecSize(ass *mod.Node) pir.Operand {
 	if T.IsStruct(ass.Type) {
@@ -438,6 +623,9 @@ func genSwap(M *mod.Module, c *context, assignees, expr *mod.Node) {
 	LHS := assignees.Leaves[0]
 	RHS := expr
 	lhs, lhsDirect := genLValue(M, c, LHS)
+	if splits(RHS) {
+		lhs = persist(c, lhs)
+	}
 	rhs, rhsDirect := genLValue(M, c, RHS)
 
 	if lhsDirect && rhsDirect {
@@ -504,6 +692,9 @@ func genLValue(M *mod.Module, c *context, left *mod.Node) (pir.Operand, bool) {
 
 func genNormalSingleAssign(M *mod.Module, c *context, assignee, expr *mod.Node, op LK.LexKind) {
 	RHS := genExpr(M, c, expr)
+	if splits(assignee) {
+		RHS = persist(c, RHS)
+	}
 	LHS, direct := genLValue(M, c, assignee)
 	if direct {
 		cp := RIU.Copy(RHS, LHS)
@@ -519,6 +710,9 @@ func genNormalSingleAssign(M *mod.Module, c *context, assignee, expr *mod.Node,
 // order of evaluation is RIGHT then LEFT
 func genOpSingleAssign(M *mod.Module, c *context, assignee, expr *mod.Node, op LK.LexKind) {
 	RHS := genExpr(M, c, expr)
+	if splits(assignee) {
+		RHS = persist(c, RHS)
+	}
 	instrT := mapOpToInstr(op)
 	LHS, direct := genLValue(M, c, assignee)
 	if direct {
@@ -621,6 +815,9 @@ func genCall(M *mod.Module, c *context, call *mod.Node) []pir.Operand {
 	args := call.Leaves[0]
 
 	procOp := genExpr(M, c, proc)
+	if splits(args) {
+		procOp = persist(c, procOp)
+	}
 
 	argOps := genArgs(M, c, args)
 	retOps := genRets(M, c, procOp)
@@ -800,6 +997,9 @@ func genBoolLit(M *mod.Module, c *context, lit *mod.Node) pir.Operand {
 func genArithOp(M *mod.Module, c *context, op *mod.Node) pir.Operand {
 	it := lexToBinaryOp(op.Lex)
 	a := genExpr(M, c, op.Leaves[0])
+	if splits(op.Leaves[1]) {
+		a = persist(c, a)
+	}
 	b := genExpr(M, c, op.Leaves[1])
 	dest := c.AllocTemp(op.Type)
 	instr := RIU.Bin(it, a, b, dest)
@@ -810,6 +1010,9 @@ func genArithOp(M *mod.Module, c *context, op *mod.Node) pir.Operand {
 func genCompOp(M *mod.Module, c *context, op *mod.Node) pir.Operand {
 	it := lexToBinaryOp(op.Lex)
 	a := genExpr(M, c, op.Leaves[0])
+	if splits(op.Leaves[1]) {
+		a = persist(c, a)
+	}
 	b := genExpr(M, c, op.Leaves[1])
 	dest := c.AllocTemp(op.Type)
 	instr := RIU.BinOut(it, a, b, dest)
@@ -817,13 +1020,21 @@ func genCompOp(M *mod.Module, c *context, op *mod.Node) pir.Operand {
 	return dest
 }
 
+// the result crosses blocks, so it lives in a hidden variable
 func genLogicalOp(M *mod.Module, c *context, op *mod.Node) pir.Operand {
-	it := lexToBinaryOp(op.Lex)
-	a := genExpr(M, c, op.Leaves[0])
-	b := genExpr(M, c, op.Leaves[1])
-	dest := c.AllocTemp(op.Type)
-	instr := RIU.Bin(it, a, b, dest)
-	c.CurrBlock.AddInstr(instr)
+	dest := c.AllocHiddenVar(op.Type)
+	trueblID, truebl := c.NewBlock()
+	falseblID, falsebl := c.NewBlock()
+	outblID, outbl := c.NewBlock()
+
+	genCond(M, c, op, trueblID, falseblID)
+
+	truebl.AddInstr(RIU.Copy(newNumLit(one, op.Type), dest))
+	truebl.Jmp(outblID)
+	falsebl.AddInstr(RIU.Copy(newNumLit(zero, op.Type), dest))
+	falsebl.Jmp(outblID)
+
+	c.CurrBlock = outbl
 	return dest
 }
 
@@ -832,6 +1043,9 @@ func genIndexing(M *mod.Module, c *context, op *mod.Node) pir.Operand {
 	callee := op.Leaves[1]
 	index := op.Leaves[0].Leaves[0] // should be ok
 	a := genExpr(M, c, callee)
+	if splits(index) {
+		a = persist(c, a)
+	}
 
 	iOp := genExpr(M, c, index)
 	if iOp.Type.Size() < T.T_I32.Size() {
@@ -946,10 +1160,6 @@ func lexToBinaryOp(op LK.LexKind) IK.InstrKind {
 		return IK.Less
 	case LK.LESSEQ:
 		return IK.LessEq
-	case LK.AND:
-		return IK.And
-	case LK.OR:
-		return IK.Or
 	case LK.SHIFTLEFT:
 		return IK.ShiftLeft
 	case LK.SHIFTRIGHT:
@@ -996,11 +1206,12 @@ func newPirProc(sy *mod.Global) *pir.Procedure {
 		vars[ps.Position] = ps.T
 	}
 	return &pir.Procedure{
-		Label: sy.Label(),
-		CC:    P.Type.Proc.CC,
-		Vars:  vars,
-		Rets:  P.Rets,
-		Args:  args,
+		Label:  sy.Label(),
+		CC:     P.Type.Proc.CC,
+		Vars:   vars,
+		Rets:   P.Rets,
+		Args:   args,
+		Extern: P.Extern,
 	}
 }
 
@@ -0,0 +1,280 @@
+package lsp
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	. "mpc/core"
+	mod "mpc/core/module"
+	gk "mpc/core/module/globalkind"
+	lk "mpc/core/module/lexkind"
+	lck "mpc/core/module/localkind"
+)
+
+func hoverAt(doc *document, pos Position) *hover {
+	if doc.M == nil {
+		return nil
+	}
+	path := nodesAt(doc.M.Root, pos)
+	if len(path) == 0 {
+		return nil
+	}
+	n := path[len(path)-1]
+	text := ""
+	if n.Lex == lk.IDENTIFIER {
+		text = describeID(doc.M, path)
+	}
+	if text == "" && n.Type != nil {
+		text = n.Type.String()
+	}
+	if text == "" {
+		return nil
+	}
+	r := toRange(*n.Range)
+	return &hover{
+		Contents: markupContent{Kind: "plaintext", Value: text},
+		Range:    &r,
+	}
+}
+
+func describeID(M *mod.Module, path []*mod.Node) string {
+	n := path[len(path)-1]
+	parent := parentOf(path)
+	if parent != nil {
+		switch parent.Lex {
+		case lk.DOUBLECOLON:
+			dep, ok := M.Dependencies[parent.Leaves[0].Text]
+			if !ok {
+				return ""
+			}
+			if n == parent.Leaves[0] {
+				return describeModule(dep.M)
+			}
+			sy, ok := dep.M.Exported[n.Text]
+			if !ok {
+				return ""
+			}
+			return describeGlobal(sy)
+		case lk.DOT, lk.ARROW:
+			if n == parent.Leaves[0] && parent.Type != nil {
+				return "field " + n.Text + ": " + parent.Type.String()
+			}
+		}
+	}
+	proc := enclosingProc(M, path)
+	if proc != nil {
+		l := proc.GetLocal(n.Text)
+		if l != nil {
+			return describeLocal(l)
+		}
+	}
+	// imported modules are globals too, but have no type
+	if dep, ok := M.Dependencies[n.Text]; ok {
+		return describeModule(dep.M)
+	}
+	if sy, ok := M.Globals[n.Text]; ok && sy.Kind != gk.Module {
+		return describeGlobal(M.GetSymbol(n.Text))
+	}
+	return ""
+}
+
+func describeLocal(l *mod.Local) string {
+	kind := "var"
+	if l.Kind == lck.Argument {
+		kind = "arg"
+	}
+	return kind + " " + l.Name + ": " + l.T.String()
+}
+
+func describeGlobal(sy *mod.Global) string {
+	out := sy.Kind.String() + " " + sy.ModuleName + "::" + sy.Name
+	if sy.Kind == gk.Struct || sy.Kind == gk.Module {
+		return out
+	}
+	out += ": " + sy.GetType().String()
+	if sy.Kind == gk.Const && sy.Const.Value != nil {
+		out += " = " + sy.Const.Value.String()
+	}
+	return out
+}
+
+func describeModule(M *mod.Module) string {
+	return "module " + M.Name + " (" + M.FullPath + ")"
+}
+
+func definitionAt(doc *document, pos Position) *location {
+	if doc.M == nil {
+		return nil
+	}
+	M := doc.M
+	path := nodesAt(M.Root, pos)
+	if len(path) == 0 {
+		return nil
+	}
+	n := path[len(path)-1]
+	if n.Lex != lk.IDENTIFIER {
+		return nil
+	}
+	parent := parentOf(path)
+	if parent != nil && parent.Lex == lk.DOUBLECOLON {
+		dep, ok := M.Dependencies[parent.Leaves[0].Text]
+		if !ok {
+			return nil
+		}
+		if n == parent.Leaves[0] {
+			return moduleLocation(dep.M)
+		}
+		sy, ok := dep.M.Exported[n.Text]
+		if !ok {
+			return nil
+		}
+		return globalLocation(M, sy)
+	}
+	proc := enclosingProc(M, path)
+	if proc != nil {
+		l := proc.GetLocal(n.Text)
+		if l != nil {
+			return &location{URI: pathToURI(M.FullPath), Range: toRange(*l.N.Range)}
+		}
+	}
+	if dep, ok := M.Dependencies[n.Text]; ok {
+		return moduleLocation(dep.M)
+	}
+	if sy, ok := M.Globals[n.Text]; ok && sy.Kind != gk.Module {
+		return globalLocation(M, M.GetSymbol(n.Text))
+	}
+	return nil
+}
+
+func moduleLocation(M *mod.Module) *location {
+	return &location{URI: pathToURI(M.FullPath)}
+}
+
+func globalLocation(root *mod.Module, sy *mod.Global) *location {
+	M := findModule(root, sy.ModuleName, map[*mod.Module]bool{})
+	if M == nil {
+		return nil
+	}
+	id := sy.N.Leaves[0]
+	return &location{URI: pathToURI(M.FullPath), Range: toRange(*id.Range)}
+}
+
+func findModule(M *mod.Module, name string, seen map[*mod.Module]bool) *mod.Module {
+	if M.Name == name {
+		return M
+	}
+	seen[M] = true
+	for _, dep := range M.Dependencies {
+		if seen[dep.M] {
+			continue
+		}
+		found := findModule(dep.M, name, seen)
+		if found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+var qualified = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)::[A-Za-z0-9_]*$`)
+
+// after "module::" we list everything the module exports,
+// otherwise we list the imported modules themselves
+func completionAt(doc *document, pos Position) []completionItem {
+	items := []completionItem{}
+	if doc.M == nil {
+		return items
+	}
+	lines := strings.Split(doc.Text, "\n")
+	if pos.Line >= len(lines) {
+		return items
+	}
+	line := []rune(lines[pos.Line])
+	if pos.Column < len(line) {
+		line = line[:pos.Column]
+	}
+	match := qualified.FindStringSubmatch(string(line))
+	if match != nil {
+		dep, ok := doc.M.Dependencies[match[1]]
+		if !ok {
+			return items
+		}
+		for _, sy := range dep.M.Exported {
+			items = append(items, completionItem{
+				Label:  sy.Name,
+				Kind:   completionKind(sy.Kind),
+				Detail: describeGlobal(sy),
+			})
+		}
+	} else {
+		for name, dep := range doc.M.Dependencies {
+			items = append(items, completionItem{
+				Label:  name,
+				Kind:   ciModule,
+				Detail: describeModule(dep.M),
+			})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Label < items[j].Label
+	})
+	return items
+}
+
+func completionKind(k gk.GlobalKind) int {
+	switch k {
+	case gk.Proc:
+		return ciFunction
+	case gk.Const:
+		return ciConstant
+	case gk.Struct:
+		return ciStruct
+	default:
+		return ciVariable
+	}
+}
+
+// returns the chain of nodes from the root
+// to the innermost node containing the position
+func nodesAt(root *mod.Node, pos Position) []*mod.Node {
+	path := []*mod.Node{}
+	curr := root
+	for curr != nil {
+		path = append(path, curr)
+		var next *mod.Node
+		for _, leaf := range curr.Leaves {
+			if leaf != nil && leaf.Range != nil && contains(*leaf.Range, pos) {
+				next = leaf
+				break
+			}
+		}
+		curr = next
+	}
+	return path[1:] // root always contains everything
+}
+
+// the end is inclusive, so that hovering
+// right after a name still finds it
+func contains(r Range, pos Position) bool {
+	return !pos.LessThan(r.Begin) && !pos.MoreThan(r.End)
+}
+
+func parentOf(path []*mod.Node) *mod.Node {
+	if len(path) < 2 {
+		return nil
+	}
+	return path[len(path)-2]
+}
+
+func enclosingProc(M *mod.Module, path []*mod.Node) *mod.Proc {
+	for _, n := range path {
+		if n.Lex == lk.PROC {
+			sy, ok := M.Globals[n.Leaves[0].Text]
+			if ok && sy.Kind == gk.Proc {
+				return sy.Proc
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+/*
+A small language server, speaking JSON-RPC over stdio.
+
+Each open document is analysed as if it were the root module
+of a program, so diagnostics from its dependencies are published
+too. Hover, definition and completion use the last version
+of the document that passed the typechecker, this way they still
+work (mostly) while the user is typing something broken.
+*/
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	. "mpc/core"
+	et "mpc/core/errorkind"
+	mod "mpc/core/module"
+	sv "mpc/core/severity"
+	"mpc/pipelines"
+)
+
+type document struct {
+	Path string
+	Text string
+	M    *mod.Module // last module that typechecked
+
+	Published map[string]bool // uris with diagnostics from this document
+}
+
+type server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	docs     map[string]*document
+	shutdown bool
+}
+
+var errExit = errors.New("exit")
+
+// blocks until the client sends the exit notification
+// or closes the input
+func Serve(in io.Reader, out io.Writer) error {
+	s := &server{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: map[string]*document{},
+	}
+	for {
+		msg, err := s.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = s.safeHandle(msg)
+		if err == errExit {
+			if !s.shutdown {
+				return errors.New("exit without shutdown")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) read() (*message, error) {
+	length := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(name, "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if length < 0 {
+		return nil, errors.New("missing Content-Length header")
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(s.in, body)
+	if err != nil {
+		return nil, err
+	}
+	msg := &message{}
+	err = json.Unmarshal(body, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *server) write(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (s *server) reply(msg *message, result interface{}) error {
+	return s.write(response{JsonRPC: "2.0", ID: msg.ID, Result: result})
+}
+
+func (s *server) replyError(msg *message, code int, text string) error {
+	return s.write(response{
+		JsonRPC: "2.0",
+		ID:      msg.ID,
+		Error:   &responseError{Code: code, Message: text},
+	})
+}
+
+func (s *server) notify(method string, params interface{}) error {
+	return s.write(notification{JsonRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *server) handle(msg *message) error {
+	switch msg.Method {
+	case "initialize":
+		return s.reply(msg, initializeResult{
+			Capabilities: serverCapabilities{
+				TextDocumentSync:   syncFull,
+				HoverProvider:      true,
+				DefinitionProvider: true,
+				CompletionProvider: &completionOptions{
+					TriggerCharacters: []string{":"},
+				},
+			},
+			ServerInfo: serverInfo{Name: "mpc"},
+		})
+	case "initialized":
+		return nil
+	case "shutdown":
+		s.shutdown = true
+		return s.reply(msg, nil)
+	case "exit":
+		return errExit
+	case "textDocument/didOpen":
+		var p didOpenParams
+		if json.Unmarshal(msg.Params, &p) != nil {
+			return nil
+		}
+		path := uriToPath(p.TextDocument.URI)
+		doc := &document{Path: path, Text: p.TextDocument.Text, Published: map[string]bool{}}
+		s.docs[path] = doc
+		return s.analyse(doc)
+	case "textDocument/didChange":
+		var p didChangeParams
+		if json.Unmarshal(msg.Params, &p) != nil {
+			return nil
+		}
+		doc, ok := s.docs[uriToPath(p.TextDocument.URI)]
+		if !ok || len(p.ContentChanges) == 0 {
+			return nil
+		}
+		// we only advertise full sync, so the last change is the whole text
+		doc.Text = p.ContentChanges[len(p.ContentChanges)-1].Text
+		return s.analyse(doc)
+	case "textDocument/didSave":
+		var p didCloseParams
+		if json.Unmarshal(msg.Params, &p) != nil {
+			return nil
+		}
+		doc, ok := s.docs[uriToPath(p.TextDocument.URI)]
+		if !ok {
+			return nil
+		}
+		return s.analyse(doc)
+	case "textDocument/didClose":
+		var p didCloseParams
+		if json.Unmarshal(msg.Params, &p) != nil {
+			return nil
+		}
+		path := uriToPath(p.TextDocument.URI)
+		doc, ok := s.docs[path]
+		if !ok {
+			return nil
+		}
+		delete(s.docs, path)
+		return s.publish(doc, nil)
+	case "textDocument/hover":
+		doc, pos, ok := s.positionParams(msg)
+		if !ok {
+			return s.replyError(msg, invalidParams, "unknown document")
+		}
+		return s.reply(msg, hoverAt(doc, pos))
+	case "textDocument/definition":
+		doc, pos, ok := s.positionParams(msg)
+		if !ok {
+			return s.replyError(msg, invalidParams, "unknown document")
+		}
+		return s.reply(msg, definitionAt(doc, pos))
+	case "textDocument/completion":
+		doc, pos, ok := s.positionParams(msg)
+		if !ok {
+			return s.replyError(msg, invalidParams, "unknown document")
+		}
+		return s.reply(msg, completionAt(doc, pos))
+	}
+	if msg.ID != nil {
+		return s.replyError(msg, methodNotFound, "method not found: "+msg.Method)
+	}
+	return nil // unknown notifications are ignored
+}
+
+// a panic fails only the request that caused it,
+// the session goes on with the documents it has
+func (s *server) safeHandle(msg *message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = nil
+			if msg.ID != nil {
+				err = s.replyError(msg, internalError, fmt.Sprintf("internal error: %v", r))
+			}
+		}
+	}()
+	return s.handle(msg)
+}
+
+func (s *server) positionParams(msg *message) (*document, Position, bool) {
+	var p positionParams
+	if json.Unmarshal(msg.Params, &p) != nil {
+		return nil, Position{}, false
+	}
+	doc, ok := s.docs[uriToPath(p.TextDocument.URI)]
+	pos := Position{Line: p.Position.Line, Column: p.Position.Character}
+	return doc, pos, ok
+}
+
+func (s *server) analyse(doc *document) error {
+	sources := map[string]string{}
+	for path, d := range s.docs {
+		sources[path] = d.Text
+	}
+	m, errs := modSources(doc.Path, sources)
+	if m != nil {
+		doc.M = m
+	}
+	return s.publish(doc, errs)
+}
+
+// the compiler still panics in a few places,
+// that should not bring the server down
+func modSources(path string, sources map[string]string) (m *mod.Module, errs []*Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m = nil
+			errs = []*Error{{
+				Code:     et.InternalCompilerError,
+				Severity: sv.InternalError,
+				Message:  fmt.Sprintf("internal compiler error: %v", r),
+			}}
+		}
+	}()
+	return pipelines.ModSources(path, sources)
+}
+
+func (s *server) publish(doc *document, errs []*Error) error {
+	byURI := map[string][]diagnostic{}
+	for _, e := range errs {
+		uri := pathToURI(doc.Path)
+		if e.Location != nil && e.Location.File != "" {
+			uri = pathToURI(e.Location.File)
+		}
+		byURI[uri] = append(byURI[uri], toDiagnostic(e))
+	}
+	// clears files that no longer have errors
+	doc.Published[pathToURI(doc.Path)] = true
+	for uri := range doc.Published {
+		if _, ok := byURI[uri]; !ok {
+			byURI[uri] = []diagnostic{}
+		}
+	}
+	uris := make([]string, 0, len(byURI))
+	for uri := range byURI {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	doc.Published = map[string]bool{}
+	for _, uri := range uris {
+		diags := byURI[uri]
+		if len(diags) > 0 {
+			doc.Published[uri] = true
+		}
+		err := s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+			URI:         uri,
+			Diagnostics: diags,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toDiagnostic(e *Error) diagnostic {
+	d := diagnostic{
+		Severity: toSeverity(e.Severity),
+		Source:   "mpc",
+		Message:  e.Message,
+	}
+	if e.Code != et.InvalidErrType {
+		d.Code = e.ErrCode()
+	}
+	if e.Location != nil && e.Location.Range != nil {
+		d.Range = toRange(*e.Location.Range)
+	}
+	return d
+}
+
+func toSeverity(s sv.Severity) int {
+	switch s {
+	case sv.Warning:
+		return 2
+	case sv.Information:
+		return 3
+	case sv.Hint:
+		return 4
+	default:
+		return 1
+	}
+}
+
+func toRange(r Range) lspRange {
+	return lspRange{
+		Start: position{Line: r.Begin.Line, Character: r.Begin.Column},
+		End:   position{Line: r.End.Line, Character: r.End.Column},
+	}
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.Clean(u.Path)
+}
+
+func pathToURI(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	u := url.URL{Scheme: "file", Path: abs}
+	return u.String()
+}
@@ -3,11 +3,18 @@ package main
 import (
 	"flag"
 	"fmt"
+	"mpc/cache"
 	. "mpc/core"
+	"mpc/deadcode"
 	"mpc/format"
+	"mpc/lsp"
+	"mpc/parallel"
 	"mpc/pipelines"
+	"mpc/resolution"
+	"mpc/stats"
 	"mpc/testing"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -21,15 +28,50 @@ var mod = flag.Bool("mod", false, "runs the full frontend, prints typed AST")
 var pir = flag.Bool("pir", false, "runs the full frontend, prints pir")
 var mir = flag.Bool("mir", false, "runs the full compiler, prints mir")
 var asm = flag.Bool("asm", false, "runs the full compiler, prints asm")
+var pirdot = flag.Bool("pirdot", false, "runs the full frontend, prints the control flow graph of pir in DOT")
+var mirdot = flag.Bool("mirdot", false, "runs the full compiler, prints the control flow graph of mir in DOT")
 var _format = flag.Bool("fmt", false, "formats code and prints it to stdout")
+var write = flag.Bool("w", false, "with -fmt, rewrites files in place, works on folders")
+var check = flag.Bool("check", false, "with -fmt, lists unformatted files with a diff and fails, works on folders")
 
 var test = flag.Bool("test", false, "runs tests for all files in a folder")
 var testTimeout = flag.Duration("testtimeout", 5*time.Second, "sets timeout limit for a test")
 
 var verbose = flag.Bool("v", false, "verbose tests")
 var outname = flag.String("o", "", "output name of file")
+var object = flag.Bool("c", false, "compiles to a relocatable object instead of an executable, main is optional")
+var nocache = flag.Bool("nocache", false, "compiles every module from source, without the build cache")
 
 var profile = flag.Bool("prof", false, "start profiler")
+var showStats = flag.Bool("stats", false, "prints the time taken by each phase of the compiler, and a few counts")
+var jobs = flag.Int("j", parallel.Workers, "maximum number of modules parsed, or procedures compiled, at the same time")
+
+var lspMode = flag.Bool("lsp", false, "starts a language server over stdio")
+
+var depsMode = flag.Bool("deps", false, "resolves all modules, prints the module and symbol dependency graphs")
+var depsfmt = flag.String("depsfmt", "dot", "format of the dependency graphs: dot or json")
+
+var asmfmt = flag.String("asmfmt", "native", "how binaries are assembled: native, fasm or gas")
+
+var diagfmt = flag.String("diagfmt", "text", "format of diagnostics: text or json")
+var color = flag.String("color", "auto", "colors in diagnostics: auto, always or never")
+
+var includes stringList
+
+func init() {
+	flag.Var(&includes, "I", "adds a folder to search for modules, can be repeated")
+}
+
+type stringList []string
+
+func (this *stringList) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *stringList) Set(s string) error {
+	*this = append(*this, s)
+	return nil
+}
 
 func main() {
 	flag.Parse()
@@ -43,28 +85,109 @@ func main() {
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
-	args := flag.Args()
-	if len(args) != 1 {
+	if *jobs < 1 {
+		Fatal("-j must be at least 1\n")
+	}
+	parallel.Workers = *jobs
+	Color = useColor()
+	// -I folders come before the ones in MPPATH
+	resolution.SearchPaths = append(includes, filepath.SplitList(os.Getenv("MPPATH"))...)
+	if !*nocache {
+		cache.Dir = cache.DefaultDir()
+	}
+	if *lspMode {
+		err := lsp.Serve(os.Stdin, os.Stdout)
+		if err != nil {
+			Fatal(err.Error() + "\n")
+		}
+		return
+	}
+	if args := flag.Args(); len(args) > 0 && args[0] == "run" {
+		runMode(args[1:])
+		return
+	}
+	file, objects := splitArgs(flag.Args())
+	eval(file, objects)
+}
+
+// a single source file, the rest are object files
+// to link the program with
+func splitArgs(args []string) (string, []string) {
+	source := []string{}
+	objects := []string{}
+	for _, arg := range args {
+		if strings.HasSuffix(arg, ".o") || strings.HasSuffix(arg, ".a") {
+			objects = append(objects, arg)
+		} else {
+			source = append(source, arg)
+		}
+	}
+	if len(source) != 1 {
 		Fatal("invalid number of arguments\n")
 	}
-	eval(args[0])
+	return source[0], objects
 }
 
-func eval(filename string) {
-	checkValid()
+// mpc run [objects] file.mp [args]: everything after
+// the source file belongs to the program
+func runMode(args []string) {
+	objects := []string{}
+	for len(args) > 0 && (strings.HasSuffix(args[0], ".o") || strings.HasSuffix(args[0], ".a")) {
+		objects = append(objects, args[0])
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		Fatal("run needs a source file\n")
+	}
+	checkValid(objects)
+	if *lexemes || *ast || *mod || *pir || *mir || *pirdot || *mirdot || *asm || *_format || *object || *depsMode || *test {
+		Fatal("run may not be used with other modes\n")
+	}
+	filename := args[0]
 	if !strings.Contains(filename, "/") {
 		filename = "./" + filename
 	}
+	code, err := pipelines.Run(filename, asmFormat(), objects, args[1:])
+	printStats()
+	if len(err) > 0 {
+		// the program never ran, zero would look like success
+		os.Stderr.Write([]byte(diagnostics(err)))
+		os.Exit(1)
+	}
+	os.Exit(code)
+}
+
+func eval(filename string, objects []string) {
+	checkValid(objects)
+	if !strings.Contains(filename, "/") {
+		filename = "./" + filename
+	}
+	if *write || *check {
+		formatFiles(filename)
+		return
+	}
 	if *test {
 		var res []*testing.TestResult
 		res = Test(filename, getStage(), *testTimeout)
 		printResults(res)
+		if *verbose {
+			Stdout(cache.Report())
+		}
+		printStats()
 		return
 	}
-	normalMode(filename)
+	normalMode(filename, objects)
+	printStats()
 }
 
-func normalMode(filename string) {
+// on stderr, so that it doesn't mix with the output of the mode
+func printStats() {
+	if *showStats {
+		os.Stderr.Write([]byte(stats.Report()))
+	}
+}
+
+func normalMode(filename string, objects []string) {
 	switch true {
 	case *lexemes:
 		lexemes, err := pipelines.Lexemes(filename)
@@ -90,22 +213,51 @@ func normalMode(filename string) {
 		mirP, err := pipelines.Mir(filename)
 		OkOrBurst(err)
 		fmt.Println(mirP)
+	case *pirdot:
+		pirP, err := pipelines.Pir(filename)
+		OkOrBurst(err)
+		fmt.Print(pirP.Dot())
+	case *mirdot:
+		mirP, err := pipelines.Mir(filename)
+		OkOrBurst(err)
+		fmt.Print(mirP.Dot())
 	case *asm:
-		s, err := pipelines.Fasm(filename)
+		var s string
+		var err []*Error
+		if asmFormat() == pipelines.FmtGas {
+			s, err = pipelines.Gas(filename)
+		} else {
+			s, err = pipelines.Fasm(filename)
+		}
 		OkOrBurst(err)
 		fmt.Println(s)
 	case *_format:
-		n, err := pipelines.Ast(filename)
+		_, formatted, err := pipelines.Fmt(filename)
+		OkOrBurst(err)
+		fmt.Print(formatted)
+	case *object:
+		_, err := pipelines.CompileObject(filename, *outname)
+		OkOrBurst(err)
+	case *depsMode:
+		g, err := pipelines.Deps(filename)
 		OkOrBurst(err)
-		fmt.Println(format.Format(n))
+		if *depsfmt == "json" {
+			fmt.Print(g.JSON())
+		} else {
+			fmt.Print(g.Dot())
+		}
 	default:
-		_, err := pipelines.Compile(filename, *outname)
+		_, err := pipelines.Link(filename, *outname, asmFormat(), objects)
 		OkOrBurst(err)
+		if *verbose {
+			Stdout(cache.Report())
+			Stdout(deadcode.Report())
+		}
 	}
 }
 
-func checkValid() {
-	var selected = []bool{*lexemes, *ast, *mod, *pir, *mir, *asm, *_format}
+func checkValid(objects []string) {
+	var selected = []bool{*lexemes, *ast, *mod, *pir, *mir, *pirdot, *mirdot, *asm, *_format, *object, *depsMode}
 	var count = 0
 	for _, b := range selected {
 		if b {
@@ -113,7 +265,22 @@ func checkValid() {
 		}
 	}
 	if count > 1 {
-		Fatal("only one of lex, parse, mod, pir, mir, asm or fmt flags may be used at a time")
+		Fatal("only one of lex, parse, mod, pir, mir, pirdot, mirdot, asm, fmt, c or deps flags may be used at a time")
+	}
+	if len(objects) > 0 && (count > 0 || *test) {
+		Fatal("object files may only be given when compiling an executable\n")
+	}
+	if (*write || *check) && !*_format {
+		Fatal("w and check flags may only be used with fmt\n")
+	}
+	if *write && *check {
+		Fatal("only one of w or check flags may be used at a time\n")
+	}
+	if *diagfmt != "text" && *diagfmt != "json" {
+		Fatal("invalid diagnostic format: " + *diagfmt + "\n")
+	}
+	if *depsfmt != "dot" && *depsfmt != "json" {
+		Fatal("invalid dependency graph format: " + *depsfmt + "\n")
 	}
 }
 
@@ -143,12 +310,19 @@ func Test(folder string, st testing.Stage, t time.Duration) []*testing.TestResul
 		fullpath := folder + "/" + v.Name()
 		if v.IsDir() {
 			if *verbose {
-				Stdout("\u001b[35m entering: " + fullpath + "\u001b[0m\n")
+				Stdout(Paint(Magenta, " entering: "+fullpath) + "\n")
 			}
 			res := Test(fullpath, st, t)
 			results = append(results, res...)
 			if *verbose {
-				Stdout("\u001b[35m leaving: " + fullpath + "\u001b[0m\n")
+				Stdout(Paint(Magenta, " leaving: "+fullpath) + "\n")
+			}
+		} else if strings.HasSuffix(v.Name(), ".sh") && compiling() {
+			res := testing.Script(fullpath, compileFlags(), t)
+			results = append(results, &res)
+			if *verbose {
+				Stdout("testing: " + fullpath + "\t")
+				Stdout(res.String() + "\n")
 			}
 		} else if strings.HasSuffix(v.Name(), ".mp") {
 			res := testing.Test(fullpath, st, t)
@@ -162,6 +336,95 @@ func Test(folder string, st testing.Stage, t time.Duration) []*testing.TestResul
 	return results
 }
 
+func formatFiles(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		Fatal(err.Error() + "\n")
+	}
+	var failed []string
+	if info.IsDir() {
+		failed = Format(path)
+	} else if !formatFile(path) {
+		failed = []string{path}
+	}
+	// with -w only files that don't parse are left here
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+// walks folders just like Test, returns the files that
+// are not formatted, or that could not be formatted
+func Format(folder string) []string {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		Fatal(err.Error() + "\n")
+	}
+	failed := []string{}
+	for _, v := range entries {
+		fullpath := folder + "/" + v.Name()
+		if v.IsDir() {
+			res := Format(fullpath)
+			failed = append(failed, res...)
+		} else if strings.HasSuffix(v.Name(), ".mp") {
+			if !formatFile(fullpath) {
+				failed = append(failed, fullpath)
+			}
+		}
+	}
+	return failed
+}
+
+// with -w the file is rewritten, with -check the diff
+// is printed and false is returned, files with errors
+// are reported and are never formatted
+func formatFile(file string) bool {
+	original, formatted, errs := pipelines.Fmt(file)
+	if len(errs) > 0 {
+		os.Stderr.Write([]byte(diagnostics(errs)))
+		return false
+	}
+	if original == formatted {
+		return true
+	}
+	if *write {
+		info, err := os.Stat(file)
+		if err != nil {
+			Fatal(err.Error() + "\n")
+		}
+		err = os.WriteFile(file, []byte(formatted), info.Mode().Perm())
+		if err != nil {
+			Fatal(err.Error() + "\n")
+		}
+		if *verbose {
+			Stdout("formatted: " + file + "\n")
+		}
+		return true
+	}
+	Stdout(format.Diff(file, original, formatted))
+	return false
+}
+
+// scripts link objects, fasm can't do that
+func compiling() bool {
+	stages := []bool{*lexemes, *ast, *mod, *pir, *pirdot, *mir, *mirdot, *asm, *_format}
+	for _, b := range stages {
+		if b {
+			return false
+		}
+	}
+	return asmFormat() != pipelines.FmtFasm
+}
+
+// what scripts pass on to the compiler
+func compileFlags() []string {
+	flags := []string{"-asmfmt=" + *asmfmt}
+	if *nocache {
+		flags = append(flags, "-nocache")
+	}
+	return flags
+}
+
 func getStage() testing.Stage {
 	switch {
 	case *lexemes:
@@ -170,23 +433,73 @@ func getStage() testing.Stage {
 		return testing.S_Parser
 	case *mod:
 		return testing.S_Typechecker
-	case *pir:
+	case *pir, *pirdot:
 		return testing.S_PirGeneration
-	case *mir:
+	case *mir, *mirdot:
 		return testing.S_MirGeneration
 	case *asm:
 		return testing.S_FasmGeneration
 	case *_format:
 		return testing.S_Format
 	default:
-		return testing.S_Compile
+		return testing.S_Compile(asmFormat())
 	}
 }
 
-func OkOrBurst(e *Error) {
-	if e != nil {
-		Fatal(e.String() + "\n")
+func asmFormat() pipelines.AsmFormat {
+	switch *asmfmt {
+	case "native":
+		return pipelines.FmtNative
+	case "fasm":
+		return pipelines.FmtFasm
+	case "gas":
+		return pipelines.FmtGas
 	}
+	Fatal("invalid assembler format: " + *asmfmt + "\n")
+	return pipelines.FmtNative
+}
+
+func OkOrBurst(errs []*Error) {
+	if len(errs) == 0 {
+		return
+	}
+	Fatal(diagnostics(errs))
+}
+
+func diagnostics(errs []*Error) string {
+	output := make([]string, len(errs))
+	for i, e := range errs {
+		if *diagfmt == "json" {
+			output[i] = e.JSON()
+		} else {
+			output[i] = e.String()
+		}
+	}
+	return strings.Join(output, "\n") + "\n"
+}
+
+// auto: only if NO_COLOR is not set and the colored output goes to
+// a terminal, that's stdout for test results, stderr for diagnostics
+func useColor() bool {
+	switch *color {
+	case "always":
+		return true
+	case "never":
+		return false
+	case "auto":
+		out := os.Stderr
+		if *test {
+			out = os.Stdout
+		}
+		return os.Getenv("NO_COLOR") == "" && isTerminal(out)
+	}
+	Fatal("invalid color mode: " + *color + "\n")
+	return false
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
 func Stdout(s string) {
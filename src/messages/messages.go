@@ -145,16 +145,17 @@ func NotAllCodePathsReturnAValue(M *ir.Module, p *ir.Proc) *Error {
 }
 
 func InvalidMain(M *ir.Module, sy *ir.Global) *Error {
-	return NewSemanticError(M, et.InvalidMain, sy.N, "invalid type for main function: must be proc[][]")
+	return NewSemanticError(M, et.InvalidMain, sy.N, "invalid type for main function: must be proc[][] or proc[argc:i64, argv:ptr, envp:ptr][], returning nothing, i8 or i32")
 }
 
 func ProgramWithoutEntry(M *ir.Module) *Error {
 	return NewSemanticError(M, et.NoEntryPoint, M.Root, "program has no entry point")
 }
 
-func AmbiguousFilesInFolder(M *ir.Module, n *ir.Node, found []string, modID string) *Error {
+func AmbiguousFilesInFolder(M *ir.Module, n *ir.Node, found []string, searched []string, modID string) *Error {
 	msg := "Multiple modules possible for " + modID +
-		": " + strings.Join(found, ", ")
+		": " + strings.Join(found, ", ") +
+		" (searched: " + strings.Join(searched, ", ") + ")"
 	if M != nil && n != nil {
 		return NewSemanticError(M, et.AmbiguousModuleName, n, msg)
 	}
@@ -165,14 +166,15 @@ func AmbiguousFilesInFolder(M *ir.Module, n *ir.Node, found []string, modID stri
 	}
 }
 
-func ModuleNotFound(M *ir.Module, n *ir.Node, baseFolder string, modID string) *Error {
-	msg := "module " + modID + " not found in folder " + baseFolder
+func ModuleNotFound(M *ir.Module, n *ir.Node, searched []string, modID string) *Error {
+	msg := "module " + modID + " not found, searched: " + strings.Join(searched, ", ")
 	if M != nil && n != nil {
 		return NewSemanticError(M, et.ModuleNotFound, n, msg)
 	}
 	return &Error{
-		Code:    et.ModuleNotFound,
-		Message: msg,
+		Code:     et.ModuleNotFound,
+		Severity: sv.Error,
+		Message:  msg,
 	}
 }
 
@@ -295,3 +297,11 @@ func ErrorExpectedProc(M *ir.Module, op *ir.Node) *Error {
 func ErrorExportingExternalName(M *ir.Module, op *ir.Node) *Error {
 	return NewSemanticError(M, et.ExportExternal, op, "exported external symbol")
 }
+
+func OutsideLoop(M *ir.Module, n *ir.Node) *Error {
+	return NewSemanticError(M, et.OutsideLoop, n, n.Text+" outside of loop")
+}
+
+func TooManyReturns(M *ir.Module, n *ir.Node, cc T.CCKind, max int) *Error {
+	return NewSemanticError(M, et.TooManyReturns, n, cc.String()+" procedures return at most "+strconv.Itoa(max)+" values")
+}
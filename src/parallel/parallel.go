@@ -0,0 +1,61 @@
+/*
+Bounded parallelism for the passes of the compiler. Work is split
+in items that don't depend on each other, and results are kept by
+index, so that the output never depends on scheduling.
+*/
+package parallel
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// maximum number of goroutines working at the same time,
+// 1 makes everything sequential
+var Workers = runtime.GOMAXPROCS(0)
+
+// calls f for each i in [0, n) and waits for all of them
+func Each(n int, f func(i int)) {
+	if Workers <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	var next atomic.Int64
+	for w := 0; w < min(Workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// for work that is found as it goes, like modules being imported
+type Pool struct {
+	slots chan struct{}
+}
+
+func NewPool() *Pool {
+	return &Pool{slots: make(chan struct{}, max(Workers, 1))}
+}
+
+// runs f in the background, as soon as a worker is free,
+// with a single worker it just runs f
+func (this *Pool) Go(f func()) {
+	if Workers <= 1 {
+		f()
+		return
+	}
+	go func() {
+		this.slots <- struct{}{}
+		defer func() { <-this.slots }()
+		f()
+	}()
+}
@@ -21,6 +21,7 @@ func Parse(filename string, s string) (*mod.Node, *Error) {
 		return nil, err
 	}
 	computeRanges(n)
+	attachTrivia(n, st)
 	return n, nil
 }
 
@@ -71,13 +72,17 @@ func _import(s *Lexer) (*mod.Node, *Error) {
 	return kw, nil
 }
 
-// FromImport := 'from' id 'import' Items.
+// FromImport := 'from' ModPath 'import' Items.
 func _fromImport(s *Lexer) (*mod.Node, *Error) {
 	kw, err := expect(s, lk.FROM)
 	if err != nil {
 		return nil, err
 	}
-	id, err := expect(s, lk.IDENTIFIER)
+	err = check(s, lk.IDENTIFIER)
+	if err != nil {
+		return nil, err
+	}
+	id, err := modPath(s)
 	if err != nil {
 		return nil, err
 	}
@@ -125,9 +130,10 @@ func items(s *Lexer) (*mod.Node, *Error) {
 }
 
 // AliasList := Alias {',' Alias} [','].
+// Alias := ModPath ['as' id].
 func alias(s *Lexer) (*mod.Node, *Error) {
 	if s.Word.Lex == lk.IDENTIFIER {
-		id, err := consume(s)
+		id, err := modPath(s)
 		if err != nil {
 			return nil, err
 		}
@@ -148,6 +154,34 @@ func alias(s *Lexer) (*mod.Node, *Error) {
 	return nil, nil
 }
 
+// ModPath := id {'/' id}.
+// the path is kept as a single identifier, "std/io"
+func modPath(s *Lexer) (*mod.Node, *Error) {
+	id, err := expect(s, lk.IDENTIFIER)
+	if err != nil {
+		return nil, err
+	}
+	for s.Word.Lex == lk.DIVISION {
+		_, err := consume(s)
+		if err != nil {
+			return nil, err
+		}
+		next, err := expect(s, lk.IDENTIFIER)
+		if err != nil {
+			return nil, err
+		}
+		id = &mod.Node{
+			Lex:  lk.IDENTIFIER,
+			Text: id.Text + "/" + next.Text,
+			Range: &Range{
+				Begin: id.Range.Begin,
+				End:   next.Range.End,
+			},
+		}
+	}
+	return id, nil
+}
+
 // IdList = id {',' id} [','].
 func idList(s *Lexer) (*mod.Node, *Error) {
 	list, err := repeatCommaList(s, ident)
@@ -202,12 +236,14 @@ func attrSymbol(s *Lexer) (*mod.Node, *Error) {
 	return sy, nil
 }
 
-// Symbol = Procedure | Data | Const | Struct.
+// Symbol = Procedure | Extern | Data | Const | Struct.
 func symbol(s *Lexer) (*mod.Node, *Error) {
 	Track(s, "symbol")
 	switch s.Word.Lex {
 	case lk.PROC:
 		return procDef(s)
+	case lk.EXTERN:
+		return externDef(s)
 	case lk.DATA:
 		return dataDef(s)
 	case lk.CONST:
@@ -288,10 +324,11 @@ func multipleConst(s *Lexer) (*mod.Node, *Error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = expect(s, lk.END)
+	end, err := expect(s, lk.END)
 	if err != nil {
 		return nil, err
 	}
+	kw.Range.End = end.Range.End
 	kw.SetLeaves(leafs)
 	return kw, nil
 }
@@ -346,10 +383,11 @@ func multipleData(s *Lexer) (*mod.Node, *Error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = expect(s, lk.END)
+	end, err := expect(s, lk.END)
 	if err != nil {
 		return nil, err
 	}
+	kw.Range.End = end.Range.End
 	kw.SetLeaves(leafs)
 	return kw, nil
 }
@@ -508,6 +546,43 @@ func procDef(s *Lexer) (*mod.Node, *Error) {
 	return kw, nil
 }
 
+// Extern = 'extern' 'proc' id [CC] [Signature].
+// the body of the procedure is the 'extern' keyword itself
+func externDef(s *Lexer) (*mod.Node, *Error) {
+	Track(s, "Extern")
+	ext, err := expect(s, lk.EXTERN)
+	if err != nil {
+		return nil, err
+	}
+	kw, err := expect(s, lk.PROC)
+	if err != nil {
+		return nil, err
+	}
+	var id, CC, args, rets *mod.Node
+	id, err = expect(s, lk.IDENTIFIER)
+	if err != nil {
+		return nil, err
+	}
+	if s.Word.Lex == lk.LESS {
+		CC, err = cc(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.Word.Lex == lk.LEFTBRACKET {
+		args, err = procArgs(s)
+		if err != nil {
+			return nil, err
+		}
+		rets, err = typeList(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	kw.SetLeaves([]*mod.Node{id, args, rets, nil, ext, CC})
+	return kw, nil
+}
+
 // Args := '[' [DeclList] ']'.
 func procArgs(s *Lexer) (*mod.Node, *Error) {
 	Track(s, "Args")
@@ -664,7 +739,7 @@ func structDef(s *Lexer) (*mod.Node, *Error) {
 			return nil, err
 		}
 	}
-	_, err = expect(s, lk.BEGIN)
+	begin, err := expect(s, lk.BEGIN)
 	if err != nil {
 		return nil, err
 	}
@@ -672,13 +747,17 @@ func structDef(s *Lexer) (*mod.Node, *Error) {
 	if err != nil {
 		return nil, err
 	}
+	end, err := expect(s, lk.END)
+	if err != nil {
+		return nil, err
+	}
 	fieldList := &mod.Node{
 		Lex:    lk.FIELDLIST,
 		Leaves: fields,
-	}
-	_, err = expect(s, lk.END)
-	if err != nil {
-		return nil, err
+		Range: &Range{
+			Begin: begin.Range.Begin,
+			End:   end.Range.End,
+		},
 	}
 	kw.SetLeaves([]*mod.Node{id, _size, fieldList})
 	return kw, nil
@@ -818,6 +897,8 @@ Statement = If [';']
       | Return ';'
       | Set ';'
       | Exit ';'
+      | 'break' ';'
+      | 'continue' ';'
       | Expr ';'.
 */
 func statement(s *Lexer) (*mod.Node, *Error) {
@@ -842,6 +923,8 @@ func statement(s *Lexer) (*mod.Node, *Error) {
 		n, err = _set(s)
 	case lk.EXIT:
 		n, err = _exit(s)
+	case lk.BREAK, lk.CONTINUE:
+		n, err = consume(s)
 	default:
 		n, err = expr(s)
 		if n == nil && err == nil {
@@ -1240,7 +1323,7 @@ func _asm(s *Lexer) (*mod.Node, *Error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = expect(s, lk.BEGIN)
+	begin, err := expect(s, lk.BEGIN)
 	if err != nil {
 		return nil, err
 	}
@@ -1248,13 +1331,17 @@ func _asm(s *Lexer) (*mod.Node, *Error) {
 	if err != nil {
 		return nil, err
 	}
+	end, err := expect(s, lk.END)
+	if err != nil {
+		return nil, err
+	}
 	asmlines := &mod.Node{
 		Lex:    lk.ASMLINES,
 		Leaves: lines,
-	}
-	_, err = expect(s, lk.END)
-	if err != nil {
-		return nil, err
+		Range: &Range{
+			Begin: begin.Range.Begin,
+			End:   end.Range.End,
+		},
 	}
 	kw.SetLeaves([]*mod.Node{asmlines})
 	return kw, nil
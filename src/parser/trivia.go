@@ -0,0 +1,196 @@
+package parser
+
+import (
+	mod "mpc/core/module"
+	lk "mpc/core/module/lexkind"
+	. "mpc/lexer"
+)
+
+/*
+The lexer collects comments and empty lines on the side,
+here we hand them to the nodes they belong to, so that the
+formatter can put them back in place.
+
+Nodes that hold sequences (blocks, field lists, argument lists...)
+are containers. Each item gets the lines that precede it as Leading
+and the comment at the end of its last line as Trailing, whatever is
+left before the 'end' of the container goes to the container itself
+as Closing.
+
+Since a comment always runs until the end of the line, a comment in
+the line of the container's 'begin' is after the 'begin', and one in
+the line of the container's 'end' is after the 'end'. The former is
+kept as Trailing of the container.
+
+Comments in places we can't represent, like in the middle of an
+expression, end up as Leading of the innermost item around them.
+*/
+func attachTrivia(root *mod.Node, st *Lexer) {
+	t := &trivia{
+		comments: map[int]*Comment{},
+		blank:    st.Blank,
+	}
+	for _, c := range st.Comments {
+		line := c.Range.Begin.Line
+		t.comments[line] = c
+		t.last = max(t.last, line)
+	}
+	for line := range st.Blank {
+		t.last = max(t.last, line)
+	}
+	items := []*mod.Node{}
+	items = append(items, root.Leaves[0].Leaves...)
+	items = append(items, root.Leaves[1].Leaves...)
+	t.container(root, items, 0, t.last+1)
+}
+
+type trivia struct {
+	comments map[int]*Comment // by line, there's at most one per line
+	blank    map[int]bool
+	last     int
+}
+
+// begin and end are the lines where the container opens and closes
+func (t *trivia) container(c *mod.Node, items []*mod.Node, begin, end int) {
+	line := begin
+	var prev *mod.Node
+	for _, item := range items {
+		if item == nil || item.Range == nil {
+			continue
+		}
+		from := begin
+		if prev != nil {
+			if item.Range.Begin.Line > line {
+				prev.Trailing = t.take(line)
+			}
+			from = line + 1
+		}
+		item.Leading = t.lines(from, item.Range.Begin.Line)
+		t.inside(item)
+		line = item.Range.End.Line
+		prev = item
+	}
+	if prev == nil {
+		c.Closing = t.lines(begin, end)
+		return
+	}
+	if line < end {
+		prev.Trailing = t.take(line)
+	}
+	c.Closing = t.lines(line+1, end)
+}
+
+// lists have no closing keyword, so comments after the last
+// item belong to whatever comes after the list, comments right
+// above the first item are taken as long as they're inside
+// the item that holds the list.
+func (t *trivia) list(n *mod.Node, item *mod.Node) {
+	if len(n.Leaves) == 0 {
+		return
+	}
+	first := n.Leaves[0]
+	last := n.Leaves[len(n.Leaves)-1]
+	begin := first.Range.Begin.Line
+	for begin-1 > item.Range.Begin.Line && t.comments[begin-1] != nil {
+		begin--
+	}
+	t.container(n, n.Leaves, begin, last.Range.End.Line)
+}
+
+// vars are always followed by a line break. Comments inside a
+// declaration end up as Leading of that declaration, which the
+// formatter prints between 'var' and the declaration, so comments
+// between the header of the procedure and the first declaration
+// are taken too.
+func (t *trivia) vars(n *mod.Node, header int) {
+	first := n.Leaves[0]
+	last := n.Leaves[len(n.Leaves)-1]
+	begin := first.Range.Begin.Line
+	for begin-1 > header && t.comments[begin-1] != nil {
+		begin--
+	}
+	t.container(n, n.Leaves, begin, last.Range.End.Line+1)
+}
+
+// last line of the name, arguments and returns of a procedure
+func headerEnd(proc *mod.Node) int {
+	line := proc.Range.Begin.Line
+	for _, leaf := range proc.Leaves[:3] {
+		if leaf != nil && leaf.Range != nil {
+			line = max(line, leaf.Range.End.Line)
+		}
+	}
+	return line
+}
+
+func (t *trivia) inside(item *mod.Node) {
+	t.walk(item, item)
+	// leftovers
+	for line := item.Range.Begin.Line; line < item.Range.End.Line; line++ {
+		text := t.take(line)
+		if text != "" {
+			item.Leading = append(item.Leading, text)
+		}
+	}
+}
+
+func (t *trivia) walk(n *mod.Node, item *mod.Node) {
+	for i, leaf := range n.Leaves {
+		if leaf == nil {
+			continue
+		}
+		switch leaf.Lex {
+		case lk.BLOCK, lk.FIELDLIST, lk.ASMLINES, lk.BEGIN:
+			r := leaf.Range
+			if opensLine(leaf) {
+				leaf.Trailing = t.take(r.Begin.Line)
+			}
+			t.container(leaf, leaf.Leaves, r.Begin.Line, r.End.Line)
+		case lk.PROCDECLS:
+			if n.Lex == lk.PROC && i == 3 {
+				t.vars(leaf, headerEnd(n))
+			} else {
+				t.list(leaf, item)
+			}
+		case lk.ALIASLIST, lk.BLOB, lk.EXPRLIST:
+			t.list(leaf, item)
+		default:
+			t.walk(leaf, item)
+		}
+	}
+}
+
+// true if nothing follows the 'begin' of the container in the same line,
+// a comment there is kept right after the 'begin'
+func opensLine(n *mod.Node) bool {
+	r := n.Range
+	if r.Begin.Line == r.End.Line {
+		return false
+	}
+	return len(n.Leaves) == 0 || n.Leaves[0].Range.Begin.Line > r.Begin.Line
+}
+
+func (t *trivia) take(line int) string {
+	c, ok := t.comments[line]
+	if !ok {
+		return ""
+	}
+	delete(t.comments, line)
+	return c.Text
+}
+
+// returns the comments and empty lines in [begin, end),
+// consecutive empty lines are merged
+func (t *trivia) lines(begin, end int) []string {
+	var out []string
+	end = min(end, t.last+1)
+	for line := begin; line < end; line++ {
+		text := t.take(line)
+		if text != "" {
+			out = append(out, text)
+		} else if t.blank[line] && (len(out) == 0 || out[len(out)-1] != "") {
+			out = append(out, "")
+		}
+	}
+	return out
+}
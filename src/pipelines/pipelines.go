@@ -6,145 +6,292 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 
 	"mpc/asmproc"
 	gen "mpc/backend0/gen"
 	mir "mpc/backend0/mir"
 	mirchecker "mpc/backend0/mir/checker"
 	resalloc "mpc/backend0/resalloc"
+	"mpc/cache"
 	"mpc/core/asm"
+	"mpc/deadcode"
+	"mpc/deps"
+	"mpc/elf"
 	fasm "mpc/fasm"
+	gas "mpc/gas"
 
 	"mpc/core/pir"
 	pirchecker "mpc/core/pir/checker"
 
 	. "mpc/core"
 	mod "mpc/core/module"
+	GK "mpc/core/module/globalkind"
+	T "mpc/core/types"
 
 	"mpc/constexpr"
+	"mpc/format"
 	"mpc/lexer"
 	"mpc/linearization"
 	"mpc/parser"
 	"mpc/resolution"
+	"mpc/stats"
 	"mpc/typechecker"
 )
 
 // processes a single file and returns all tokens
 // or an error
-func Lexemes(file string) ([]*mod.Node, *Error) {
+func Lexemes(file string) ([]*mod.Node, []*Error) {
 	s, err := getFile(file)
 	if err != nil {
-		return nil, err
+		return nil, single(err)
 	}
+	stats.Begin(stats.Parse)
+	defer stats.End()
 	st := lexer.NewLexer(file, s)
-	return st.ReadAll()
+	n, err := st.ReadAll()
+	return n, single(err)
 }
 
 // processes a single file and returns it's AST
 // or an error
-func Ast(file string) (*mod.Node, *Error) {
+func Ast(file string) (*mod.Node, []*Error) {
 	s, err := getFile(file)
 	if err != nil {
-		return nil, err
+		return nil, single(err)
 	}
-	return parser.Parse(file, s)
+	stats.Begin(stats.Parse)
+	defer stats.End()
+	n, err := parser.Parse(file, s)
+	return n, single(err)
 }
 
-// processes a file and all it's dependencies
-// returns a typed Module or an error
-func Mod(file string) (*mod.Module, *Error) {
-	m, err := resolution.Resolve(file, false)
-	if err != nil {
-		return nil, err
-	}
-
-	err = typechecker.Check(m)
+// processes a single file and returns it's source
+// before and after formatting, or an error
+func Fmt(file string) (string, string, []*Error) {
+	s, err := getFile(file)
 	if err != nil {
-		return nil, err
+		return "", "", single(err)
 	}
-	err = constexpr.EvalConstExprs(m)
+	n, err := parser.Parse(file, s)
 	if err != nil {
-		return nil, err
+		return "", "", single(err)
 	}
-	return m, nil
+	return s, format.Format(n), nil
 }
 
 // processes a file and all it's dependencies
-// returns a typed Module or an error
-func ModFmt(file string) (*mod.Module, *Error) {
-	m, err := resolution.Resolve(file, true)
-	if err != nil {
-		return nil, err
+// returns a typed Module or all errors found, in source order
+func Mod(file string) (*mod.Module, []*Error) {
+	return mod_(file, false)
+}
+
+// processes a file and all it's dependencies
+// returns a typed Module or all errors found, in source order
+func ModFmt(file string) (*mod.Module, []*Error) {
+	return mod_(file, true)
+}
+
+// like Mod, but files in sources are read from memory
+func ModSources(file string, sources map[string]string) (*mod.Module, []*Error) {
+	m, errs := resolution.ResolveSources(file, sources)
+	return check(m, errs)
+}
+
+// resolves a file and all it's dependencies, without typechecking,
+// so that the graph is available even with type errors
+func Deps(file string) (*deps.Graph, []*Error) {
+	m, errs := resolution.Resolve(file, false)
+	if len(errs) > 0 {
+		SortErrors(errs)
+		return nil, errs
 	}
+	return deps.Build(m), nil
+}
 
-	err = typechecker.Check(m)
-	if err != nil {
-		return nil, err
+func mod_(file string, _fmt bool) (*mod.Module, []*Error) {
+	return check(resolution.Resolve(file, _fmt))
+}
+
+func check(m *mod.Module, errs []*Error) (*mod.Module, []*Error) {
+	if len(errs) > 0 {
+		SortErrors(errs)
+		return nil, errs
 	}
-	err = constexpr.EvalConstExprs(m)
-	if err != nil {
-		return nil, err
+
+	stats.Begin(stats.Typechecking)
+	errs = typechecker.Check(m)
+	stats.End()
+	if len(errs) > 0 {
+		SortErrors(errs)
+		return nil, errs
 	}
+	stats.Begin(stats.Constexpr)
+	errs = constexpr.EvalConstExprs(m)
+	stats.End()
+	if len(errs) > 0 {
+		SortErrors(errs)
+		return nil, errs
+	}
+	countModules(m)
 	return m, nil
 }
 
+func countModules(m *mod.Module) {
+	for _, m := range append(dependencyOrder(m), m) {
+		stats.Modules++
+		for _, sy := range m.Globals {
+			if !sy.External {
+				stats.Symbols++
+			}
+		}
+	}
+}
+
 // processes a file and all it's dependencies
 // generates PIR or an error
-func Pir(file string) (*pir.Program, *Error) {
-	m, err := Mod(file)
-	if err != nil {
-		return nil, err
+func Pir(file string) (*pir.Program, []*Error) {
+	m, errs := Mod(file)
+	if len(errs) > 0 {
+		return nil, errs
 	}
+	return pir_(m, false, false)
+}
 
-	err = typechecker.CheckMain(m)
-	if err != nil {
-		return nil, err
+// libraries are compiled to objects, they only need
+// a valid main if they have one. Programs linked with
+// objects keep what the objects may call
+func pir_(m *mod.Module, lib bool, linked bool) (*pir.Program, []*Error) {
+	if _, ok := m.Globals["main"]; !lib || ok {
+		err := typechecker.CheckMain(m)
+		if err != nil {
+			return nil, single(err)
+		}
 	}
 
-	err = asmproc.GenAsmProcs(m)
-	if err != nil {
-		return nil, err
+	stats.Begin(stats.Asmproc)
+	errs := asmproc.GenAsmProcs(m)
+	stats.End()
+	if len(errs) > 0 {
+		SortErrors(errs)
+		return nil, errs
 	}
 
+	stats.Begin(stats.Linearization)
 	p, err := linearization.Generate(m)
+	if err == nil {
+		roots := []string{}
+		if linked {
+			roots = linkedRoots(m)
+		}
+		deadcode.Eliminate(p, roots)
+	}
+	stats.End()
 	if err != nil {
-		return nil, err
+		return nil, single(err)
 	}
 
+	stats.Begin(stats.PirCheck)
 	err = pirchecker.Check(p)
+	stats.End()
 	if err != nil {
 		fmt.Println(p)
-		return nil, err
+		return nil, single(err)
 	}
+	countPir(p)
 
 	return p, nil
 }
 
+// procedures of the program that objects may call: the
+// exported ones and the ones with the C calling convention
+func linkedRoots(m *mod.Module) []string {
+	roots := []string{}
+	for _, M := range append(dependencyOrder(m), m) {
+		if M.Interface {
+			continue
+		}
+		for _, sy := range M.Globals {
+			if sy.Kind != GK.Proc || sy.External || sy.Proc.Extern {
+				continue
+			}
+			_, exported := M.Exported[sy.Name]
+			if exported || sy.Proc.Type.Proc.CC == T.Cdecl {
+				roots = append(roots, sy.Label())
+			}
+		}
+	}
+	return roots
+}
+
+func countPir(p *pir.Program) {
+	for _, sy := range p.Symbols {
+		if sy.Proc != nil {
+			stats.Blocks += len(sy.Proc.AllBlocks)
+			for _, b := range sy.Proc.AllBlocks {
+				stats.PirInstrs += len(b.Code)
+			}
+		}
+	}
+}
+
 var NumRegisters = len(gen.Registers)
 
 // processes a file and all it's dependencies
 // generates MIR or an error
-func Mir(file string) (*mir.Program, *Error) {
-	p, err := Pir(file)
-	if err != nil {
-		return nil, err
+func Mir(file string) (*mir.Program, []*Error) {
+	m, errs := Mod(file)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return mir_(m, false, false)
+}
+
+func mir_(m *mod.Module, lib bool, linked bool) (*mir.Program, []*Error) {
+	p, errs := pir_(m, lib, linked)
+	if len(errs) > 0 {
+		return nil, errs
 	}
+	stats.Begin(stats.Resalloc)
 	mirP := resalloc.Allocate(p, NumRegisters)
-	err = mirchecker.Check(mirP)
+	stats.End()
+	stats.Begin(stats.MirCheck)
+	err := mirchecker.Check(mirP)
+	stats.End()
 	if err != nil {
-		return nil, err
+		return nil, single(err)
+	}
+	for _, sy := range mirP.Symbols {
+		if sy.Proc != nil {
+			stats.Spills += sy.Proc.NumOfSpills
+		}
 	}
 	return mirP, nil
 }
 
 // processes a file and all it's dependencies
 // generates Asm program or an error
-func Asm(file string, outname string) (*asm.Program, *Error) {
-	mirP, err := Mir(file)
-	if err != nil {
-		return nil, err
+func Asm(file string, outname string) (*asm.Program, []*Error) {
+	m, errs := Mod(file)
+	if len(errs) > 0 {
+		return nil, errs
 	}
+	return asm_(m, outname, false, false)
+}
+
+func asm_(m *mod.Module, outname string, lib bool, linked bool) (*asm.Program, []*Error) {
+	mirP, errs := mir_(m, lib, linked)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	stats.Begin(stats.Gen)
 	out := gen.Generate(mirP)
+	stats.End()
+	stats.AsmLines += len(out.Executable) + len(out.Readonly) + len(out.Writable)
 	if outname != "" {
 		out.FileName = outname
 	} else {
@@ -153,41 +300,400 @@ func Asm(file string, outname string) (*asm.Program, *Error) {
 	return out, nil
 }
 
-func Fasm(file string) (string, *Error) {
-	p, err := Asm(file, "")
-	if err != nil {
-		return "", err
+func Fasm(file string) (string, []*Error) {
+	p, errs := Asm(file, "")
+	if len(errs) > 0 {
+		return "", errs
 	}
+	stats.Begin(stats.Emission)
+	defer stats.End()
 	return fasm.Generate(p), nil
 }
 
+func Gas(file string) (string, []*Error) {
+	p, errs := Asm(file, "")
+	if len(errs) > 0 {
+		return "", errs
+	}
+	stats.Begin(stats.Emission)
+	defer stats.End()
+	return gas.Generate(p), nil
+}
+
+// how the binary is produced from the asm.Program
+type AsmFormat int
+
+const (
+	FmtNative AsmFormat = iota // in-process encoder and ELF writer
+	FmtFasm                    // prints fasm source and calls fasm
+	FmtGas                     // prints GNU as source and calls as and ld
+)
+
 // processes a Millipascal program and saves a binary
 // into disk
-func Compile(file string, outname string) (string, *Error) {
-	fp, err := Asm(file, outname)
-	if err != nil {
-		return "", err
+func Compile(file string, outname string, af AsmFormat) (string, []*Error) {
+	return Link(file, outname, af, nil)
+}
+
+// like Compile, but links the program with object files (.o or .a),
+// extern procedures are resolved by the linker. modules loaded
+// from interfaces bring their own objects
+func Link(file string, outname string, af AsmFormat, objects []string) (string, []*Error) {
+	var m *mod.Module
+	var errs []*Error
+	cached := cache.Enabled() && af != FmtFasm
+	if cached {
+		m, errs = check(resolution.ResolveCached(file))
+	} else {
+		m, errs = Mod(file)
+	}
+	if len(errs) > 0 {
+		return "", errs
+	}
+	if cached {
+		errs = fillCache(m)
+		if len(errs) > 0 {
+			return "", errs
+		}
+	}
+	fp, errs := asm_(m, outname, false, len(objects) > 0)
+	if len(errs) > 0 {
+		return "", errs
+	}
+	cachedObjects := moduleObjects(m)
+	var ioerr error
+	switch {
+	case af == FmtNative && len(cachedObjects)+len(objects) > 0:
+		ioerr = linkNative(fp, cachedObjects, objects)
+	case af == FmtNative:
+		ioerr = genNative(fp)
+	case af == FmtFasm && len(objects) > 0:
+		ioerr = errors.New("fasm can't link object files, use -asmfmt=native or gas")
+	case af == FmtFasm:
+		ioerr = genFasm(fp)
+	case af == FmtGas:
+		ioerr = genGas(fp, cachedObjects, objects)
 	}
-	ioerr := genBinary(fp)
 	if ioerr != nil {
-		return "", ProcessFileError(ioerr)
+		return "", single(ProcessFileError(ioerr))
+	}
+	return fp.FileName, nil
+}
+
+/*
+Processes a Millipascal module and saves a relocatable object
+into disk, main is optional. The object only has the code of
+the module, dependencies are linked separately.
+
+The interface of the module is saved next to its source,
+the object too, unless outname says otherwise.
+*/
+func CompileObject(file string, outname string) (string, []*Error) {
+	m, errs := Mod(file)
+	if len(errs) > 0 {
+		return "", errs
+	}
+	declareDependencies(m, map[*mod.Module]bool{m: true})
+	if outname == "" {
+		outname = strings.TrimSuffix(m.FullPath, filepath.Ext(m.FullPath)) + ".o"
+	}
+	fp, errs := asm_(m, outname, true, false)
+	if len(errs) > 0 {
+		return "", errs
+	}
+	stats.Begin(stats.Emission)
+	obj, err := elf.Object(fp)
+	stats.End()
+	if err != nil {
+		return "", single(ProcessFileError(err))
+	}
+	err = os.WriteFile(fp.FileName, obj, 0644)
+	if err != nil {
+		return "", single(ProcessFileError(err))
+	}
+	err = writeInterface(m, fp.FileName)
+	if err != nil {
+		return "", single(ProcessFileError(err))
 	}
 	return fp.FileName, nil
 }
 
-func genBinary(fp *asm.Program) error {
+/*
+Dependencies that were not in the cache are compiled to their
+own objects, one at a time, just like with -c, and stored.
+In the end only the main module is left to compile.
+
+If an entry can't be stored the module is compiled with the
+rest of the program, as if there was no cache. So are modules
+with gc procedures: the stack maps of a program are a single
+table, each object would bring its own.
+*/
+func fillCache(m *mod.Module) []*Error {
+	all := dependencyOrder(m)
+	for _, dep := range all {
+		if dep.Interface || hasGC(dep) {
+			continue
+		}
+		for _, other := range all {
+			other.Interface = other != dep
+		}
+		m.Interface = true
+		fp, errs := asm_(m, "", true, false)
+		if len(errs) > 0 {
+			return errs
+		}
+		dep.Object, _ = storeModule(dep, fp)
+		for _, other := range all {
+			other.Interface = other.Object != ""
+		}
+		m.Interface = false
+	}
+	return nil
+}
+
+func hasGC(m *mod.Module) bool {
+	for _, sy := range m.Globals {
+		if sy.Kind == GK.Proc && !sy.External && sy.Proc.Type.Proc.CC == T.GC {
+			return true
+		}
+	}
+	return false
+}
+
+func storeModule(m *mod.Module, fp *asm.Program) (string, error) {
+	stats.Begin(stats.Emission)
+	obj, err := elf.Object(fp)
+	stats.End()
+	if err != nil {
+		return "", err
+	}
+	source, err := os.ReadFile(m.FullPath)
+	if err != nil {
+		return "", err
+	}
+	header := resolution.InterfaceHeader(m.Name, string(source), m.Hash, cache.ObjectName(m.Hash))
+	return cache.Store(m.Hash, header+"\n"+format.Interface(m), obj)
+}
+
+// dependencies come before their dependents, the main module is not included
+func dependencyOrder(m *mod.Module) []*mod.Module {
+	seen := map[*mod.Module]bool{m: true}
+	order := []*mod.Module{}
+	var visit func(m *mod.Module)
+	visit = func(m *mod.Module) {
+		names := []string{}
+		for name := range m.Dependencies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			dep := m.Dependencies[name].M
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			visit(dep)
+			order = append(order, dep)
+		}
+	}
+	visit(m)
+	return order
+}
+
+// dependencies are only declared, as if they came from interfaces
+func declareDependencies(m *mod.Module, seen map[*mod.Module]bool) {
+	for _, dep := range m.Dependencies {
+		if !seen[dep.M] {
+			seen[dep.M] = true
+			dep.M.Interface = true
+			declareDependencies(dep.M, seen)
+		}
+	}
+}
+
+func writeInterface(m *mod.Module, object string) error {
+	source, err := os.ReadFile(m.FullPath)
+	if err != nil {
+		return err
+	}
+	path := resolution.InterfacePath(m.FullPath)
+	rel, err := relativeTo(filepath.Dir(path), object)
+	if err != nil {
+		return err
+	}
+	header := resolution.InterfaceHeader(m.Name, string(source), m.Hash, rel)
+	return os.WriteFile(path, []byte(header+"\n"+format.Interface(m)), 0644)
+}
+
+func relativeTo(folder, path string) (string, error) {
+	absFolder, err := filepath.Abs(folder)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(absFolder, absPath)
+}
+
+// every module is linked once, in a stable order
+func moduleObjects(m *mod.Module) []string {
+	objects := []string{}
+	for _, dep := range dependencyOrder(m) {
+		if dep.Object != "" {
+			objects = append(objects, dep.Object)
+		}
+	}
+	return objects
+}
+
+// binaries are relative to the current folder, so that
+// they can be executed by name, unless the path is absolute
+func OutputPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return "./" + name
+}
+
+/*
+Compiles the program to a temporary binary and runs it with
+the given arguments and the standard streams of the compiler.
+Returns the exit code of the program, or 128 plus the signal
+that killed it, like a shell would.
+*/
+func Run(file string, af AsmFormat, objects []string, args []string) (int, []*Error) {
+	dir, err := os.MkdirTemp("", "mpc_*")
+	if err != nil {
+		return 0, single(ProcessFileError(err))
+	}
+	defer os.RemoveAll(dir)
+	bin, errs := Link(file, filepath.Join(dir, "out"), af, objects)
+	if len(errs) > 0 {
+		return 0, errs
+	}
+
+	// the program gets the interrupt, we stay to clean up
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	cmd := exec.Command(bin, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		status, ok := exitErr.Sys().(syscall.WaitStatus)
+		if ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return 0, single(ProcessFileError(err))
+	}
+	return 0, nil
+}
+
+func genNative(fp *asm.Program) error {
+	stats.Begin(stats.Emission)
+	defer stats.End()
+	bin, err := elf.Executable(fp)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(OutputPath(fp.FileName), bin, 0755)
+}
+
+func linkNative(fp *asm.Program, cached, objects []string) error {
+	dir, oserr := os.MkdirTemp("", "mpc_*")
+	if oserr != nil {
+		return oserr
+	}
+	defer os.RemoveAll(dir)
+	stats.Begin(stats.Emission)
+	obj, oserr := elf.Object(fp)
+	stats.End()
+	if oserr != nil {
+		return oserr
+	}
+	objFile := filepath.Join(dir, "out.o")
+	oserr = os.WriteFile(objFile, obj, 0644)
+	if oserr != nil {
+		return oserr
+	}
+	return ld(fp, objFile, cached, objects)
+}
+
+// objects go after ours, so that archives are searched
+// for the symbols we use. Each symbol of our objects has
+// its own section, the ones nothing uses are left out
+func ld(fp *asm.Program, obj string, cached, objects []string) error {
+	ours := append([]string{obj}, cached...)
+	args := []string{"-static", "--gc-sections", "--print-gc-sections", "-o", OutputPath(fp.FileName)}
+	args = append(args, ours...)
+	args = append(args, objects...)
+	stats.Begin(stats.Assembly)
+	defer stats.End()
+	cmd := exec.Command("ld", args...)
+	s, oserr := cmd.CombinedOutput()
+	if oserr != nil {
+		return errors.New(string(s) + "\n" + oserr.Error())
+	}
+	deadcode.Unlinked(string(s), ours)
+	return nil
+}
+
+func genFasm(fp *asm.Program) error {
 	f, oserr := os.CreateTemp("", "mpc_*")
 	if oserr != nil {
 		return oserr
 	}
 	defer os.Remove(f.Name())
+	stats.Begin(stats.Emission)
 	_, oserr = f.WriteString(fasm.Generate(fp))
+	stats.End()
 	if oserr != nil {
 		return oserr
 	}
-	name := "./" + fp.FileName
+	name := OutputPath(fp.FileName)
 	cmd := exec.Command("fasm", f.Name(), name)
 
+	stats.Begin(stats.Assembly)
+	s, oserr := cmd.CombinedOutput()
+	stats.End()
+	if oserr != nil {
+		return errors.New(string(s) + "\n" + oserr.Error())
+	}
+	return nil
+}
+
+func genGas(fp *asm.Program, cached, objects []string) error {
+	dir, oserr := os.MkdirTemp("", "mpc_*")
+	if oserr != nil {
+		return oserr
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "out.s")
+	obj := filepath.Join(dir, "out.o")
+	stats.Begin(stats.Emission)
+	oserr = os.WriteFile(src, []byte(gas.Generate(fp)), 0644)
+	stats.End()
+	if oserr != nil {
+		return oserr
+	}
+	stats.Begin(stats.Assembly)
+	oserr = run("as", "-o", obj, src)
+	stats.End()
+	if oserr != nil {
+		return oserr
+	}
+	return ld(fp, obj, cached, objects)
+}
+
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
 	s, oserr := cmd.CombinedOutput()
 	if oserr != nil {
 		return errors.New(string(s) + "\n" + oserr.Error())
@@ -202,3 +708,11 @@ func getFile(file string) (string, *Error) {
 	}
 	return string(text), nil
 }
+
+// avoids the typed nil inside a non-nil slice
+func single(err *Error) []*Error {
+	if err == nil {
+		return nil
+	}
+	return []*Error{err}
+}
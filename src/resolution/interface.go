@@ -0,0 +1,124 @@
+package resolution
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mod "mpc/core/module"
+	"mpc/format"
+)
+
+// interfaces are kept next to the source of their module
+const InterfaceExt = ".mpi"
+
+const (
+	sourceLine = "# source: "
+	moduleLine = "# module: "
+	objectLine = "# object: "
+)
+
+// identifies a version of the source of a module
+func SourceHash(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:])
+}
+
+// ties an interface to the source it was generated from, and to
+// the hash of the module, that changes with any of its dependencies,
+// the object is relative to the interface
+func InterfaceHeader(modID, source, hash, object string) string {
+	return "# interface of " + modID + ", generated by mpc -c\n" +
+		sourceLine + SourceHash(source) + "\n" +
+		moduleLine + hash + "\n" +
+		objectLine + object + "\n"
+}
+
+// an interface that may replace the source of a module
+type iface struct {
+	Path   string
+	Object string
+	Hash   string // of the module, see InterfaceHeader
+}
+
+func InterfacePath(sourcePath string) string {
+	return strings.TrimSuffix(sourcePath, filepath.Ext(sourcePath)) + InterfaceExt
+}
+
+/*
+An interface replaces the source of a module only if it was
+generated from the current source and its object still exists.
+The module being compiled, and anything that is formatted,
+always comes from source.
+
+The dependencies are only known after the couplings are resolved,
+those are the same in the interface, the hash of the module is
+checked then, see resolveModule.
+*/
+func findInterface(s *state, folder, fileName, modID string) (*iface, bool) {
+	if s._fmt || modID == s.Main {
+		return nil, false
+	}
+	source, err := readFile(s, folder+"/"+fileName)
+	if err != nil {
+		return nil, false
+	}
+	path := InterfacePath(folder + "/" + fileName)
+	text, ioerr := os.ReadFile(path)
+	if ioerr != nil {
+		return nil, false
+	}
+	sourceHash, i := readHeader(string(text))
+	if sourceHash != SourceHash(source) || i.Hash == "" || i.Object == "" {
+		return nil, false
+	}
+	i.Path = path
+	if !filepath.IsAbs(i.Object) {
+		i.Object = filepath.Join(folder, i.Object)
+	}
+	if _, ioerr := os.Stat(i.Object); ioerr != nil {
+		return nil, false
+	}
+	return i, true
+}
+
+func readHeader(text string) (string, *iface) {
+	source := ""
+	i := &iface{}
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if strings.HasPrefix(line, sourceLine) {
+			source = strings.TrimPrefix(line, sourceLine)
+		}
+		if strings.HasPrefix(line, moduleLine) {
+			i.Hash = strings.TrimPrefix(line, moduleLine)
+		}
+		if strings.HasPrefix(line, objectLine) {
+			i.Object = strings.TrimPrefix(line, objectLine)
+		}
+	}
+	return source, i
+}
+
+// procedures in interfaces are defined by the object of the module,
+// unless they were already extern in the source
+func markInterface(M *mod.Module) {
+	for _, sy := range M.Globals {
+		if !sy.External && !hasAttr(sy, format.Foreign) {
+			sy.Interface = true
+		}
+	}
+}
+
+func hasAttr(sy *mod.Global, attr string) bool {
+	for _, a := range sy.Attr {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
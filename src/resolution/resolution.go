@@ -2,56 +2,96 @@ package resolution
 
 import (
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strings"
 
 	EK "mpc/core/errorkind"
 	GK "mpc/core/module/globalkind"
 	LK "mpc/core/module/lexkind"
+	SV "mpc/core/severity"
 
+	"mpc/cache"
 	. "mpc/core"
 	mod "mpc/core/module"
 	"mpc/format"
 	"mpc/lexer"
 	msg "mpc/messages"
+	"mpc/parallel"
 	"mpc/parser"
+	"mpc/stats"
 )
 
+// folders searched for modules, after the folder of the entry file,
+// module paths like std/io are subfolders of these
+var SearchPaths []string
+
 // _fmt set to true will format every file from AST before parsing again
-func Resolve(filePath string, _fmt bool) (*mod.Module, *Error) {
+func Resolve(filePath string, _fmt bool) (*mod.Module, []*Error) {
+	return resolveFrom(filePath, _fmt, nil, false)
+}
+
+// like Resolve, but dependencies found in the build cache
+// are loaded from their interfaces
+func ResolveCached(filePath string) (*mod.Module, []*Error) {
+	return resolveFrom(filePath, false, nil, cache.Enabled())
+}
+
+// files present in sources (by path) are read from memory instead of disk,
+// this is used by the language server for unsaved buffers
+func ResolveSources(filePath string, sources map[string]string) (*mod.Module, []*Error) {
+	return resolveFrom(filePath, false, sources, false)
+}
+
+func resolveFrom(filePath string, _fmt bool, sources map[string]string, cached bool) (*mod.Module, []*Error) {
+	stats.Begin(stats.Resolution)
+	defer stats.End()
 	name, err := extractName(filePath)
 	if err != nil {
-		return nil, err
+		return nil, []*Error{err}
 	}
 
 	s, ioerr := newState(filePath, _fmt)
 	if ioerr != nil {
-		return nil, processFileError(ioerr)
+		return nil, []*Error{processFileError(ioerr)}
 	}
+	s.Sources = sources
+	s.Main = name
+	s.Cached = cached
 
 	m, err := resolveModule(s, name)
 	if err != nil {
-		return nil, err
+		return nil, []*Error{err}
 	}
 	err = checkDependencyCycles(m)
 	if err != nil {
-		return nil, err
+		return nil, []*Error{err}
 	}
-	err = resolveNames(m)
-	if err != nil {
-		return nil, err
+	errs := resolveNames(m)
+	if len(errs) > 0 {
+		return nil, errs
 	}
 	return m, nil
 }
 
 type state struct {
-	Modules       map[string]*mod.Module
-	BaseFolder    string
-	FilesInFolder []string
+	Modules    map[string]*mod.Module
+	BaseFolder string
+	Roots      []string            // BaseFolder then SearchPaths
+	Folders    map[string][]string // files in each folder, lazily read
 
 	RefNode   *mod.Node // for errors
 	RefModule *mod.Module
 
+	Sources map[string]string
+	Main    string // the module being compiled
+	Cached  bool
+
+	Pool    *parallel.Pool
+	Parsing map[string]*parsing // by path
+
 	_fmt bool
 }
 
@@ -61,41 +101,129 @@ func newState(fullPath string, _fmt bool) (*state, error) {
 	if err != nil {
 		return nil, err
 	}
-	filenames := make([]string, len(files))
-	for i, file := range files {
-		filenames[i] = file.Name()
-	}
 	return &state{
-		Modules:       map[string]*mod.Module{},
-		BaseFolder:    folder,
-		FilesInFolder: filenames,
-		_fmt:          _fmt,
+		Modules:    map[string]*mod.Module{},
+		BaseFolder: folder,
+		Roots:      append([]string{folder}, SearchPaths...),
+		Folders:    map[string][]string{folder: fileNames(files)},
+		Pool:       parallel.NewPool(),
+		Parsing:    map[string]*parsing{},
+		_fmt:       _fmt,
 	}, nil
 }
 
+func fileNames(files []fs.FileInfo) []string {
+	filenames := []string{}
+	for _, file := range files {
+		if !file.IsDir() {
+			filenames = append(filenames, file.Name())
+		}
+	}
+	return filenames
+}
+
+// folders that can't be read are just empty
+func filesIn(s *state, folder string) []string {
+	filenames, ok := s.Folders[folder]
+	if ok {
+		return filenames
+	}
+	files, _ := ioutil.ReadDir(folder)
+	filenames = fileNames(files)
+	s.Folders[folder] = filenames
+	return filenames
+}
+
 func resolveModule(s *state, modID string) (*mod.Module, *Error) {
 	module, ok := s.Modules[modID]
 	if ok {
 		return module, nil
 	}
-	fileName, err := findFile(s, modID)
+	folder, fileName, err := findFile(s, modID)
 	if err != nil {
 		return nil, err
 	}
-	n, err := openAndParse(s, fileName)
+	sourcePath := folder + "/" + fileName
+	i, isInterface := findInterface(s, folder, fileName, modID)
+	if isInterface {
+		fileName = filepath.Base(i.Path)
+	}
+	n, err := parse(s, folder+"/"+fileName)
 	if err != nil {
 		return nil, err
 	}
-	module = newModule(s.BaseFolder, modID, fileName, n)
+	module = newModule(folder, modID, fileName, n)
+	module.Interface = isInterface
+	if isInterface {
+		module.Object = i.Object
+	}
 	s.Modules[modID] = module
+	prefetch(s, n.Leaves[0])
 
 	err = resolveDependencies(s, n.Leaves[0], module)
 	if err != nil {
 		return nil, err
 	}
+	source, err := readFile(s, sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	module.Hash = moduleHash(module, source)
+	if isInterface && module.Hash != i.Hash {
+		err = fromSource(s, module, sourcePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.Cached && !module.Interface && modID != s.Main {
+		return module, loadCached(s, module)
+	}
 	return module, nil
 }
 
+func moduleHash(M *mod.Module, source string) string {
+	deps := []string{}
+	for _, dep := range M.Dependencies {
+		deps = append(deps, dep.M.Name+" "+dep.M.Hash)
+	}
+	sort.Strings(deps)
+	return cache.Key(M.Name, source, deps)
+}
+
+// a dependency changed after the interface was generated,
+// the module is compiled from source after all
+func fromSource(s *state, M *mod.Module, sourcePath string) *Error {
+	n, err := parse(s, sourcePath)
+	if err != nil {
+		return err
+	}
+	M.Root = n
+	M.FullPath = sourcePath
+	M.Interface = false
+	M.Object = ""
+	// the same modules, but the nodes must come from the source
+	M.Dependencies = map[string]*mod.Dependency{}
+	return resolveDependencies(s, n.Leaves[0], M)
+}
+
+// the interface has the same couplings as the source,
+// so the dependencies stay the same
+func loadCached(s *state, M *mod.Module) *Error {
+	iface, object, ok := cache.Lookup(M.Hash)
+	if !ok {
+		return nil
+	}
+	n, err := parse(s, iface)
+	if err != nil {
+		return err
+	}
+	M.Root = n
+	M.FullPath = iface
+	M.Interface = true
+	M.Object = object
+	return nil
+}
+
 func resolveDependencies(s *state, coupling *mod.Node, module *mod.Module) *Error {
 	if coupling.Lex != LK.COUPLINGS {
 		panic("resolver: resolveDependencies: bad node")
@@ -130,7 +258,7 @@ func fromImport(s *state, n *mod.Node, dependentMod *mod.Module) *Error {
 		return err
 	}
 
-	return addDependency(dependentMod, mod, n, modID)
+	return addDependency(dependentMod, mod, n, baseName(modID))
 }
 
 func multiImport(s *state, n *mod.Node, dependentMod *mod.Module) *Error {
@@ -153,7 +281,7 @@ func multiImport(s *state, n *mod.Node, dependentMod *mod.Module) *Error {
 			name = n.Leaves[1].Text
 		} else {
 			impName = n.Text
-			name = n.Text
+			name = baseName(n.Text)
 		}
 		mod, err := resolveModule(s, impName)
 		if err != nil {
@@ -178,6 +306,11 @@ func addDependency(parent *mod.Module, dependency *mod.Module, source *mod.Node,
 	return nil
 }
 
+// std/io is known as io
+func baseName(modID string) string {
+	return modID[strings.LastIndex(modID, "/")+1:]
+}
+
 func getFolder(fullpath string) string {
 	path := strings.Split(fullpath, "/")
 	if len(path) == 1 {
@@ -201,15 +334,17 @@ func extractName(filePath string) (string, *Error) {
 		return name[0], nil
 	}
 	return "", &Error{
-		Code:    EK.InvalidFileName,
-		Message: filePath + " : " + name[0],
+		Code:     EK.InvalidFileName,
+		Severity: SV.Error,
+		Message:  filePath + " : " + name[0],
 	}
 }
 
 func invalidModuleName(filePath string) *Error {
 	return &Error{
-		Code:    EK.InvalidFileName,
-		Message: filePath,
+		Code:     EK.InvalidFileName,
+		Severity: SV.Error,
+		Message:  filePath,
 	}
 }
 
@@ -225,11 +360,100 @@ func newModule(basePath, modID, filename string, root *mod.Node) *mod.Module {
 	}
 }
 
-func openAndParse(s *state, filename string) (*mod.Node, *Error) {
-	path := s.BaseFolder + "/" + filename
-	text, e := ioutil.ReadFile(path)
+func readFile(s *state, path string) (string, *Error) {
+	text, ok := s.Sources[filepath.Clean(path)]
+	if ok {
+		return text, nil
+	}
+	contents, e := ioutil.ReadFile(path)
 	if e != nil {
-		return nil, processFileError(e)
+		return "", processFileError(e)
+	}
+	return string(contents), nil
+}
+
+// a file being parsed in the background
+type parsing struct {
+	done chan struct{}
+	n    *mod.Node
+	err  *Error
+}
+
+/*
+Files imported by a module are parsed in the background while
+the module is resolved. Resolution still goes one module at
+a time, in order, so errors are the same as if nothing was
+parsed ahead. Files that can't be found are left for
+resolution to report.
+*/
+func prefetch(s *state, coupling *mod.Node) {
+	for _, modID := range imported(coupling) {
+		if _, ok := s.Modules[modID]; ok {
+			continue
+		}
+		folder, fileName, err := findFile(s, modID)
+		if err != nil {
+			continue
+		}
+		i, isInterface := findInterface(s, folder, fileName, modID)
+		if isInterface {
+			fileName = filepath.Base(i.Path)
+		}
+		path := folder + "/" + fileName
+		if _, ok := s.Parsing[path]; ok {
+			continue
+		}
+		p := &parsing{done: make(chan struct{})}
+		s.Parsing[path] = p
+		s.Pool.Go(func() {
+			p.n, p.err = openAndParse(s, path)
+			close(p.done)
+		})
+	}
+}
+
+// same as in resolveDependencies
+func imported(coupling *mod.Node) []string {
+	output := []string{}
+	for _, n := range coupling.Leaves {
+		switch n.Lex {
+		case LK.FROM:
+			output = append(output, n.Leaves[0].Text)
+		case LK.IMPORT:
+			if n.Leaves[0].Lex == LK.ALL {
+				continue
+			}
+			for _, item := range n.Leaves[0].Leaves {
+				if item.Lex == LK.AS {
+					output = append(output, item.Leaves[0].Text)
+				} else {
+					output = append(output, item.Text)
+				}
+			}
+		}
+	}
+	return output
+}
+
+// a tree is only used once, if the same file is parsed
+// again, it must be a different tree
+func parse(s *state, path string) (*mod.Node, *Error) {
+	stats.Begin(stats.Parse)
+	defer stats.End()
+	p, ok := s.Parsing[path]
+	if ok {
+		delete(s.Parsing, path)
+		<-p.done
+		return p.n, p.err
+	}
+	return openAndParse(s, path)
+}
+
+// may run in the background, s is only read
+func openAndParse(s *state, path string) (*mod.Node, *Error) {
+	text, err := readFile(s, path)
+	if err != nil {
+		return nil, err
 	}
 
 	n, err := parser.Parse(path, string(text))
@@ -238,8 +462,12 @@ func openAndParse(s *state, filename string) (*mod.Node, *Error) {
 	}
 
 	if s._fmt {
-		text := format.Format(n)
-		n, err = parser.Parse(path, string(text))
+		formatted := format.Format(n)
+		n, err = parser.Parse(path, formatted)
+		if err != nil {
+			return nil, err
+		}
+		err = checkRoundTrip(path, text, formatted, n)
 		if err != nil {
 			return nil, err
 		}
@@ -248,26 +476,94 @@ func openAndParse(s *state, filename string) (*mod.Node, *Error) {
 	return n, nil
 }
 
-func findFile(s *state, modID string) (string, *Error) {
-	found := []string{}
-	for _, filename := range s.FilesInFolder {
-		if strings.HasPrefix(filename, modID+".") {
-			found = append(found, filename)
-		}
+// formatting twice must give the same output, and no comment
+// may be lost in the way
+func checkRoundTrip(path, original, formatted string, n *mod.Node) *Error {
+	if format.Format(n) != formatted {
+		return roundTripError(path, "formatting is not idempotent")
+	}
+	before, err := comments(path, original)
+	if err != nil {
+		return err
 	}
-	if len(found) > 1 {
-		return "", msg.AmbiguousFilesInFolder(s.RefModule, s.RefNode, found, modID)
+	after, err := comments(path, formatted)
+	if err != nil {
+		return err
+	}
+	if strings.Join(before, "\n") != strings.Join(after, "\n") {
+		return roundTripError(path, "formatting changed the comments")
+	}
+	return nil
+}
+
+// sorted, since the formatter may move comments around
+func comments(path, text string) ([]string, *Error) {
+	st := lexer.NewLexer(path, text)
+	_, err := st.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	for _, c := range st.Comments {
+		out = append(out, c.Text)
 	}
-	if len(found) == 0 {
-		return "", msg.ModuleNotFound(s.RefModule, s.RefNode, s.BaseFolder, modID)
+	sort.Strings(out)
+	return out, nil
+}
+
+func roundTripError(path, message string) *Error {
+	return &Error{
+		Code:     EK.InternalCompilerError,
+		Severity: SV.InternalError,
+		Location: &Location{File: path},
+		Message:  message,
+	}
+}
+
+// the first root that has the module wins,
+// errors list every folder that was searched
+func findFile(s *state, modID string) (string, string, *Error) {
+	searched := []string{}
+	name := baseName(modID)
+	for _, root := range s.Roots {
+		folder := root
+		if name != modID {
+			folder += "/" + modID[:len(modID)-len(name)-1]
+		}
+		searched = append(searched, folder)
+		found := []string{}
+		for _, filename := range filesIn(s, folder) {
+			if strings.HasPrefix(filename, name+".") && !isObject(filename) && !isInterface(filename) {
+				found = append(found, filename)
+			}
+		}
+		if len(found) > 1 {
+			for i := range found {
+				found[i] = folder + "/" + found[i]
+			}
+			return "", "", msg.AmbiguousFilesInFolder(s.RefModule, s.RefNode, found, searched, modID)
+		}
+		if len(found) == 1 {
+			return folder, found[0], nil
+		}
 	}
-	return found[0], nil
+	return "", "", msg.ModuleNotFound(s.RefModule, s.RefNode, searched, modID)
+}
+
+// objects and interfaces are compiled right next to their source
+func isObject(filename string) bool {
+	return strings.HasSuffix(filename, ".o") || strings.HasSuffix(filename, ".a")
+}
+
+func isInterface(filename string) bool {
+	return strings.HasSuffix(filename, InterfaceExt)
 }
 
 func processFileError(e error) *Error {
 	return &Error{
-		Code:    EK.FileError,
-		Message: e.Error(),
+		Code:     EK.FileError,
+		Severity: SV.Error,
+		Message:  e.Error(),
 	}
 }
 
@@ -306,64 +602,71 @@ func depHasVisited(visited []*mod.Dependency, b *mod.Dependency) bool {
 	return false
 }
 
-func resolveNames(M *mod.Module) *Error {
-	err := resolve(M)
-	if err != nil {
-		return err
+func resolveNames(M *mod.Module) []*Error {
+	errs := resolve(M)
+	if len(errs) > 0 {
+		return errs
 	}
 	M.ResetVisited()
 	return nil
 }
 
-func resolve(M *mod.Module) *Error {
+// errors inside a phase are independent of each other,
+// but later phases (and dependent modules) expect the earlier
+// ones to have succeeded, so we stop at the end of a failed phase
+func resolve(M *mod.Module) []*Error {
 	if M.Visited {
 		return nil
 	}
 	M.Visited = true
 	for _, dep := range M.Dependencies {
-		err := resolve(dep.M)
-		if err != nil {
-			return err
+		errs := resolve(dep.M)
+		if len(errs) > 0 {
+			return errs
 		}
 	}
 
 	err := createImportedSymbols(M)
 	if err != nil {
-		return err
+		return []*Error{err}
 	}
 
-	err = createGlobals(M)
-	if err != nil {
-		return err
+	errs := createGlobals(M)
+	if len(errs) > 0 {
+		return errs
 	}
 
-	err = resolveGlobalDepGraph(M)
-	if err != nil {
-		return err
+	errs = resolveGlobalDepGraph(M)
+	if len(errs) > 0 {
+		return errs
 	}
 
 	err = checkGlobalCycles(M)
 	if err != nil {
-		return err
+		return []*Error{err}
 	}
 
 	err = checkExports(M)
 	if err != nil {
-		return err
+		return []*Error{err}
 	}
 
 	return nil
 }
 
-func createGlobals(M *mod.Module) *Error {
+func createGlobals(M *mod.Module) []*Error {
+	errs := []*Error{}
 	symbols := M.Root.Leaves[1]
 	for _, symbol := range symbols.Leaves {
 		err := declareSymbol(M, symbol)
 		if err != nil {
-			return err
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	if M.Interface {
+		markInterface(M)
+	}
+	return errs
 }
 
 func importSymbols(M *mod.Module, n *mod.Node) *Error {
@@ -421,7 +724,7 @@ func createImportedSymbols(M *mod.Module) *Error {
 }
 
 func fromImportSymbols(M *mod.Module, n *mod.Node) *Error {
-	mod := n.Leaves[0].Text
+	mod := baseName(n.Leaves[0].Text)
 	dep, ok := M.Dependencies[mod]
 	if !ok {
 		panic("dependency should have been found")
@@ -642,6 +945,7 @@ func getProcSymbol(M *mod.Module, n *mod.Node, idlist []string) *mod.Global {
 			Name:   name,
 			ArgMap: map[string]int{},
 			VarMap: map[string]int{},
+			Extern: n.Leaves[4].Lex == LK.EXTERN,
 			N:      n,
 		},
 		N: n,
@@ -733,37 +1037,28 @@ func declStructSymbol(M *mod.Module, n *mod.Node, idlist []string) *Error {
 	return nil
 }
 
-func resolveGlobalDepGraph(M *mod.Module) *Error {
+func resolveGlobalDepGraph(M *mod.Module) []*Error {
+	errs := []*Error{}
 	for _, sy := range M.Globals {
 		if sy.External {
 			continue
 		}
-		if sy.Kind == GK.Const {
-			err := resExpr(M, mod.FromSymbol(sy), sy.N.Leaves[2])
-			if err != nil {
-				return err
-			}
-		}
-		if sy.Kind == GK.Data {
-			err := resData(M, sy)
-			if err != nil {
-				return err
-			}
+		var err *Error
+		switch sy.Kind {
+		case GK.Const:
+			err = resExpr(M, mod.FromSymbol(sy), sy.N.Leaves[2])
+		case GK.Data:
+			err = resData(M, sy)
+		case GK.Struct:
+			err = resStruct(M, sy)
+		case GK.Proc:
+			err = resProc(M, sy)
 		}
-		if sy.Kind == GK.Struct {
-			err := resStruct(M, sy)
-			if err != nil {
-				return err
-			}
-		}
-		if sy.Kind == GK.Proc {
-			err := resProc(M, sy)
-			if err != nil {
-				return err
-			}
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	return errs
 }
 
 func resBaseType(M *mod.Module, sy *mod.Global, n *mod.Node) *Error {
@@ -0,0 +1,79 @@
+/*
+Wall time of each phase of the compiler, and a few counts of what
+went through them. Phases may nest (parsing happens in the middle
+of resolution), the time of a phase doesn't include the phases
+that started inside it.
+*/
+package stats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	Parse         = "lex/parse"
+	Resolution    = "resolution"
+	Typechecking  = "typechecking"
+	Constexpr     = "constexpr"
+	Asmproc       = "asmproc"
+	Linearization = "linearization"
+	PirCheck      = "pir check"
+	Resalloc      = "resalloc"
+	MirCheck      = "mir check"
+	Gen           = "gen"
+	Emission      = "emission"
+	Assembly      = "assembly"
+)
+
+// in pipeline order
+var phases = []string{
+	Parse, Resolution, Typechecking, Constexpr, Asmproc, Linearization,
+	PirCheck, Resalloc, MirCheck, Gen, Emission, Assembly,
+}
+
+var Times = map[string]time.Duration{}
+
+var Modules, Symbols, PirInstrs, Blocks, Spills, AsmLines int
+
+var running []string
+var since time.Time
+
+// every Begin must be followed by an End
+func Begin(phase string) {
+	now := time.Now()
+	if len(running) > 0 {
+		Times[running[len(running)-1]] += now.Sub(since)
+	}
+	running = append(running, phase)
+	since = now
+}
+
+func End() {
+	now := time.Now()
+	top := len(running) - 1
+	Times[running[top]] += now.Sub(since)
+	running = running[:top]
+	since = now
+}
+
+func Report() string {
+	output := []string{}
+	total := time.Duration(0)
+	for _, phase := range phases {
+		output = append(output, fmt.Sprintf("%-14s %v", phase, Times[phase]))
+		total += Times[phase]
+	}
+	output = append(output,
+		fmt.Sprintf("%-14s %v", "total", total),
+		"",
+		fmt.Sprintf("%-14s %d", "modules", Modules),
+		fmt.Sprintf("%-14s %d", "symbols", Symbols),
+		fmt.Sprintf("%-14s %d", "pir instrs", PirInstrs),
+		fmt.Sprintf("%-14s %d", "blocks", Blocks),
+		fmt.Sprintf("%-14s %d", "spills", Spills),
+		fmt.Sprintf("%-14s %d", "asm lines", AsmLines),
+	)
+	return strings.Join(output, "\n") + "\n"
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 )
 
@@ -20,8 +21,15 @@ import (
 // of the file:
 // 	module_name.E001.mp
 // 	            ^ error code
+// 	module_name.E013.E020.mp
+// 	            ^ several error codes, in source order
 // 	module_name.mp
 // 	           ^ no error code (file must exit normally)
+//
+// what takes more than one run of the compiler, like linking
+// separately compiled objects, is tested by shell scripts:
+// 	module_name.sh
+// 	           ^ must exit normally
 
 type TestResult struct {
 	File    string
@@ -31,75 +39,78 @@ type TestResult struct {
 
 func (res *TestResult) String() string {
 	if res.Ok {
-		return "\u001b[34mok\u001b[0m"
+		return Paint(Blue, "ok")
 	}
-	return "\u001b[31mfail\u001b[0m"
+	return Paint(Red, "fail")
 }
 
-type Stage func(filename string, outname string) (outfile string, err *Error)
+type Stage func(filename string, outname string) (outfile string, errs []*Error)
 
-func S_Lexer(filename string, outname string) (string, *Error) {
-	_, err := pipelines.Lexemes(filename)
-	return "", err
+func S_Lexer(filename string, outname string) (string, []*Error) {
+	_, errs := pipelines.Lexemes(filename)
+	return "", errs
 }
 
-func S_Parser(filename string, outname string) (string, *Error) {
-	_, err := pipelines.Ast(filename)
-	return "", err
+func S_Parser(filename string, outname string) (string, []*Error) {
+	_, errs := pipelines.Ast(filename)
+	return "", errs
 }
 
-func S_Typechecker(filename string, outname string) (string, *Error) {
-	_, err := pipelines.Mod(filename)
-	return "", err
+func S_Typechecker(filename string, outname string) (string, []*Error) {
+	_, errs := pipelines.Mod(filename)
+	return "", errs
 }
 
-func S_PirGeneration(filename string, outname string) (string, *Error) {
-	_, err := pipelines.Pir(filename)
-	return "", err
+func S_PirGeneration(filename string, outname string) (string, []*Error) {
+	_, errs := pipelines.Pir(filename)
+	return "", errs
 }
 
-func S_MirGeneration(filename string, outname string) (string, *Error) {
-	_, err := pipelines.Mir(filename)
-	return "", err
+func S_MirGeneration(filename string, outname string) (string, []*Error) {
+	_, errs := pipelines.Mir(filename)
+	return "", errs
 }
 
-func S_FasmGeneration(filename string, outname string) (string, *Error) {
-	_, err := pipelines.Asm(filename, outname)
-	return "", err
+func S_FasmGeneration(filename string, outname string) (string, []*Error) {
+	_, errs := pipelines.Asm(filename, outname)
+	return "", errs
 }
 
-func S_Compile(filename string, outname string) (string, *Error) {
-	return pipelines.Compile(filename, outname)
+func S_Compile(af pipelines.AsmFormat) Stage {
+	return func(filename string, outname string) (string, []*Error) {
+		return pipelines.Compile(filename, outname, af)
+	}
 }
 
-func S_Format(filename string, outname string) (string, *Error) {
-	_, err := pipelines.ModFmt(filename)
-	return "", err
+func S_Format(filename string, outname string) (string, []*Error) {
+	_, errs := pipelines.ModFmt(filename)
+	return "", errs
 }
 
 func Test(file string, st Stage, timeout time.Duration) TestResult {
 	defer recoverIfFatal()
-	expectedErr := extractError(file)
+	expectedErrs := extractErrors(file)
 
-	outfile, err := st(file, "")
+	outfile, errs := st(file, "")
 
-	if err != nil {
-		if err.Code == et.InternalCompilerError {
-			return TestResult{
-				File:    file,
-				Ok:      false,
-				Message: err.Message,
+	if len(errs) > 0 {
+		for _, err := range errs {
+			if err.Code == et.InternalCompilerError {
+				return TestResult{
+					File:    file,
+					Ok:      false,
+					Message: err.Message,
+				}
 			}
 		}
 		// if a module doesn't have entry point, it is a lib
-		if err.Code != et.NoEntryPoint {
-			return compareError(file, err, expectedErr)
-		} else {
+		if len(errs) == 1 && errs[0].Code == et.NoEntryPoint {
 			return TestResult{
 				File: file,
 				Ok:   true,
 			}
 		}
+		return compareErrors(file, errs, expectedErrs)
 	}
 
 	if outfile != "" {
@@ -117,8 +128,51 @@ func Test(file string, st Stage, timeout time.Duration) TestResult {
 	}
 }
 
+/*
+Scripts run in an empty temporary folder, they create the
+files they need there. $MPC is the compiler being tested and
+$MPCFLAGS the flags it was given that matter for compilation.
+*/
+func Script(file string, flags []string, timeout time.Duration) TestResult {
+	mpc, err := os.Executable()
+	if err != nil {
+		return newResult(file, ProcessFileError(err))
+	}
+	script, err := filepath.Abs(file)
+	if err != nil {
+		return newResult(file, ProcessFileError(err))
+	}
+	dir, err := os.MkdirTemp("", "mpc_test_*")
+	if err != nil {
+		return newResult(file, ProcessFileError(err))
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command("sh", script)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "MPC="+mpc, "MPCFLAGS="+strings.Join(flags, " "))
+	output := &strings.Builder{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err = wait(cmd, timeout)
+	if err != nil {
+		return TestResult{
+			File:    file,
+			Ok:      false,
+			Message: strings.TrimSpace(err.Error() + "\n" + output.String()),
+		}
+	}
+	return TestResult{
+		File: file,
+		Ok:   true,
+	}
+}
+
 func execWithTimeout(cmdstr string, t time.Duration) error {
-	cmd := exec.Command(cmdstr)
+	return wait(exec.Command(cmdstr), t)
+}
+
+func wait(cmd *exec.Cmd, t time.Duration) error {
 	if err := cmd.Start(); err != nil {
 		return err
 	}
@@ -132,53 +186,64 @@ func execWithTimeout(cmdstr string, t time.Duration) error {
 
 func recoverIfFatal() {
 	if r := recover(); r != nil {
-		fmt.Printf("\u001b[31m fatal error: %v\t\u001b[0m", r)
+		fmt.Print(Paint(Red, fmt.Sprintf(" fatal error: %v\t", r)))
 	}
 }
 
-func extractError(file string) string {
+func extractErrors(file string) []string {
 	pathlist := strings.Split(file, "/")
 	name := pathlist[len(pathlist)-1]
 	sections := strings.Split(name, ".")
 	if len(sections) < 3 {
-		return ""
+		return nil
 	}
-	err := sections[len(sections)-2]
-	return err
+	// module names may have dots too: mod.1.E045.mp
+	start := len(sections) - 1
+	for start > 1 && isErrCode(sections[start-1]) {
+		start--
+	}
+	return sections[start : len(sections)-1]
 }
 
-func compareError(file string, err *Error, expectedErr string) TestResult {
-	if err != nil && expectedErr == "" {
-		msg := "expected no errors, instead found: " +
-			err.ErrCode()
-		return TestResult{
-			File:    file,
-			Message: msg,
-			Ok:      false,
+func isErrCode(s string) bool {
+	if len(s) < 2 || s[0] != 'E' {
+		return false
+	}
+	for _, r := range s[1:] {
+		if r < '0' || r > '9' {
+			return false
 		}
-	} else if err == nil && expectedErr != "" {
-		msg := "expected error " + expectedErr +
-			", instead found nothing"
+	}
+	return true
+}
+
+func compareErrors(file string, errs []*Error, expectedErrs []string) TestResult {
+	actual := make([]string, len(errs))
+	for i, err := range errs {
+		actual[i] = err.ErrCode()
+	}
+	expected := strings.Join(expectedErrs, ", ")
+	found := strings.Join(actual, ", ")
+	if found == expected {
 		return TestResult{
-			File:    file,
-			Message: msg,
-			Ok:      false,
-		}
-	} else if err != nil && expectedErr != "" {
-		actual := err.ErrCode()
-		if actual != expectedErr {
-			msg := "expected error " + expectedErr +
-				", instead found " + actual
-			return TestResult{
-				File:    file,
-				Message: msg,
-				Ok:      false,
-			}
+			File: file,
+			Ok:   true,
 		}
 	}
+	var msg string
+	if len(expectedErrs) == 0 {
+		msg = "expected no errors, instead found: " + found
+	} else if len(errs) == 0 {
+		msg = "expected error " + expected +
+			", instead found nothing"
+	} else {
+		msg = "expected error " + expected +
+			", instead found " + found
+	}
 	return TestResult{
-		File: file,
-		Ok:   true,
+		File:    file,
+		Message: msg,
+		Ok:      false,
 	}
 }
 
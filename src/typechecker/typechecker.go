@@ -2,6 +2,7 @@ package typechecker
 
 import (
 	. "mpc/core"
+	"mpc/core/cc/cdecl"
 	mod "mpc/core/module"
 	GK "mpc/core/module/globalkind"
 	LxK "mpc/core/module/lexkind"
@@ -10,59 +11,67 @@ import (
 	msg "mpc/messages"
 )
 
-func Check(M *mod.Module) *Error {
+func Check(M *mod.Module) []*Error {
 	M.ResetVisited()
 	err := createStructTypes(M)
 	if err != nil {
-		return err
+		return []*Error{err}
 	}
 	M.ResetVisited()
-	err = checkModule(M)
-	if err != nil {
-		return err
+	errs := checkModule(M)
+	if len(errs) > 0 {
+		return errs
 	}
 	M.ResetVisited()
 	return nil // only for first module
 }
 
-func checkModule(M *mod.Module) *Error {
+func checkModule(M *mod.Module) []*Error {
 	if M.Visited {
 		return nil
 	}
 	M.Visited = true
 	for _, dep := range M.Dependencies {
-		err := checkModule(dep.M)
-		if err != nil {
-			return err
+		errs := checkModule(dep.M)
+		if len(errs) > 0 {
+			return errs
 		}
 	}
 
-	err := checkSymbolsTpl(M)
-	if err != nil {
-		return err
+	// procedure bodies need every signature to be correct
+	errs := checkSymbolsTpl(M)
+	if len(errs) > 0 {
+		return errs
 	}
 
 	for _, sy := range M.Globals {
-		if sy.Kind == GK.Proc && !sy.External {
-			err := checkBlock(M, sy.Proc, sy.N.Leaves[4])
-			if err != nil {
-				return err
-			}
+		if sy.Kind == GK.Proc && !sy.External && !sy.Proc.Extern {
+			errs = append(errs, checkBlock(M, sy.Proc, sy.N.Leaves[4])...)
 		}
 	}
-	return nil
+	return errs
 }
 
-func checkSymbolsTpl(M *mod.Module) *Error {
+// if a symbol fails, anything that depends on it
+// may be missing a type, so we skip those and
+// only report errors from independent symbols
+func checkSymbolsTpl(M *mod.Module) []*Error {
+	errs := []*Error{}
+	failed := map[mod.SyField]mod.Unit{}
 	for _, sy := range M.Globals {
 		if !sy.External {
-			err := checkSymbol(M, mod.FromSymbol(sy))
+			sf := mod.FromSymbol(sy)
+			if sf.Reaches(failed) {
+				continue
+			}
+			err := checkSymbol(M, sf)
 			if err != nil {
-				return err
+				errs = append(errs, err)
+				sf.Reach(failed)
 			}
 		}
 	}
-	return nil
+	return errs
 }
 
 func CheckMain(M *mod.Module) *Error {
@@ -70,12 +79,34 @@ func CheckMain(M *mod.Module) *Error {
 	if !ok {
 		return msg.ProgramWithoutEntry(M)
 	}
-	if p.Proc == nil || !T.IsProc(p.Proc.Type) || !T.T_MainProc.Equals(p.Proc.Type) {
+	if p.Proc == nil || !T.IsProc(p.Proc.Type) || !validMain(p.Proc.Type.Proc) {
 		return msg.InvalidMain(M, p)
 	}
 	return nil
 }
 
+// main[], main[argc:i64], main[argc:i64, argv:ptr]
+// or main[argc:i64, argv:ptr, envp:ptr], each of them
+// may return an i8 or i32 exit code
+func validMain(t *T.ProcType) bool {
+	if t.CC != T.Stack || len(t.Args) > len(T.T_MainArgs) {
+		return false
+	}
+	if len(t.Rets) > 1 || len(t.Rets) == 1 && !validExitCode(t.Rets[0]) {
+		return false
+	}
+	for i, arg := range t.Args {
+		if !T.T_MainArgs[i].Equals(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+func validExitCode(t *T.Type) bool {
+	return T.T_I8.Equals(t) || T.T_I32.Equals(t)
+}
+
 type modSy struct {
 	Mod string
 	Sy  string
@@ -378,6 +409,10 @@ func checkProc(M *mod.Module, proc *mod.Proc) *Error {
 	}
 
 	t := &T.Type{Proc: &T.ProcType{CC: cckind, Args: args, Rets: rets}}
+	err = checkCC(M, cc, t.Proc)
+	if err != nil {
+		return err
+	}
 	proc.Type = t
 	proc.N.Type = t
 	return nil
@@ -537,13 +572,26 @@ func getProcType(M *mod.Module, n *mod.Node) (*T.Type, *Error) {
 		cckind = T.Stack
 	}
 
-	return &T.Type{
+	t := &T.Type{
 		Proc: &T.ProcType{
 			CC:   cckind,
 			Args: argTypes,
 			Rets: retTypes,
 		},
-	}, nil
+	}
+	err := checkCC(M, CC, t.Proc)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// C only has registers for two returns
+func checkCC(M *mod.Module, n *mod.Node, t *T.ProcType) *Error {
+	if t.CC == T.Cdecl && len(t.Rets) > len(cdecl.Rets) {
+		return msg.TooManyReturns(M, n, t.CC, len(cdecl.Rets))
+	}
+	return nil
 }
 
 func getIDType(M *mod.Module, n *mod.Node) (*T.Type, *Error) {
@@ -565,24 +613,24 @@ func getIDType(M *mod.Module, n *mod.Node) (*T.Type, *Error) {
 	return found.Struct.Type, nil
 }
 
-func checkBlock(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
+// statements are checked independently, so that
+// a single block can report more than one error
+func checkBlock(M *mod.Module, proc *mod.Proc, n *mod.Node) []*Error {
+	errs := []*Error{}
 	if n.Lex == LxK.ASM {
 		lines := n.Leaves[0]
 		for _, line := range lines.Leaves {
 			err := checkLine(M, proc, line)
 			if err != nil {
-				return err
+				errs = append(errs, err)
 			}
 		}
-		return nil
+		return errs
 	}
 	for _, code := range n.Leaves {
-		err := checkStatement(M, proc, code)
-		if err != nil {
-			return err
-		}
+		errs = append(errs, checkStatement(M, proc, code)...)
 	}
-	return nil
+	return errs
 }
 
 func checkLine(M *mod.Module, proc *mod.Proc, line *mod.Node) *Error {
@@ -616,7 +664,8 @@ func resOpList(M *mod.Module, proc *mod.Proc, opList *mod.Node) *Error {
 	return nil
 }
 
-func checkStatement(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
+func checkStatement(M *mod.Module, proc *mod.Proc, n *mod.Node) []*Error {
+	var err *Error
 	switch n.Lex {
 	case LxK.EOF:
 		return nil
@@ -627,122 +676,112 @@ func checkStatement(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
 	case LxK.DO:
 		return checkDoWhile(M, proc, n)
 	case LxK.RETURN:
-		return checkReturn(M, proc, n)
+		err = checkReturn(M, proc, n)
 	case LxK.SET:
-		return checkSet(M, proc, n)
+		err = checkSet(M, proc, n)
 	case LxK.EXIT:
-		return checkExit(M, proc, n)
+		err = checkExit(M, proc, n)
+	case LxK.BREAK, LxK.CONTINUE:
+		if proc.Loops == 0 {
+			err = msg.OutsideLoop(M, n)
+		}
 	default:
-		return checkExpr(M, proc, n)
+		err = checkExpr(M, proc, n)
 	}
+	if err != nil {
+		return []*Error{err}
+	}
+	return nil
 }
 
-func checkIf(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
+func checkIf(M *mod.Module, proc *mod.Proc, n *mod.Node) []*Error {
 	exp := n.Leaves[0]
 	block := n.Leaves[1]
 	elseifchain := n.Leaves[2]
 	else_ := n.Leaves[3]
 
-	err := checkExpr(M, proc, exp)
-	if err != nil {
-		return err
-	}
-
-	if !exp.Type.Equals(T.T_Bool) {
-		return msg.ExpectedBool(M, exp)
-	}
-
-	err = checkExprType(M, exp)
-	if err != nil {
-		return err
-	}
+	errs := checkBlock(M, proc, block)
 
-	err = checkBlock(M, proc, block)
+	err := checkIfCond(M, proc, exp)
 	if err != nil {
-		return err
+		errs = append(errs, err)
 	}
 
 	if elseifchain != nil {
-		err = checkElseIfChain(M, proc, elseifchain)
-		if err != nil {
-			return err
-		}
+		errs = append(errs, checkElseIfChain(M, proc, elseifchain)...)
 	}
 
 	if else_ != nil {
-		err = checkElse(M, proc, else_)
-		if err != nil {
-			return err
-		}
+		errs = append(errs, checkElse(M, proc, else_)...)
 	}
 
-	return nil
+	return errs
 }
 
-func checkElse(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
-	err := checkBlock(M, proc, n.Leaves[0])
-	if err != nil {
-		return err
-	}
-	return nil
+func checkElse(M *mod.Module, proc *mod.Proc, n *mod.Node) []*Error {
+	return checkBlock(M, proc, n.Leaves[0])
 }
 
-func checkElseIfChain(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
+func checkElseIfChain(M *mod.Module, proc *mod.Proc, n *mod.Node) []*Error {
+	errs := []*Error{}
 	for _, elseif := range n.Leaves {
-		err := checkElseIf(M, proc, elseif)
-		if err != nil {
-			return err
-		}
+		errs = append(errs, checkElseIf(M, proc, elseif)...)
 	}
-	return nil
+	return errs
 }
 
-func checkElseIf(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
+func checkElseIf(M *mod.Module, proc *mod.Proc, n *mod.Node) []*Error {
+	errs := checkBlock(M, proc, n.Leaves[1])
 	err := checkExpr(M, proc, n.Leaves[0])
-	if err != nil {
-		return err
-	}
-
-	err = checkExprType(M, n.Leaves[0])
-	if err != nil {
-		return err
+	if err == nil {
+		err = checkExprType(M, n.Leaves[0])
 	}
-
-	err = checkBlock(M, proc, n.Leaves[1])
 	if err != nil {
-		return err
+		errs = append(errs, err)
 	}
-	return nil
+	return errs
 }
 
-func checkWhile(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
-	cond := n.Leaves[0]
-	bl := n.Leaves[1]
-	err := checkExpr(M, proc, cond)
+func checkIfCond(M *mod.Module, proc *mod.Proc, exp *mod.Node) *Error {
+	err := checkExpr(M, proc, exp)
 	if err != nil {
 		return err
 	}
 
-	err = checkExprType(M, cond)
-	if err != nil {
-		return err
+	if !exp.Type.Equals(T.T_Bool) {
+		return msg.ExpectedBool(M, exp)
 	}
 
-	if !cond.Type.Equals(T.T_Bool) {
-		return msg.ExpectedBool(M, cond)
-	}
+	return checkExprType(M, exp)
+}
 
-	err = checkBlock(M, proc, bl)
+func checkWhile(M *mod.Module, proc *mod.Proc, n *mod.Node) []*Error {
+	cond := n.Leaves[0]
+	bl := n.Leaves[1]
+	proc.Loops++
+	errs := checkBlock(M, proc, bl)
+	proc.Loops--
+	err := checkCond(M, proc, cond)
 	if err != nil {
-		return err
+		errs = append(errs, err)
 	}
-	return nil
+	return errs
 }
 
-func checkDoWhile(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
+func checkDoWhile(M *mod.Module, proc *mod.Proc, n *mod.Node) []*Error {
 	cond := n.Leaves[1]
 	bl := n.Leaves[0]
+	proc.Loops++
+	errs := checkBlock(M, proc, bl)
+	proc.Loops--
+	err := checkCond(M, proc, cond)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
 
+func checkCond(M *mod.Module, proc *mod.Proc, cond *mod.Node) *Error {
 	err := checkExpr(M, proc, cond)
 	if err != nil {
 		return err
@@ -756,11 +795,6 @@ func checkDoWhile(M *mod.Module, proc *mod.Proc, n *mod.Node) *Error {
 	if !cond.Type.Equals(T.T_Bool) {
 		return msg.ExpectedBool(M, cond)
 	}
-
-	err = checkBlock(M, proc, bl)
-	if err != nil {
-		return err
-	}
 	return nil
 }
 
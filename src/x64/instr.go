@@ -0,0 +1,523 @@
+package x64
+
+import (
+	"fmt"
+
+	"mpc/core/asm"
+	ik "mpc/core/asm/instrkind"
+)
+
+// returns true if a jump grew from rel8 to rel32
+func (e *encoder) instr(index int, instr asm.Instr) (bool, error) {
+	ops := make([]operand, len(instr.Operands))
+	for i, op := range instr.Operands {
+		var err error
+		ops[i], err = e.operand(op)
+		if err != nil {
+			return false, err
+		}
+	}
+	e.findRelocs(instr.Kind, ops)
+	switch instr.Kind {
+	case ik.Nop:
+		return false, e.plain(ops, 0x90)
+	case ik.Ret:
+		return false, e.plain(ops, 0xC3)
+	case ik.Cdq:
+		return false, e.plain(ops, 0x99)
+	case ik.Cqo:
+		return false, e.plain(ops, 0x48, 0x99)
+	case ik.Syscall:
+		return false, e.plain(ops, 0x0F, 0x05)
+	case ik.Mov:
+		return false, e.mov(ops)
+	case ik.Movsx:
+		return false, e.movx(ops, 0xBE)
+	case ik.Movzx:
+		return false, e.movx(ops, 0xB6)
+	case ik.Movsxd:
+		return false, e.movsxd(ops)
+	case ik.Add:
+		return false, e.alu(ops, 0)
+	case ik.Or:
+		return false, e.alu(ops, 1)
+	case ik.And:
+		return false, e.alu(ops, 4)
+	case ik.Sub:
+		return false, e.alu(ops, 5)
+	case ik.Xor:
+		return false, e.alu(ops, 6)
+	case ik.Cmp:
+		return false, e.alu(ops, 7)
+	case ik.Not:
+		return false, e.unary(ops, 2)
+	case ik.Neg:
+		return false, e.unary(ops, 3)
+	case ik.Mul:
+		return false, e.unary(ops, 4)
+	case ik.Div:
+		return false, e.unary(ops, 6)
+	case ik.IDiv:
+		return false, e.unary(ops, 7)
+	case ik.IMul:
+		return false, e.imul(ops)
+	case ik.Shl, ik.Sal:
+		return false, e.shift(ops, 4)
+	case ik.Shr:
+		return false, e.shift(ops, 5)
+	case ik.Sar:
+		return false, e.shift(ops, 7)
+	case ik.Push:
+		return false, e.push(ops)
+	case ik.Pop:
+		return false, e.pop(ops)
+	case ik.Call:
+		return false, e.call(ops)
+	case ik.Jmp:
+		return e.jump(index, ops, []byte{0xEB}, []byte{0xE9}, 4)
+	case ik.Je, ik.Jne, ik.Jl, ik.Jle, ik.Jg, ik.Jge,
+		ik.Jb, ik.Jbe, ik.Ja, ik.Jae:
+		cc := condition(instr.Kind)
+		return e.jump(index, ops, []byte{0x70 | cc}, []byte{0x0F, 0x80 | cc}, -1)
+	case ik.Sete, ik.Setne, ik.Setg, ik.Setge, ik.Setl,
+		ik.Setle, ik.Seta, ik.Setae, ik.Setb, ik.Setbe:
+		return false, e.setcc(ops, condition(instr.Kind))
+	}
+	return false, fmt.Errorf("unsupported instruction")
+}
+
+func condition(k ik.InstrKind) byte {
+	switch k {
+	case ik.Jb, ik.Setb:
+		return 0x2
+	case ik.Jae, ik.Setae:
+		return 0x3
+	case ik.Je, ik.Sete:
+		return 0x4
+	case ik.Jne, ik.Setne:
+		return 0x5
+	case ik.Jbe, ik.Setbe:
+		return 0x6
+	case ik.Ja, ik.Seta:
+		return 0x7
+	case ik.Jl, ik.Setl:
+		return 0xC
+	case ik.Jge, ik.Setge:
+		return 0xD
+	case ik.Jle, ik.Setle:
+		return 0xE
+	case ik.Jg, ik.Setg:
+		return 0xF
+	}
+	panic("unreachable 120")
+}
+
+func arity(ops []operand, n int) error {
+	if len(ops) != n {
+		return fmt.Errorf("expected %v operands, found %v", n, len(ops))
+	}
+	return nil
+}
+
+func (e *encoder) plain(ops []operand, code ...byte) error {
+	if err := arity(ops, 0); err != nil {
+		return err
+	}
+	e.emit(&inst{Opcode: code})
+	return nil
+}
+
+func (e *encoder) mov(ops []operand) error {
+	if err := arity(ops, 2); err != nil {
+		return err
+	}
+	dest, src := ops[0], ops[1]
+	size, err := operandSize(dest, src)
+	if err != nil {
+		return err
+	}
+	in := &inst{}
+	in.size(size)
+	switch {
+	case dest.Kind == opReg && src.Kind == opReg:
+		in.Opcode = []byte{byteOr(size, 0x88, 0x89)}
+		err = in.rm(in.reg(src.Reg, src.Size), dest)
+	case dest.Kind == opReg && src.Kind == opMem:
+		in.Opcode = []byte{byteOr(size, 0x8A, 0x8B)}
+		err = in.rm(in.reg(dest.Reg, dest.Size), src)
+	case dest.Kind == opMem && src.Kind == opReg:
+		in.Opcode = []byte{byteOr(size, 0x88, 0x89)}
+		err = in.rm(in.reg(src.Reg, src.Size), dest)
+	case dest.Kind == opReg && src.Kind == opImm:
+		if size == asm.QuadWord && !src.Label && !fits32(src.Imm) {
+			// mov r64, imm64
+			in.Opcode = []byte{0xB8 | byte(dest.Reg&7)}
+			in.B = dest.Reg >= 8
+			in.Imm = le64(src.Imm)
+			break
+		}
+		if size == asm.QuadWord {
+			in.Opcode = []byte{0xC7}
+			err = in.rm(0, dest)
+		} else {
+			in.Opcode = []byte{byteOr(size, 0xB0, 0xB8) | byte(dest.Reg&7)}
+			in.B = dest.Reg >= 8
+			in.Rex = isByteRex(dest.Reg, dest.Size)
+		}
+		if err == nil {
+			in.Imm, err = immOf(src.Imm, size)
+		}
+	case dest.Kind == opMem && src.Kind == opImm:
+		in.Opcode = []byte{byteOr(size, 0xC6, 0xC7)}
+		err = in.rm(0, dest)
+		if err == nil {
+			in.Imm, err = immOf(src.Imm, size)
+		}
+	default:
+		err = fmt.Errorf("invalid operands")
+	}
+	if err != nil {
+		return err
+	}
+	e.emit(in)
+	return nil
+}
+
+func byteOr(size asm.TypeSize, b, other byte) byte {
+	if size == asm.Byte {
+		return b
+	}
+	return other
+}
+
+// movsx and movzx, the source decides the opcode
+func (e *encoder) movx(ops []operand, opcode byte) error {
+	if err := arity(ops, 2); err != nil {
+		return err
+	}
+	dest, src := ops[0], ops[1]
+	if dest.Kind != opReg || src.Kind == opImm {
+		return fmt.Errorf("invalid operands")
+	}
+	in := &inst{}
+	in.size(dest.Size)
+	switch src.Size {
+	case asm.Byte:
+	case asm.Word:
+		opcode++
+	default:
+		return fmt.Errorf("invalid source size")
+	}
+	in.Opcode = []byte{0x0F, opcode}
+	err := in.rm(in.reg(dest.Reg, dest.Size), src)
+	if err != nil {
+		return err
+	}
+	e.emit(in)
+	return nil
+}
+
+func (e *encoder) movsxd(ops []operand) error {
+	if err := arity(ops, 2); err != nil {
+		return err
+	}
+	dest, src := ops[0], ops[1]
+	if dest.Kind != opReg || src.Kind == opImm {
+		return fmt.Errorf("invalid operands")
+	}
+	in := &inst{W: true, Opcode: []byte{0x63}}
+	err := in.rm(in.reg(dest.Reg, dest.Size), src)
+	if err != nil {
+		return err
+	}
+	e.emit(in)
+	return nil
+}
+
+// add, or, and, sub, xor and cmp share the same encodings,
+// n is both the opcode extension and the row in the opcode table
+func (e *encoder) alu(ops []operand, n byte) error {
+	if err := arity(ops, 2); err != nil {
+		return err
+	}
+	dest, src := ops[0], ops[1]
+	size, err := operandSize(dest, src)
+	if err != nil {
+		return err
+	}
+	in := &inst{}
+	in.size(size)
+	switch {
+	case dest.Kind != opImm && src.Kind == opReg:
+		in.Opcode = []byte{n<<3 | byteOr(size, 0, 1)}
+		err = in.rm(in.reg(src.Reg, src.Size), dest)
+	case dest.Kind == opReg && src.Kind == opMem:
+		in.Opcode = []byte{n<<3 | byteOr(size, 2, 3)}
+		err = in.rm(in.reg(dest.Reg, dest.Size), src)
+	case dest.Kind != opImm && src.Kind == opImm:
+		accumulator := dest.Kind == opReg && dest.Reg == 0
+		switch {
+		case size == asm.Byte && accumulator:
+			in.Opcode = []byte{n<<3 | 4}
+			in.Imm = []byte{byte(src.Imm)}
+		case size == asm.Byte:
+			in.Opcode = []byte{0x80}
+			err = in.rm(n, dest)
+			in.Imm = []byte{byte(src.Imm)}
+		case !src.Label && fits8(src.Imm):
+			in.Opcode = []byte{0x83}
+			err = in.rm(n, dest)
+			in.Imm = []byte{byte(src.Imm)}
+		case accumulator:
+			in.Opcode = []byte{n<<3 | 5}
+			in.Imm, err = immOf(src.Imm, size)
+		default:
+			in.Opcode = []byte{0x81}
+			err = in.rm(n, dest)
+			if err == nil {
+				in.Imm, err = immOf(src.Imm, size)
+			}
+		}
+	default:
+		err = fmt.Errorf("invalid operands")
+	}
+	if err != nil {
+		return err
+	}
+	e.emit(in)
+	return nil
+}
+
+// not, neg, mul, div, idiv and single operand imul
+func (e *encoder) unary(ops []operand, n byte) error {
+	if err := arity(ops, 1); err != nil {
+		return err
+	}
+	op := ops[0]
+	if op.Kind == opImm {
+		return fmt.Errorf("invalid operands")
+	}
+	in := &inst{}
+	in.size(op.Size)
+	in.Opcode = []byte{byteOr(op.Size, 0xF6, 0xF7)}
+	err := in.rm(n, op)
+	if err != nil {
+		return err
+	}
+	e.emit(in)
+	return nil
+}
+
+func (e *encoder) imul(ops []operand) error {
+	if len(ops) == 1 {
+		return e.unary(ops, 5)
+	}
+	if len(ops) == 2 {
+		// imul r, imm is imul r, r, imm
+		if ops[1].Kind == opImm {
+			ops = []operand{ops[0], ops[0], ops[1]}
+		} else {
+			dest, src := ops[0], ops[1]
+			if dest.Kind != opReg {
+				return fmt.Errorf("invalid operands")
+			}
+			in := &inst{Opcode: []byte{0x0F, 0xAF}}
+			in.size(dest.Size)
+			err := in.rm(in.reg(dest.Reg, dest.Size), src)
+			if err != nil {
+				return err
+			}
+			e.emit(in)
+			return nil
+		}
+	}
+	if err := arity(ops, 3); err != nil {
+		return err
+	}
+	dest, src, imm := ops[0], ops[1], ops[2]
+	if dest.Kind != opReg || src.Kind == opImm || imm.Kind != opImm {
+		return fmt.Errorf("invalid operands")
+	}
+	in := &inst{}
+	in.size(dest.Size)
+	err := in.rm(in.reg(dest.Reg, dest.Size), src)
+	if err != nil {
+		return err
+	}
+	if !imm.Label && fits8(imm.Imm) {
+		in.Opcode = []byte{0x6B}
+		in.Imm = []byte{byte(imm.Imm)}
+	} else {
+		in.Opcode = []byte{0x69}
+		in.Imm, err = immOf(imm.Imm, dest.Size)
+		if err != nil {
+			return err
+		}
+	}
+	e.emit(in)
+	return nil
+}
+
+func (e *encoder) shift(ops []operand, n byte) error {
+	if err := arity(ops, 2); err != nil {
+		return err
+	}
+	dest, count := ops[0], ops[1]
+	if dest.Kind == opImm {
+		return fmt.Errorf("invalid operands")
+	}
+	in := &inst{}
+	in.size(dest.Size)
+	switch {
+	case count.Kind == opImm && count.Imm == 1:
+		in.Opcode = []byte{byteOr(dest.Size, 0xD0, 0xD1)}
+	case count.Kind == opImm:
+		in.Opcode = []byte{byteOr(dest.Size, 0xC0, 0xC1)}
+		in.Imm = []byte{byte(count.Imm)}
+	case count.Kind == opReg && count.Reg == 1 && count.Size == asm.Byte:
+		in.Opcode = []byte{byteOr(dest.Size, 0xD2, 0xD3)}
+	default:
+		return fmt.Errorf("shift count must be an immediate or cl")
+	}
+	err := in.rm(n, dest)
+	if err != nil {
+		return err
+	}
+	e.emit(in)
+	return nil
+}
+
+func (e *encoder) push(ops []operand) error {
+	if err := arity(ops, 1); err != nil {
+		return err
+	}
+	op := ops[0]
+	in := &inst{}
+	switch op.Kind {
+	case opReg:
+		in.Opcode = []byte{0x50 | byte(op.Reg&7)}
+		in.B = op.Reg >= 8
+	case opImm:
+		if !op.Label && fits8(op.Imm) {
+			in.Opcode = []byte{0x6A}
+			in.Imm = []byte{byte(op.Imm)}
+		} else {
+			in.Opcode = []byte{0x68}
+			var err error
+			in.Imm, err = immOf(op.Imm, asm.QuadWord)
+			if err != nil {
+				return err
+			}
+		}
+	case opMem:
+		in.Opcode = []byte{0xFF}
+		err := in.rm(6, op)
+		if err != nil {
+			return err
+		}
+	}
+	e.emit(in)
+	return nil
+}
+
+func (e *encoder) pop(ops []operand) error {
+	if err := arity(ops, 1); err != nil {
+		return err
+	}
+	op := ops[0]
+	in := &inst{}
+	switch op.Kind {
+	case opReg:
+		in.Opcode = []byte{0x58 | byte(op.Reg&7)}
+		in.B = op.Reg >= 8
+	case opMem:
+		in.Opcode = []byte{0x8F}
+		err := in.rm(0, op)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid operands")
+	}
+	e.emit(in)
+	return nil
+}
+
+func (e *encoder) call(ops []operand) error {
+	if err := arity(ops, 1); err != nil {
+		return err
+	}
+	op := ops[0]
+	if op.Kind == opImm {
+		return e.rel32([]byte{0xE8}, op.Imm)
+	}
+	in := &inst{Opcode: []byte{0xFF}}
+	err := in.rm(2, op)
+	if err != nil {
+		return err
+	}
+	e.emit(in)
+	return nil
+}
+
+func (e *encoder) rel32(opcode []byte, target int64) error {
+	end := int64(e.addr()) + int64(len(opcode)) + 4
+	disp := target - end
+	if e.check && !fits32(disp) {
+		return fmt.Errorf("jump too far")
+	}
+	e.emit(&inst{Opcode: opcode, Imm: le32(disp)})
+	return nil
+}
+
+// ext is the opcode extension for the indirect form, -1 if there's none
+func (e *encoder) jump(index int, ops []operand, short, near []byte, ext int) (bool, error) {
+	if err := arity(ops, 1); err != nil {
+		return false, err
+	}
+	op := ops[0]
+	if op.Kind != opImm {
+		if ext == -1 {
+			return false, fmt.Errorf("invalid operands")
+		}
+		in := &inst{Opcode: []byte{0xFF}}
+		err := in.rm(byte(ext), op)
+		if err != nil {
+			return false, err
+		}
+		e.emit(in)
+		return false, nil
+	}
+	if e.external(op) {
+		return false, e.rel32(near, op.Imm)
+	}
+	grew := false
+	if !e.long[index] {
+		end := int64(e.addr()) + int64(len(short)) + 1
+		disp := op.Imm - end
+		if fits8(disp) || !e.check {
+			e.emit(&inst{Opcode: short, Imm: []byte{byte(int8(disp))}})
+			return false, nil
+		}
+		e.long[index] = true
+		grew = true
+	}
+	return grew, e.rel32(near, op.Imm)
+}
+
+func (e *encoder) setcc(ops []operand, cc byte) error {
+	if err := arity(ops, 1); err != nil {
+		return err
+	}
+	op := ops[0]
+	if op.Kind == opImm || op.Size != asm.Byte {
+		return fmt.Errorf("invalid operands")
+	}
+	in := &inst{Opcode: []byte{0x0F, 0x90 | cc}}
+	err := in.rm(0, op)
+	if err != nil {
+		return err
+	}
+	e.emit(in)
+	return nil
+}
@@ -0,0 +1,135 @@
+package x64
+
+import (
+	"mpc/core/asm"
+	ik "mpc/core/asm/instrkind"
+)
+
+type RelocKind int
+
+const (
+	Abs32S RelocKind = iota // absolute, sign extended from 32 bits
+	PC32                    // relative to the field
+	PLT32                   // like PC32, for calls and jumps
+)
+
+// a field in the code that is only known after linking,
+// the addend is relative to the symbol, as in ELF's rela
+type Reloc struct {
+	Offset uint64
+	Symbol string
+	Kind   RelocKind
+	Addend int64
+}
+
+type field int
+
+const (
+	immField  field = iota
+	dispField       // always the last 4 bytes of the ModRM
+)
+
+type pendingReloc struct {
+	Field  field
+	Reloc  Reloc
+	MinImm bool // pc relative fields end before the immediate
+}
+
+/*
+Like Encode, but the code is not placed anywhere: every reference to a
+label not defined by the lines, and every absolute reference to one that
+is, becomes a relocation. Relative references to labels in the lines
+are resolved, since the code moves as a whole.
+*/
+func EncodeObject(lines []asm.Line) ([]byte, map[string]uint64, []Reloc, error) {
+	e := &encoder{
+		symbols:     map[string]uint64{},
+		code:        map[string]uint64{},
+		long:        map[int]bool{},
+		relocatable: true,
+		defined:     map[string]bool{},
+	}
+	for _, line := range lines {
+		if line.IsLabel {
+			if !isLocal(line.Label) {
+				e.scope = line.Label
+			}
+			e.defined[e.qualify(line.Label)] = true
+		}
+	}
+	_, err := e.pass(lines, false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for {
+		changed, err := e.pass(lines, true)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !changed {
+			return e.buff, e.code, e.relocs, nil
+		}
+	}
+}
+
+func (e *encoder) external(op operand) bool {
+	return e.relocatable && op.Sym != "" && !e.defined[op.Sym]
+}
+
+func isBranch(k ik.InstrKind) bool {
+	switch k {
+	case ik.Call, ik.Jmp, ik.Je, ik.Jne, ik.Jl, ik.Jle, ik.Jg, ik.Jge,
+		ik.Jb, ik.Jbe, ik.Ja, ik.Jae:
+		return true
+	}
+	return false
+}
+
+func (e *encoder) findRelocs(k ik.InstrKind, ops []operand) {
+	e.pending = e.pending[:0]
+	if !e.relocatable {
+		return
+	}
+	for _, op := range ops {
+		if op.Sym == "" {
+			continue
+		}
+		var p pendingReloc
+		switch {
+		case op.Kind == opImm && isBranch(k):
+			if !e.external(op) {
+				continue
+			}
+			p = pendingReloc{Field: immField, Reloc: Reloc{Kind: PLT32, Addend: -4}}
+		case op.Kind == opImm:
+			p = pendingReloc{Field: immField, Reloc: Reloc{Kind: Abs32S}}
+		case op.Rip:
+			if !e.external(op) {
+				continue
+			}
+			addend := op.Disp - op.SymAddr - 4
+			p = pendingReloc{Field: dispField, Reloc: Reloc{Kind: PC32, Addend: addend}, MinImm: true}
+		default:
+			p = pendingReloc{Field: dispField, Reloc: Reloc{Kind: Abs32S, Addend: op.Disp - op.SymAddr}}
+		}
+		p.Reloc.Symbol = op.Sym
+		e.pending = append(e.pending, p)
+	}
+}
+
+func (e *encoder) addRelocs(in *inst, modrmAt int) {
+	for _, p := range e.pending {
+		r := p.Reloc
+		switch p.Field {
+		case immField:
+			r.Offset = uint64(modrmAt + len(in.ModRM))
+		case dispField:
+			r.Offset = uint64(modrmAt + len(in.ModRM) - 4)
+		}
+		if p.MinImm {
+			r.Addend -= int64(len(in.Imm))
+		}
+		e.relocs = append(e.relocs, r)
+	}
+	e.pending = e.pending[:0]
+}
@@ -0,0 +1,479 @@
+/*
+This package encodes asm.Program lines into x86-64 machine code,
+it covers the same instructions the fasm backend is able to print.
+
+Whenever there's more than one encoding we try to pick the one
+fasm picks, so that both outputs can be compared: short jumps
+are relaxed into near jumps only when needed, immediates use the
+8 bit forms when they fit, and so on.
+*/
+package x64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"mpc/core/asm"
+	ik "mpc/core/asm/instrkind"
+)
+
+/*
+Encodes the lines as if they were loaded at base.
+Symbols should contain the address of every label not defined
+by the lines themselves (ie, data). Returns the code and the address
+of every label defined in the lines, with local labels (.L0) fully
+qualified by their parent label (main_main.L0).
+*/
+func Encode(lines []asm.Line, base uint64, symbols map[string]uint64) ([]byte, map[string]uint64, error) {
+	e := &encoder{
+		base:    base,
+		symbols: symbols,
+		code:    map[string]uint64{},
+		long:    map[int]bool{},
+	}
+	// first pass only finds out where labels are,
+	// assuming every jump is short
+	_, err := e.pass(lines, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		changed, err := e.pass(lines, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !changed {
+			return e.buff, e.code, nil
+		}
+	}
+}
+
+type encoder struct {
+	base    uint64
+	symbols map[string]uint64
+	code    map[string]uint64 // labels from the previous pass
+	long    map[int]bool      // jumps that do not fit in a rel8
+
+	buff  []byte
+	scope string
+	check bool
+
+	// only for objects
+	relocatable bool
+	defined     map[string]bool // labels defined by the lines
+	relocs      []Reloc
+	pending     []pendingReloc // of the instruction being encoded
+}
+
+func (e *encoder) addr() uint64 {
+	return e.base + uint64(len(e.buff))
+}
+
+func (e *encoder) pass(lines []asm.Line, check bool) (bool, error) {
+	e.buff = e.buff[:0]
+	e.scope = ""
+	e.check = check
+	e.relocs = nil
+	changed := false
+	labels := map[string]uint64{}
+	for i, line := range lines {
+		if line.IsLabel {
+			name := line.Label
+			if isLocal(name) {
+				name = e.scope + name
+			} else {
+				e.scope = name
+			}
+			if _, ok := labels[name]; ok {
+				return false, fmt.Errorf("label %v defined twice", name)
+			}
+			labels[name] = e.addr()
+			if e.code[name] != labels[name] {
+				changed = true
+			}
+			continue
+		}
+		grew, err := e.instr(i, line.Instr)
+		if err != nil {
+			return false, fmt.Errorf("%v: %v", lineString(line), err)
+		}
+		changed = changed || grew
+	}
+	e.code = labels
+	return changed, nil
+}
+
+func isLocal(label string) bool {
+	return strings.HasPrefix(label, ".")
+}
+
+func (e *encoder) qualify(name string) string {
+	if isLocal(name) {
+		return e.scope + name
+	}
+	return name
+}
+
+func (e *encoder) label(name string) (uint64, error) {
+	name = e.qualify(name)
+	if addr, ok := e.code[name]; ok {
+		return addr, nil
+	}
+	if addr, ok := e.symbols[name]; ok {
+		return addr, nil
+	}
+	if !e.check || e.relocatable {
+		return 0, nil // forward reference in the first pass
+	}
+	return 0, fmt.Errorf("undefined label %v", name)
+}
+
+type opKind int
+
+const (
+	opReg opKind = iota
+	opMem
+	opImm
+)
+
+type operand struct {
+	Kind opKind
+	Size asm.TypeSize
+
+	Reg int
+
+	// memory: [Base + Index + Disp] or [rip + Disp]
+	Base   int // -1 if absent
+	Index  int // -1 if absent
+	Disp   int64
+	Rip    bool // Disp is the absolute target
+	RipRaw bool // Disp is relative to the next instruction: [rip + n]
+	Disp32 bool // labels always use 32 bit displacements
+
+	Imm   int64
+	Label bool // labels always use 32 bit immediates
+
+	Sym     string // the label, fully qualified
+	SymAddr int64  // and its address, as far as we know
+}
+
+const rip = 16
+
+func (e *encoder) operand(op asm.Operand) (operand, error) {
+	switch op.Kind {
+	case asm.Simple:
+		switch op.A.Kind {
+		case asm.Reg:
+			if op.A.Reg.ID < 0 || op.A.Reg.ID > 15 {
+				return operand{}, fmt.Errorf("invalid register %v", op.A.Reg)
+			}
+			return operand{Kind: opReg, Reg: op.A.Reg.ID, Size: op.A.Reg.TypeSize}, nil
+		case asm.Const:
+			imm, err := toInt64(op.A.Const)
+			return operand{Kind: opImm, Imm: imm}, err
+		case asm.Label:
+			addr, err := e.label(op.A.Label)
+			return operand{
+				Kind: opImm, Imm: int64(addr), Label: true,
+				Sym: e.qualify(op.A.Label), SymAddr: int64(addr),
+			}, err
+		}
+	case asm.Addressing:
+		return e.address(op)
+	}
+	return operand{}, fmt.Errorf("invalid operand")
+}
+
+func (e *encoder) address(op asm.Operand) (operand, error) {
+	out := operand{Kind: opMem, Size: op.TypeSize, Base: -1, Index: -1}
+	switch op.A.Kind {
+	case asm.Reg:
+		if op.A.Reg.ID == rip {
+			out.Rip = true
+			out.RipRaw = true
+		} else {
+			out.Base = op.A.Reg.ID
+		}
+	case asm.Label:
+		addr, err := e.label(op.A.Label)
+		if err != nil {
+			return out, err
+		}
+		out.Rip = true
+		out.Disp = int64(addr)
+		out.Sym, out.SymAddr = e.qualify(op.A.Label), int64(addr)
+	case asm.Const:
+		disp, err := toInt64(op.A.Const)
+		if err != nil {
+			return out, err
+		}
+		out.Disp = disp
+		out.Disp32 = true
+	default:
+		return out, fmt.Errorf("invalid address")
+	}
+	switch op.B.Kind {
+	case asm.InvalidValueKind:
+	case asm.Const:
+		disp, err := toInt64(op.B.Const)
+		if err != nil {
+			return out, err
+		}
+		out.Disp += disp
+	case asm.Reg:
+		if out.Rip || out.Base == -1 || op.B.Reg.ID == 4 || op.B.Reg.ID > 15 {
+			return out, fmt.Errorf("invalid index register")
+		}
+		out.Index = op.B.Reg.ID
+	case asm.Label:
+		if out.Rip {
+			return out, fmt.Errorf("invalid address")
+		}
+		addr, err := e.label(op.B.Label)
+		if err != nil {
+			return out, err
+		}
+		out.Disp += int64(addr)
+		out.Disp32 = true
+		out.Sym, out.SymAddr = e.qualify(op.B.Label), int64(addr)
+	}
+	return out, nil
+}
+
+func toInt64(n *big.Int) (int64, error) {
+	if n == nil {
+		return 0, fmt.Errorf("nil constant")
+	}
+	if n.IsInt64() {
+		return n.Int64(), nil
+	}
+	if n.IsUint64() {
+		return int64(n.Uint64()), nil
+	}
+	return 0, fmt.Errorf("constant %v does not fit in 64 bits", n)
+}
+
+func fits8(n int64) bool {
+	return n >= -128 && n <= 127
+}
+
+func fits32(n int64) bool {
+	return n >= -(1<<31) && n <= (1<<31)-1
+}
+
+func lineString(line asm.Line) string {
+	ops := make([]string, len(line.Instr.Operands))
+	for i, op := range line.Instr.Operands {
+		ops[i] = opString(op)
+	}
+	return ik.KindToString(line.Instr.Kind) + " " + strings.Join(ops, ", ")
+}
+
+func opString(op asm.Operand) string {
+	str := func(v asm.Value) string {
+		switch v.Kind {
+		case asm.Reg:
+			return v.Reg.String()
+		case asm.Const:
+			return v.Const.String()
+		case asm.Label:
+			return v.Label
+		}
+		return "?"
+	}
+	if op.Kind == asm.Addressing {
+		if op.B.Kind != asm.InvalidValueKind {
+			return op.TypeSize.String() + "[" + str(op.A) + " + " + str(op.B) + "]"
+		}
+		return op.TypeSize.String() + "[" + str(op.A) + "]"
+	}
+	return str(op.A)
+}
+
+// an instruction being encoded, prefixes are computed from the flags
+type inst struct {
+	Word    bool // 0x66
+	W, R, X bool
+	B       bool
+	Rex     bool // needed for spl, bpl, sil and dil
+
+	Opcode []byte
+	ModRM  []byte
+	Imm    []byte
+
+	Rip       bool
+	RipTarget int64
+	RipAt     int // offset of the disp32 inside ModRM
+}
+
+func (e *encoder) emit(in *inst) {
+	if in.Word {
+		e.buff = append(e.buff, 0x66)
+	}
+	if in.W || in.R || in.X || in.B || in.Rex {
+		rex := byte(0x40)
+		if in.W {
+			rex |= 8
+		}
+		if in.R {
+			rex |= 4
+		}
+		if in.X {
+			rex |= 2
+		}
+		if in.B {
+			rex |= 1
+		}
+		e.buff = append(e.buff, rex)
+	}
+	e.buff = append(e.buff, in.Opcode...)
+	modrmAt := len(e.buff)
+	e.buff = append(e.buff, in.ModRM...)
+	e.buff = append(e.buff, in.Imm...)
+	e.addRelocs(in, modrmAt)
+	if in.Rip {
+		end := e.base + uint64(len(e.buff))
+		disp := in.RipTarget - int64(end)
+		binary.LittleEndian.PutUint32(e.buff[modrmAt+in.RipAt:], uint32(int32(disp)))
+	}
+}
+
+func isByteRex(reg int, size asm.TypeSize) bool {
+	return size == asm.Byte && reg >= 4 && reg <= 7
+}
+
+func (in *inst) size(s asm.TypeSize) {
+	switch s {
+	case asm.Word:
+		in.Word = true
+	case asm.QuadWord:
+		in.W = true
+	}
+}
+
+// sets the reg field of the ModRM byte, either a register or an opcode extension
+func (in *inst) reg(r int, size asm.TypeSize) byte {
+	if r >= 8 {
+		in.R = true
+	}
+	if isByteRex(r, size) {
+		in.Rex = true
+	}
+	return byte(r & 7)
+}
+
+func (in *inst) rm(regField byte, op operand) error {
+	switch op.Kind {
+	case opReg:
+		if op.Reg >= 8 {
+			in.B = true
+		}
+		if isByteRex(op.Reg, op.Size) {
+			in.Rex = true
+		}
+		in.ModRM = []byte{0xC0 | regField<<3 | byte(op.Reg&7)}
+		return nil
+	case opMem:
+		return in.mem(regField, op)
+	}
+	return fmt.Errorf("expected register or memory operand")
+}
+
+func (in *inst) mem(regField byte, op operand) error {
+	if op.RipRaw {
+		in.ModRM = append([]byte{regField<<3 | 5}, le32(op.Disp)...)
+		return nil
+	}
+	if op.Rip {
+		in.ModRM = []byte{regField<<3 | 5, 0, 0, 0, 0}
+		in.Rip = true
+		in.RipTarget = op.Disp
+		in.RipAt = 1
+		return nil
+	}
+	if !fits32(op.Disp) {
+		return fmt.Errorf("displacement %v does not fit in 32 bits", op.Disp)
+	}
+	disp32 := le32(op.Disp)
+	if op.Base == -1 { // absolute address
+		in.ModRM = append([]byte{regField<<3 | 4, 0x25}, disp32...)
+		return nil
+	}
+	base := byte(op.Base & 7)
+	if op.Base >= 8 {
+		in.B = true
+	}
+	var mod byte
+	var disp []byte
+	switch {
+	case op.Disp32:
+		mod, disp = 0x80, disp32
+	case op.Disp == 0 && base != 5: // rbp and r13 always need a displacement
+		mod, disp = 0x00, nil
+	case fits8(op.Disp):
+		mod, disp = 0x40, []byte{byte(int8(op.Disp))}
+	default:
+		mod, disp = 0x80, disp32
+	}
+	if op.Index != -1 {
+		if op.Index >= 8 {
+			in.X = true
+		}
+		sib := byte(op.Index&7)<<3 | base
+		in.ModRM = append([]byte{mod | regField<<3 | 4, sib}, disp...)
+		return nil
+	}
+	if base == 4 { // rsp and r12 always need a SIB
+		in.ModRM = append([]byte{mod | regField<<3 | 4, 0x24}, disp...)
+		return nil
+	}
+	in.ModRM = append([]byte{mod | regField<<3 | base}, disp...)
+	return nil
+}
+
+func le16(n int64) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, uint16(n))
+	return b
+}
+
+func le32(n int64) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(n))
+	return b
+}
+
+func le64(n int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+// immediate of the given size, qwords are sign extended from 32 bits
+func immOf(n int64, s asm.TypeSize) ([]byte, error) {
+	switch s {
+	case asm.Byte:
+		return []byte{byte(n)}, nil
+	case asm.Word:
+		return le16(n), nil
+	case asm.DoubleWord:
+		return le32(n), nil
+	case asm.QuadWord:
+		if !fits32(n) {
+			return nil, fmt.Errorf("immediate %v does not fit in 32 bits", n)
+		}
+		return le32(n), nil
+	}
+	return nil, fmt.Errorf("invalid operand size")
+}
+
+func operandSize(ops ...operand) (asm.TypeSize, error) {
+	for _, op := range ops {
+		if op.Kind != opImm && op.Size != asm.InvalidTypeSize {
+			return op.Size, nil
+		}
+	}
+	return asm.InvalidTypeSize, fmt.Errorf("unknown operand size")
+}
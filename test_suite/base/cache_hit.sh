@@ -0,0 +1,36 @@
+# the second build of a program takes its dependency from the
+# build cache. The cache is our own, so that other runs don't count
+set -e
+
+case "$MPCFLAGS" in
+*-nocache*) exit 0 ;; # nothing to hit
+esac
+export XDG_CACHE_HOME="$PWD/cache"
+
+cat > lib.mp <<'END'
+export Double
+
+proc Double[a:i64] i64
+begin
+    return a * 2l;
+end
+END
+
+cat > main.mp <<'END'
+import lib
+
+proc main
+begin
+    if lib::Double[21l] != 42l begin
+        exit 1ss;
+    end
+end
+END
+
+$MPC $MPCFLAGS -v -o prog main.mp > first
+./prog
+grep -q "cache: 0 hits, 1 misses" first
+
+$MPC $MPCFLAGS -v -o prog main.mp > second
+./prog
+grep -q "cache: 1 hits, 0 misses" second
@@ -0,0 +1,44 @@
+# an object compiled on its own calls back into the program,
+# nothing in the program calls those procedures, but they must
+# still be linked: one is exported, the other is cdecl
+set -e
+
+cat > lib.mp <<'END'
+export Apply
+
+extern proc main_Twice[a:i64] i64
+extern proc main_Half<cdecl>[a:i64] i64
+
+proc Apply[a:i64] i64
+begin
+    return main_Half[main_Twice[a]];
+end
+END
+
+cat > main.mp <<'END'
+export Twice
+
+extern proc lib_Apply[a:i64] i64
+
+proc Twice[a:i64] i64
+begin
+    return a * 2l;
+end
+
+proc Half<cdecl>[a:i64] i64
+begin
+    return a / 2l;
+end
+
+proc main
+begin
+    if lib_Apply[21l] != 21l begin
+        exit 1ss;
+    end
+end
+END
+
+$MPC $MPCFLAGS -c lib.mp
+rm lib.mpi # only the object is linked
+$MPC $MPCFLAGS -o prog main.mp lib.o
+./prog
@@ -0,0 +1,54 @@
+# an object compiled with -c must not be used after one of
+# the modules it depends on changes
+set -e
+
+cat > b.mp <<'END'
+export K, P
+
+const K = 1
+
+struct P begin
+    X:i32;
+end
+END
+
+cat > a.mp <<'END'
+from b import K, P
+
+export F
+
+proc F[] i32
+begin
+    return K + sizeof[P];
+end
+END
+
+cat > main.mp <<'END'
+import a
+from b import K, P
+
+proc main
+begin
+    if a::F[] != K + sizeof[P] begin
+        exit 1ss;
+    end
+end
+END
+
+$MPC $MPCFLAGS -c a.mp
+$MPC $MPCFLAGS -o prog main.mp
+./prog
+
+cat > b.mp <<'END'
+export K, P
+
+const K = 2
+
+struct P begin
+    X:i32;
+    Y:i64;
+end
+END
+
+$MPC $MPCFLAGS -o prog main.mp
+./prog
@@ -0,0 +1,28 @@
+# a procedure from an object compiled on its own, with -c,
+# that the program only knows by its extern declaration
+set -e
+
+cat > lib.mp <<'END'
+export Triple
+
+proc Triple[a:i64] i64
+begin
+    return a * 3l;
+end
+END
+
+cat > main.mp <<'END'
+extern proc lib_Triple[a:i64] i64
+
+proc main
+begin
+    if lib_Triple[14l] != 42l begin
+        exit 1ss;
+    end
+end
+END
+
+$MPC $MPCFLAGS -c lib.mp
+rm lib.mpi # only the object is linked
+$MPC $MPCFLAGS -o prog main.mp lib.o
+./prog
@@ -0,0 +1,33 @@
+# procedures of imported modules that the program doesn't use are
+# left out of the binary, even when the module comes from the cache
+set -e
+
+cat > lib.mp <<'END'
+export Used, Unused
+
+proc Used[a:i64] i64
+begin
+    return a + 1l;
+end
+
+proc Unused[a:i64] i64
+begin
+    return a - 1l;
+end
+END
+
+cat > main.mp <<'END'
+import lib
+
+proc main
+begin
+    if lib::Used[41l] != 42l begin
+        exit 1ss;
+    end
+end
+END
+
+$MPC $MPCFLAGS -v -o prog main.mp > report
+./prog
+grep -q "lib_Unused" report
+! grep -q "lib_Used" report